@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"io/ioutil"
+	"kdc/pkg/client"
+	"kdc/pkg/reqsig"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const clientUsage = "client [flags] address | subtract <fileId> <amount> | read <fileId> [user] | terminate <fileId> |\n" +
+	"       transfer <fileId> <recipient> <amount> |\n" +
+	"       info <fileId> | participants <fileId> | operations <fileId> | earnings <fileId> | files |\n" +
+	"       grant <fileId> <user> <role or capabilities> | revoke <fileId> <user> | audit <fileId> |\n" +
+	"       delegate <fileId> <delegate> <cap> | undelegate <fileId> <delegate> | delegations <fileId> |\n" +
+	"       approve <fileId> <spender> <amount> | charge <fileId> <user> <amount> | allowance <fileId> <user> <spender> |\n" +
+	"       reserve <fileId> <payee> <amount> | capture <fileId> <hold> <amount> | release <fileId> <hold> |\n" +
+	"       reverse <fileId> <operation> <amount> [reason]"
+
+func envOr(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+func loadClientKey(keyFile, keystore, passwordFile string) (*ecdsa.PrivateKey, error) {
+	switch {
+	case "" != keyFile && "" != keystore:
+		return nil, errors.New("use either -key or -keystore")
+	case "" != keyFile:
+		return client.LoadPrivateKey(keyFile)
+	case "" != keystore:
+		var password string
+		if "" != passwordFile {
+			content, err := ioutil.ReadFile(passwordFile)
+			if err != nil {
+				return nil, err
+			}
+			password = strings.TrimSpace(string(content))
+		}
+		return client.LoadKeystore(keystore, password)
+	default:
+		return nil, errors.New("-key or -keystore is required")
+	}
+}
+
+func parseAmount(s string) (*big.Int, error) {
+	amount, ok := new(big.Int).SetString(s, 0)
+	if !ok || amount.Sign() < 0 {
+		return nil, fmt.Errorf("%q is not a positive amount", s)
+	}
+	return amount, nil
+}
+
+func parseLimits(validFrom uint64, validFor time.Duration, maxAmount, dailyCap string) (client.Limits, error) {
+	limits := client.Limits{ValidFrom: validFrom}
+	if validFor > 0 {
+		start := time.Now()
+		if validFrom > 0 {
+			start = time.Unix(int64(validFrom), 0)
+		}
+		limits.ValidUntil = uint64(start.Add(validFor).Unix())
+	}
+	for _, limit := range []struct {
+		value  string
+		target **hexutil.Big
+	}{{maxAmount, &limits.MaxAmount}, {dailyCap, &limits.DailyCap}} {
+		if "" == limit.value {
+			continue
+		}
+		amount, err := parseAmount(limit.value)
+		if err != nil {
+			return limits, err
+		}
+		*limit.target = (*hexutil.Big)(amount)
+	}
+	return limits, nil
+}
+
+func runClient(args []string) error {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: kdc %s\n\n%s\n\nflags:\n", clientUsage, commands["client"].description)
+		fs.PrintDefaults()
+	}
+	url := fs.String("url", envOr("KDC_CLIENT_URL", "http://127.0.0.1:8080/api"), "kdc api endpoint ($KDC_CLIENT_URL)")
+	keyFile := fs.String("key", os.Getenv("KDC_CLIENT_KEY"), "file holding the hex private key ($KDC_CLIENT_KEY)")
+	keystore := fs.String("keystore", os.Getenv("KDC_CLIENT_KEYSTORE"), "keystore file of the account ($KDC_CLIENT_KEYSTORE)")
+	passwordFile := fs.String("password-file", os.Getenv("KDC_CLIENT_PASSWORD_FILE"), "file holding the keystore password ($KDC_CLIENT_PASSWORD_FILE)")
+	chainId := fs.Int64("chain-id", 1, "chain id of the domain the api expects")
+	service := fs.String("service-address", "0xa07b0fc50549c636ad4d7fbc6ea747574efb8e8a", "service address of the domain the api expects")
+	scheme := fs.String("signature-type", string(reqsig.TypedData), "eip712, personal or legacy")
+	lifetime := fs.Duration("lifetime", 5*time.Minute, "how long a signed subtract or privilege change stays valid")
+	opUser := fs.String("user", "", "operations: only the operations of this user")
+	opFrom := fs.Uint64("from", 0, "operations: only the operations at or after this unix time")
+	opTo := fs.Uint64("to", 0, "operations: only the operations at or before this unix time")
+	opOffset := fs.Uint64("offset", 0, "operations: operations to skip")
+	opLimit := fs.Uint64("limit", 0, "operations: maximum number of operations")
+	validFrom := fs.Uint64("valid-from", 0, "grant: unix time the privilege is valid from")
+	validFor := fs.Duration("valid-for", 0, "grant, delegate, reserve: how long the privilege, the delegation or the hold is valid, from -valid-from or now")
+	maxAmount := fs.String("max-amount", "", "grant: largest amount of one subtract")
+	dailyCap := fs.String("daily-cap", "", "grant: largest total of the subtracts of 24 hours")
+	forUser := fs.String("for", "", "subtract: user whose balance is spent, with a delegation to the signer")
+	payee := fs.String("payee", "", "subtract: address credited instead of the owner of the file")
+	details := fs.Bool("details", false, "read: also what holds reserve and what is available; operations: also the signed requests")
+	reference := fs.String("reference", "", "subtract, charge, transfer, capture, reverse: reference recorded with the operations")
+	memo := fs.String("memo", "", "subtract, charge, transfer, capture, reverse: memo recorded with the operations")
+	idempotencyKey := fs.String("idempotency-key", "", "changes: key under which a retry returns the result of the first request")
+	printOnly := fs.Bool("print", false, "print the signed request instead of sending it")
+	fs.Parse(args)
+	rest := fs.Args()
+	if len(rest) < 1 {
+		return usageErr(clientUsage)
+	}
+	key, err := loadClientKey(*keyFile, *keystore, *passwordFile)
+	if err != nil {
+		return err
+	}
+	signer := client.NewSigner(key, *chainId, *service)
+	signer.Scheme = reqsig.Scheme(*scheme)
+	signer.Lifetime = *lifetime
+	c := client.New(*url, signer)
+
+	var req *client.Request
+	switch {
+	case rest[0] == "address" && len(rest) == 1:
+		fmt.Println(c.Address())
+		return nil
+	case rest[0] == "subtract" && len(rest) == 3:
+		var amount *big.Int
+		amount, err = parseAmount(rest[2])
+		if err == nil {
+			user := c.Address()
+			if "" != *forUser {
+				user = *forUser
+			}
+			req, err = signer.SubtractToRequest(c.NextId(), rest[1], user, amount, *payee)
+		}
+	case rest[0] == "transfer" && len(rest) == 4:
+		var amount *big.Int
+		amount, err = parseAmount(rest[3])
+		if err == nil {
+			req, err = signer.TransferRequest(c.NextId(), rest[1], rest[2], amount)
+		}
+	case rest[0] == "read" && (len(rest) == 2 || len(rest) == 3):
+		user := c.Address()
+		if len(rest) == 3 {
+			user = rest[2]
+		}
+		if *details {
+			req, err = signer.ReadBalanceRequest(c.NextId(), rest[1], user)
+		} else {
+			req, err = signer.ReadRequest(c.NextId(), rest[1], user)
+		}
+	case rest[0] == "terminate" && len(rest) == 2:
+		req, err = signer.TerminateRequest(c.NextId(), rest[1])
+	case rest[0] == "info" && len(rest) == 2:
+		req, err = signer.GetFileInfoRequest(c.NextId(), rest[1])
+	case rest[0] == "participants" && len(rest) == 2:
+		req, err = signer.ListParticipantsRequest(c.NextId(), rest[1])
+	case rest[0] == "operations" && len(rest) == 2:
+		filter := client.OperationFilter{User: *opUser, From: *opFrom, To: *opTo, Offset: *opOffset, Limit: *opLimit}
+		req, err = signer.ListOperationsRequest(c.NextId(), rest[1], filter)
+		if err == nil {
+			req.Params.Details = *details
+		}
+	case rest[0] == "earnings" && len(rest) == 2:
+		req, err = signer.ListEarningsRequest(c.NextId(), rest[1])
+	case rest[0] == "files" && len(rest) == 1:
+		req, err = signer.ListMyFilesRequest(c.NextId())
+	case rest[0] == "grant" && len(rest) == 4:
+		var limits client.Limits
+		limits, err = parseLimits(*validFrom, *validFor, *maxAmount, *dailyCap)
+		if err == nil {
+			req, err = signer.GrantPrivilegeRequest(c.NextId(), rest[1], rest[2], rest[3], limits)
+		}
+	case rest[0] == "revoke" && len(rest) == 3:
+		req, err = signer.RevokePrivilegeRequest(c.NextId(), rest[1], rest[2])
+	case rest[0] == "audit" && len(rest) == 2:
+		req, err = signer.ListPrivilegeEventsRequest(c.NextId(), rest[1])
+	case rest[0] == "delegate" && len(rest) == 4:
+		if 0 == *validFor {
+			return errors.New("delegate: -valid-for is required")
+		}
+		var limit *big.Int
+		limit, err = parseAmount(rest[3])
+		if err == nil {
+			req, err = signer.DelegateRequest(c.NextId(), rest[1], rest[2], limit, uint64(time.Now().Add(*validFor).Unix()))
+		}
+	case rest[0] == "undelegate" && len(rest) == 3:
+		req, err = signer.RevokeDelegationRequest(c.NextId(), rest[1], rest[2])
+	case rest[0] == "delegations" && len(rest) == 2:
+		req, err = signer.ListDelegationsRequest(c.NextId(), rest[1])
+	case (rest[0] == "approve" || rest[0] == "charge") && len(rest) == 4:
+		var amount *big.Int
+		amount, err = parseAmount(rest[3])
+		if err == nil && rest[0] == "approve" {
+			req, err = signer.ApproveRequest(c.NextId(), rest[1], rest[2], amount)
+		} else if err == nil {
+			req, err = signer.ChargeRequest(c.NextId(), rest[1], rest[2], amount)
+		}
+	case rest[0] == "allowance" && len(rest) == 4:
+		req, err = signer.AllowanceRequest(c.NextId(), rest[1], rest[2], rest[3])
+	case rest[0] == "reserve" && len(rest) == 4:
+		if 0 == *validFor {
+			return errors.New("reserve: -valid-for is required")
+		}
+		var amount *big.Int
+		amount, err = parseAmount(rest[3])
+		if err == nil {
+			req, err = signer.ReserveRequest(c.NextId(), rest[1], rest[2], amount, uint64(time.Now().Add(*validFor).Unix()))
+		}
+	case rest[0] == "capture" && len(rest) == 4:
+		var hold uint64
+		var amount *big.Int
+		hold, err = strconv.ParseUint(rest[2], 10, 64)
+		if err == nil {
+			amount, err = parseAmount(rest[3])
+		}
+		if err == nil {
+			req, err = signer.CaptureRequest(c.NextId(), rest[1], hold, amount)
+		}
+	case rest[0] == "release" && len(rest) == 3:
+		var hold uint64
+		hold, err = strconv.ParseUint(rest[2], 10, 64)
+		if err == nil {
+			req, err = signer.ReleaseRequest(c.NextId(), rest[1], hold)
+		}
+	case rest[0] == "reverse" && (len(rest) == 4 || len(rest) == 5):
+		var operation uint64
+		var amount *big.Int
+		var reason string
+		if len(rest) == 5 {
+			reason = rest[4]
+		}
+		operation, err = strconv.ParseUint(rest[2], 10, 64)
+		if err == nil {
+			amount, err = parseAmount(rest[3])
+		}
+		if err == nil {
+			req, err = signer.ReverseRequest(c.NextId(), rest[1], operation, amount, reason)
+		}
+	default:
+		return usageErr(clientUsage)
+	}
+	if err != nil {
+		return err
+	}
+	if "" != *reference || "" != *memo {
+		req.WithMeta(*reference, *memo)
+	}
+	if "" != *idempotencyKey {
+		req.WithIdempotencyKey(*idempotencyKey)
+	}
+	if *printOnly {
+		return printJSON(req)
+	}
+	result, err := c.Send(req)
+	if err != nil {
+		return err
+	}
+	var out interface{}
+	json.Unmarshal(result, &out)
+	return printJSON(out)
+}
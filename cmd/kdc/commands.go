@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/internal/pkg/core"
+	"kdc/internal/pkg/service"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+func printJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func runServe(args []string) error {
+	conf, rest, err := setup("serve", args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return usageErr(commands["serve"].usage)
+	}
+	err = conf.RequireSyncAccount()
+	if err != nil {
+		return err
+	}
+	// the api exits the process itself when it cannot listen
+	go service.RunService()
+
+	stop := make(chan struct{})
+	var workers sync.WaitGroup
+	start := func(worker func(stop <-chan struct{})) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			worker(stop)
+		}()
+	}
+	start(service.RunIngester)
+	start(service.RunSettlementWorker)
+	if conf.Settlement.BatchEnabled {
+		start(service.RunSyncBatcher)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	fmt.Fprintf(os.Stderr, "received %s, stopping\n", sig)
+	close(stop)
+	workers.Wait()
+	return nil
+}
+
+func runSync(args []string) error {
+	_, rest, err := setup("sync", args)
+	if err != nil {
+		return err
+	}
+	if len(rest) < 1 || len(rest) > 2 {
+		return usageErr(commands["sync"].usage)
+	}
+	from := rest[0]
+	var to string
+	if len(rest) == 2 {
+		to = rest[1]
+	} else {
+		to = service.GetBlockNumber()
+	}
+	for _, block := range []string{from, to} {
+		if _, err := hexutil.DecodeUint64(block); err != nil {
+			return fmt.Errorf("%q is not a hex block number", block)
+		}
+	}
+	created, err := service.IngestBlockRange(from, to)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("ingested %d files from blocks %s to %s\n", created, from, to)
+	return nil
+}
+
+type fileDetailsT struct {
+	core.FileInfoT
+	InitMortgage   map[string]string  `json:"initMortgage"`
+	RemainMortgage *core.MortgageT    `json:"remainMortgage"`
+	Earnings       *core.MortgageT    `json:"earnings"`
+	Deposits       []core.DepositT    `json:"deposits"`
+	Settlements    []core.SettlementT `json:"settlements"`
+}
+
+func runFile(args []string) error {
+	_, rest, err := setup("file", args)
+	if err != nil {
+		return err
+	}
+	if len(rest) == 1 && rest[0] == "list" {
+		return listFiles()
+	}
+	if len(rest) == 2 && rest[0] == "show" {
+		return showFile(rest[1])
+	}
+	return usageErr(commands["file"].usage)
+}
+
+func listFiles() error {
+	files, err := core.ListFiles()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tOWNER\tOPEN\tSTATE\tEND\tCREATED")
+	for _, file := range files {
+		end := "-"
+		if file.EndTime > 0 {
+			end = time.Unix(file.EndTime, 0).UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\t%s\n", file.FileId, file.Owner, file.IsOpen, file.State, end,
+			time.Unix(file.CreateTime, 0).UTC().Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func showFile(fileId string) error {
+	info, err := core.GetFileInfo(fileId)
+	if err != nil {
+		return err
+	}
+	details := fileDetailsT{FileInfoT: *info, InitMortgage: make(map[string]string)}
+	initMortgage, err := core.InitMortgage(fileId)
+	if err != nil {
+		return err
+	}
+	for user, value := range *initMortgage {
+		details.InitMortgage[user] = value.String()
+	}
+	details.RemainMortgage, err = core.RemainMortgage(fileId)
+	if err != nil {
+		return err
+	}
+	details.Earnings, err = core.Earnings(fileId)
+	if err != nil {
+		return err
+	}
+	details.Deposits, err = core.ListDeposits(fileId)
+	if err != nil {
+		return err
+	}
+	details.Settlements, err = core.ListSettlements(fileId)
+	if err != nil {
+		return err
+	}
+	return printJSON(details)
+}
+
+func runBalance(args []string) error {
+	_, rest, err := setup("balance", args)
+	if err != nil {
+		return err
+	}
+	if len(rest) < 1 || len(rest) > 2 {
+		return usageErr(commands["balance"].usage)
+	}
+	remain, err := core.RemainMortgage(rest[0])
+	if err != nil {
+		return err
+	}
+	if len(rest) == 2 {
+		value, ok := (*remain)[rest[1]]
+		if !ok {
+			return fmt.Errorf("%s has no balance in file %s", rest[1], rest[0])
+		}
+		fmt.Println(value)
+		return nil
+	}
+	var users []string
+	for user := range *remain {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tBALANCE")
+	for _, user := range users {
+		fmt.Fprintf(w, "%s\t%s\n", user, (*remain)[user])
+	}
+	return w.Flush()
+}
+
+func runTerminate(args []string) error {
+	conf, rest, err := setup("terminate", args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 {
+		return usageErr(commands["terminate"].usage)
+	}
+	err = conf.RequireSyncAccount()
+	if err != nil {
+		return err
+	}
+	info, err := core.GetFileInfo(rest[0])
+	if err != nil {
+		return err
+	}
+	if !info.IsOpen {
+		return errors.New("file " + info.FileId + " is already terminated")
+	}
+	_, err = core.Terminate(info.Owner, info.FileId)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("file %s terminated, settlement sent\n", info.FileId)
+	return nil
+}
+
+func runSimulate(args []string) error {
+	_, rest, err := setup("simulate", args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 {
+		return usageErr(commands["simulate"].usage)
+	}
+	simulation, err := service.SimulateSettlement(rest[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(simulation)
+}
+
+func runReconcile(args []string) error {
+	_, rest, err := setup("reconcile", args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 {
+		return usageErr(commands["reconcile"].usage)
+	}
+	report, err := service.Reconcile(rest[0])
+	if err != nil {
+		return err
+	}
+	return report.WriteJSON(os.Stdout)
+}
+
+func runPolicy(args []string) error {
+	_, rest, err := setup("policy", args)
+	if err != nil {
+		return err
+	}
+	if (len(rest) != 4 && len(rest) != 5) || rest[0] != "test" {
+		return usageErr(commands["policy"].usage)
+	}
+	now := time.Now().Unix()
+	if len(rest) == 5 {
+		now, err = strconv.ParseInt(rest[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a unix time", rest[4])
+		}
+	}
+	ctx, decision, err := core.EvaluateRequest(rest[1], rest[2], rest[3], now)
+	if err != nil {
+		return err
+	}
+	return printJSON(map[string]interface{}{
+		"allowed": decision.Allowed,
+		"rule":    decision.Rule,
+		"context": map[string]interface{}{
+			"user": ctx.User, "fileId": ctx.FileId, "action": ctx.Action, "now": ctx.Now,
+			"known": ctx.Known, "owner": ctx.Owner, "participant": ctx.Participant,
+			"capabilities": ctx.Capabilities.String(), "open": ctx.Open, "endTime": ctx.EndTime,
+		},
+	})
+}
+
+func runMigrate(args []string) error {
+	conf, rest, err := parseFlags("migrate", args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return usageErr(commands["migrate"].usage)
+	}
+	from, to, err := core.MigrateDatabase(conf.Data.Dir)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		fmt.Printf("database is at version %d, nothing to do\n", to)
+	} else {
+		fmt.Printf("database migrated from version %d to %d\n", from, to)
+	}
+	return nil
+}
+
+func runVersion(args []string) error {
+	if len(args) != 0 {
+		return usageErr(commands["version"].usage)
+	}
+	fmt.Printf("kdc %s (schema version %d)\n", version, core.LatestSchemaVersion())
+	return nil
+}
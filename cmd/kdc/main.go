@@ -1,7 +1,120 @@
 package main
 
-import "fmt"
+import (
+	"flag"
+	"fmt"
+	"kdc/internal/pkg/config"
+	"kdc/internal/pkg/core"
+	"kdc/internal/pkg/service"
+	"os"
+	"sort"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+type command struct {
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"serve":     {"serve [flags]", "run the api, the chain ingester and the settlement worker", runServe},
+		"sync":      {"sync [flags] <fromBlock> [toBlock]", "ingest the mortgage inits of a block range once", runSync},
+		"file":      {"file [flags] show <fileId> | list", "show one file or list all files of the ledger", runFile},
+		"balance":   {"balance [flags] <fileId> [user]", "print the balances of a file", runBalance},
+		"terminate": {"terminate [flags] <fileId>", "terminate a file on behalf of its owner and settle it", runTerminate},
+		"simulate":  {"simulate [flags] <fileId>", "show the sync transactions settling a file would send", runSimulate},
+		"reconcile": {"reconcile [flags] <fromBlock>", "compare the ledger with the chain and print a json report", runReconcile},
+		"migrate":   {"migrate [flags]", "upgrade the ledger to the current schema", runMigrate},
+		"policy":    {"policy [flags] test <user> <fileId> <action> [unixTime]", "evaluate the authorization policy for a hypothetical request", runPolicy},
+		"version":   {"version", "print the kdc version", runVersion},
+		"client":    {clientUsage, "sign and send requests to a kdc api", runClient},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: kdc <command> [flags] [arguments]\n\ncommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].description)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun 'kdc <command> -h' for the flags of a command\n")
+}
+
+// parseFlags parses the configuration flags shared by every command and returns the
+// loaded configuration with the remaining arguments.
+func parseFlags(name string, args []string) (*config.Config, []string, error) {
+	cmd := commands[name]
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: kdc %s\n\n%s\n\nflags:\n", cmd.usage, cmd.description)
+		fs.PrintDefaults()
+	}
+	flags := config.RegisterFlags(fs)
+	fs.Parse(args)
+	conf, err := flags.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = conf.SetupLogging()
+	if err != nil {
+		return nil, nil, err
+	}
+	return conf, fs.Args(), nil
+}
+
+// setup loads the configuration, opens the ledger and configures the service.
+func setup(name string, args []string) (*config.Config, []string, error) {
+	conf, rest, err := parseFlags(name, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = core.OpenDatabase(conf.Data.Dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = core.LoadPolicy(conf.Policy.File)
+	if err != nil {
+		return nil, nil, err
+	}
+	service.Configure(conf)
+	return conf, rest, nil
+}
+
+type usageErr string
+
+func (e usageErr) Error() string {
+	return "usage: kdc " + string(e)
+}
 
 func main() {
-	fmt.Printf("Hello, world.\n")
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		if os.Args[1] != "help" && os.Args[1] != "-h" && os.Args[1] != "--help" {
+			fmt.Fprintf(os.Stderr, "kdc: unknown command %q\n\n", os.Args[1])
+		}
+		usage()
+		os.Exit(2)
+	}
+	err := cmd.run(os.Args[2:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if _, ok := err.(usageErr); ok {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,369 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ChainConfig struct {
+	// json-rpc endpoint of the chain node
+	Url string `yaml:"url"`
+	// first block ingested by a new ledger
+	StartBlock string `yaml:"startBlock"`
+	// how often new blocks are ingested
+	PollInterval time.Duration `yaml:"pollInterval"`
+	// account receiving the special transactions
+	SpecialAccount              string `yaml:"specialAccount"`
+	SyncTransactionType         string `yaml:"syncTransactionType"`
+	SyncBatchTransactionType    string `yaml:"syncBatchTransactionType"`
+	MortgageInitTransactionType string `yaml:"mortgageInitTransactionType"`
+	// type of the special transactions topping up open files, none ingested when empty,
+	// the default
+	DepositTransactionType string `yaml:"depositTransactionType"`
+}
+
+type AccountConfig struct {
+	// account that signs the sync transactions, unlocked on the node
+	SyncAccount string `yaml:"syncAccount"`
+	// file holding the password of the sync account
+	PasswordFile string `yaml:"passwordFile"`
+	Password     string `yaml:"-"`
+}
+
+type GasConfig struct {
+	Gas      string `yaml:"gas"`
+	GasPrice string `yaml:"gasPrice"`
+}
+
+type SettlementConfig struct {
+	// how often expired files are settled and pending sync transactions checked
+	Interval         time.Duration `yaml:"interval"`
+	MaxParticipants  int           `yaml:"maxParticipants"`
+	MaxExtraDataSize int           `yaml:"maxExtraDataSize"`
+	BatchEnabled     bool          `yaml:"batchEnabled"`
+	BatchInterval    time.Duration `yaml:"batchInterval"`
+}
+
+type ApiConfig struct {
+	Listen string `yaml:"listen"`
+	// file holding the key of the admin api, which is disabled without it
+	AdminKeyFile string `yaml:"adminKeyFile"`
+	AdminKey     string `yaml:"-"`
+	// eip-712 domain requests are signed under
+	ChainId        int64  `yaml:"chainId"`
+	ServiceAddress string `yaml:"serviceAddress"`
+	// accept the legacy concatenated request signatures
+	LegacySignatures bool `yaml:"legacySignatures"`
+	// how far in the future the expiry of a signed request may be
+	MaxRequestLifetime time.Duration `yaml:"maxRequestLifetime"`
+	// how long the result of a request made under an idempotency key is kept
+	IdempotencyKeyLifetime time.Duration `yaml:"idempotencyKeyLifetime"`
+}
+
+type DataConfig struct {
+	Dir string `yaml:"dir"`
+}
+
+type LogConfig struct {
+	Level string `yaml:"level"`
+	// log file, stderr when empty
+	File string `yaml:"file"`
+}
+
+type PolicyConfig struct {
+	// yaml authorization policy, the privileges of the users decide when empty
+	File string `yaml:"file"`
+}
+
+type Config struct {
+	Chain      ChainConfig      `yaml:"chain"`
+	Account    AccountConfig    `yaml:"account"`
+	Gas        GasConfig        `yaml:"gas"`
+	Settlement SettlementConfig `yaml:"settlement"`
+	Api        ApiConfig        `yaml:"api"`
+	Data       DataConfig       `yaml:"data"`
+	Log        LogConfig        `yaml:"log"`
+	Policy     PolicyConfig     `yaml:"policy"`
+}
+
+// setting is a value that can be overridden from the environment and the command line.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"chain.url", "KDC_CHAIN_URL", "json-rpc endpoint of the chain node",
+		func(c *Config, v string) error { c.Chain.Url = v; return nil }},
+	{"chain.start-block", "KDC_CHAIN_START_BLOCK", "first block ingested by a new ledger",
+		func(c *Config, v string) error { c.Chain.StartBlock = v; return nil }},
+	{"chain.special-account", "KDC_CHAIN_SPECIAL_ACCOUNT", "account receiving the special transactions",
+		func(c *Config, v string) error { c.Chain.SpecialAccount = v; return nil }},
+	{"account.sync", "KDC_ACCOUNT_SYNC", "account that signs the sync transactions",
+		func(c *Config, v string) error { c.Account.SyncAccount = v; return nil }},
+	{"account.password-file", "KDC_ACCOUNT_PASSWORD_FILE", "file holding the password of the sync account",
+		func(c *Config, v string) error { c.Account.PasswordFile = v; return nil }},
+	{"gas.gas", "KDC_GAS", "gas limit of sync transactions",
+		func(c *Config, v string) error { c.Gas.Gas = v; return nil }},
+	{"gas.price", "KDC_GAS_PRICE", "gas price of sync transactions",
+		func(c *Config, v string) error { c.Gas.GasPrice = v; return nil }},
+	{"settlement.batch", "KDC_SETTLEMENT_BATCH", "send settlements of several files together",
+		func(c *Config, v string) error { return parseBool(v, &c.Settlement.BatchEnabled) }},
+	{"settlement.batch-interval", "KDC_SETTLEMENT_BATCH_INTERVAL", "how often batched settlements are sent",
+		func(c *Config, v string) (err error) { c.Settlement.BatchInterval, err = time.ParseDuration(v); return }},
+	{"api.listen", "KDC_API_LISTEN", "listen address of the api",
+		func(c *Config, v string) error { c.Api.Listen = v; return nil }},
+	{"api.admin-key-file", "KDC_API_ADMIN_KEY_FILE", "file holding the key of the admin api",
+		func(c *Config, v string) error { c.Api.AdminKeyFile = v; return nil }},
+	{"api.chain-id", "KDC_API_CHAIN_ID", "chain id of the domain requests are signed under",
+		func(c *Config, v string) (err error) { c.Api.ChainId, err = strconv.ParseInt(v, 0, 64); return }},
+	{"api.service-address", "KDC_API_SERVICE_ADDRESS", "address of the domain requests are signed under",
+		func(c *Config, v string) error { c.Api.ServiceAddress = v; return nil }},
+	{"api.legacy-signatures", "KDC_API_LEGACY_SIGNATURES", "accept legacy request signatures",
+		func(c *Config, v string) error { return parseBool(v, &c.Api.LegacySignatures) }},
+	{"api.max-request-lifetime", "KDC_API_MAX_REQUEST_LIFETIME", "how far in the future the expiry of a signed request may be",
+		func(c *Config, v string) (err error) { c.Api.MaxRequestLifetime, err = time.ParseDuration(v); return }},
+	{"api.idempotency-key-lifetime", "KDC_API_IDEMPOTENCY_KEY_LIFETIME", "how long the result of a request with an idempotency key is kept",
+		func(c *Config, v string) (err error) {
+			c.Api.IdempotencyKeyLifetime, err = time.ParseDuration(v)
+			return
+		}},
+	{"data.dir", "KDC_DATA_DIR", "directory of the ledger database",
+		func(c *Config, v string) error { c.Data.Dir = v; return nil }},
+	{"log.level", "KDC_LOG_LEVEL", "log level",
+		func(c *Config, v string) error { c.Log.Level = v; return nil }},
+	{"log.file", "KDC_LOG_FILE", "log file, stderr when empty",
+		func(c *Config, v string) error { c.Log.File = v; return nil }},
+	{"policy.file", "KDC_POLICY_FILE", "yaml authorization policy",
+		func(c *Config, v string) error { c.Policy.File = v; return nil }},
+}
+
+func parseBool(v string, dst *bool) error {
+	if v != "true" && v != "false" {
+		return fmt.Errorf("expected true or false, got %q", v)
+	}
+	*dst = v == "true"
+	return nil
+}
+
+// Default returns the configuration used when nothing overrides it.
+func Default() *Config {
+	dataDir := ".kdc"
+	if usr, err := user.Current(); err == nil {
+		dataDir = filepath.Join(usr.HomeDir, ".kdc")
+	}
+	return &Config{
+		Chain: ChainConfig{
+			Url:                         "http://127.0.0.1:8545",
+			StartBlock:                  "0x0",
+			PollInterval:                15 * time.Second,
+			SpecialAccount:              "0xa07b0fc50549c636ad4d7fbc6ea747574efb8e8a",
+			SyncTransactionType:         "0x7",
+			SyncBatchTransactionType:    "0x8",
+			MortgageInitTransactionType: "0x4",
+			DepositTransactionType:      "",
+		},
+		Gas: GasConfig{
+			Gas:      "0x34502",
+			GasPrice: "0x9122",
+		},
+		Settlement: SettlementConfig{
+			Interval:         30 * time.Second,
+			MaxParticipants:  500,
+			MaxExtraDataSize: 32 * 1024,
+			BatchInterval:    30 * time.Second,
+		},
+		Api: ApiConfig{
+			Listen:                 ":8080",
+			ChainId:                1,
+			ServiceAddress:         "0xa07b0fc50549c636ad4d7fbc6ea747574efb8e8a",
+			MaxRequestLifetime:     10 * time.Minute,
+			IdempotencyKeyLifetime: 24 * time.Hour,
+		},
+		Data: DataConfig{
+			Dir: dataDir,
+		},
+		Log: LogConfig{
+			Level: "INFO",
+		},
+	}
+}
+
+// Flags holds the command line overrides registered on a flag set.
+type Flags struct {
+	path   *string
+	values map[string]*string
+	fs     *flag.FlagSet
+}
+
+// RegisterFlags adds -config and one flag per overridable setting to fs.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	flags := &Flags{
+		path:   fs.String("config", os.Getenv("KDC_CONFIG"), "yaml configuration file"),
+		values: make(map[string]*string),
+		fs:     fs,
+	}
+	for _, s := range settings {
+		flags.values[s.flag] = fs.String(s.flag, "", s.usage+" ($"+s.env+")")
+	}
+	return flags
+}
+
+// Load builds the configuration from the defaults, the configuration file, the
+// environment and the command line, in increasing order of precedence, then reads
+// the secret files and validates the result. fs must have been parsed.
+func (f *Flags) Load() (*Config, error) {
+	c := Default()
+	if "" != *f.path {
+		err := c.loadFile(*f.path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(c, value); err != nil {
+				return nil, fmt.Errorf("$%s: %s", s.env, err)
+			}
+		}
+	}
+	var err error
+	f.fs.Visit(func(fl *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == fl.Name && err == nil {
+				if setErr := s.set(c, *f.values[s.flag]); setErr != nil {
+					err = fmt.Errorf("-%s: %s", s.flag, setErr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = c.loadSecrets()
+	if err != nil {
+		return nil, err
+	}
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = yaml.UnmarshalStrict(content, c)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+func readSecret(path string) (string, error) {
+	if "" == path {
+		return "", nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func (c *Config) loadSecrets() (err error) {
+	c.Account.Password, err = readSecret(c.Account.PasswordFile)
+	if err != nil {
+		return err
+	}
+	c.Api.AdminKey, err = readSecret(c.Api.AdminKeyFile)
+	return err
+}
+
+// Validate reports the first setting that cannot work.
+func (c *Config) Validate() error {
+	u, err := url.Parse(c.Chain.Url)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("chain.url: invalid url %q", c.Chain.Url)
+	}
+	if !common.IsHexAddress(c.Chain.SpecialAccount) {
+		return fmt.Errorf("chain.specialAccount: invalid address %q", c.Chain.SpecialAccount)
+	}
+	if "" != c.Account.SyncAccount && !common.IsHexAddress(c.Account.SyncAccount) {
+		return fmt.Errorf("account.syncAccount: invalid address %q", c.Account.SyncAccount)
+	}
+	for name, value := range map[string]string{
+		"chain.startBlock":                  c.Chain.StartBlock,
+		"chain.syncTransactionType":         c.Chain.SyncTransactionType,
+		"chain.syncBatchTransactionType":    c.Chain.SyncBatchTransactionType,
+		"chain.mortgageInitTransactionType": c.Chain.MortgageInitTransactionType,
+		"gas.gas":                           c.Gas.Gas,
+		"gas.gasPrice":                      c.Gas.GasPrice,
+	} {
+		if _, err := hexutil.DecodeUint64(value); err != nil {
+			return fmt.Errorf("%s: %q is not a hex quantity", name, value)
+		}
+	}
+	if _, err := hexutil.DecodeUint64(c.Chain.DepositTransactionType); "" != c.Chain.DepositTransactionType && err != nil {
+		return fmt.Errorf("chain.depositTransactionType: %q is not a hex quantity", c.Chain.DepositTransactionType)
+	}
+	if c.Chain.PollInterval <= 0 || c.Settlement.Interval <= 0 {
+		return errors.New("chain.pollInterval and settlement.interval must be positive")
+	}
+	if c.Settlement.MaxParticipants <= 0 || c.Settlement.MaxExtraDataSize <= 0 {
+		return errors.New("settlement: maxParticipants and maxExtraDataSize must be positive")
+	}
+	if c.Settlement.BatchEnabled && c.Settlement.BatchInterval <= 0 {
+		return errors.New("settlement.batchInterval: must be positive when batching is enabled")
+	}
+	if "" == c.Api.Listen {
+		return errors.New("api.listen: must not be empty")
+	}
+	if c.Api.ChainId <= 0 {
+		return fmt.Errorf("api.chainId: %d is not a chain id", c.Api.ChainId)
+	}
+	if c.Api.MaxRequestLifetime <= 0 {
+		return errors.New("api.maxRequestLifetime: must be positive")
+	}
+	if c.Api.IdempotencyKeyLifetime <= 0 {
+		return errors.New("api.idempotencyKeyLifetime: must be positive")
+	}
+	if !common.IsHexAddress(c.Api.ServiceAddress) {
+		return fmt.Errorf("api.serviceAddress: invalid address %q", c.Api.ServiceAddress)
+	}
+	if "" == c.Data.Dir {
+		return errors.New("data.dir: must not be empty")
+	}
+	if _, err := logLevel(c.Log.Level); err != nil {
+		return fmt.Errorf("log.level: %s", err)
+	}
+	return nil
+}
+
+// RequireSyncAccount reports whether the configuration can send sync transactions.
+func (c *Config) RequireSyncAccount() error {
+	if "" == c.Account.SyncAccount {
+		return errors.New("account.syncAccount: required to send sync transactions")
+	}
+	if "" == c.Account.Password {
+		return errors.New("account.passwordFile: required to unlock the sync account")
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kdc-config")
+	defer os.RemoveAll(dir)
+	passwordFile := writeFile(t, dir, "password", "secret\n")
+	configFile := writeFile(t, dir, "kdc.yaml", `
+chain:
+  url: http://node:8545
+account:
+  syncAccount: "0xaf7a12de8dc1de25c0541966695498074f52a1cc"
+  passwordFile: `+passwordFile+`
+settlement:
+  batchEnabled: true
+  batchInterval: 10s
+api:
+  listen: ":9000"
+log:
+  level: DEBUG
+`)
+	os.Setenv("KDC_API_LISTEN", ":9001")
+	os.Setenv("KDC_LOG_LEVEL", "WARNING")
+	defer os.Unsetenv("KDC_API_LISTEN")
+	defer os.Unsetenv("KDC_LOG_LEVEL")
+
+	fs := flag.NewFlagSet("kdc", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	err := fs.Parse([]string{"-config", configFile, "-log.level", "ERROR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := flags.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Chain.Url != "http://node:8545" || c.Settlement.BatchInterval != 10*time.Second || !c.Settlement.BatchEnabled {
+		t.Errorf("file values not applied: %+v", c)
+	}
+	if c.Api.Listen != ":9001" {
+		t.Errorf("expected environment to override file, got %s", c.Api.Listen)
+	}
+	if c.Log.Level != "ERROR" {
+		t.Errorf("expected flag to override environment, got %s", c.Log.Level)
+	}
+	if c.Account.Password != "secret" {
+		t.Errorf("expected password from file, got %q", c.Account.Password)
+	}
+	if c.Gas.Gas != Default().Gas.Gas {
+		t.Errorf("expected default gas, got %s", c.Gas.Gas)
+	}
+	if err = c.RequireSyncAccount(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for name, broken := range map[string]func(c *Config){
+		"url":      func(c *Config) { c.Chain.Url = "127.0.0.1" },
+		"special":  func(c *Config) { c.Chain.SpecialAccount = "0x12" },
+		"gas":      func(c *Config) { c.Gas.Gas = "100" },
+		"chunks":   func(c *Config) { c.Settlement.MaxParticipants = 0 },
+		"listen":   func(c *Config) { c.Api.Listen = "" },
+		"chainid":  func(c *Config) { c.Api.ChainId = 0 },
+		"service":  func(c *Config) { c.Api.ServiceAddress = "kdc" },
+		"loglevel": func(c *Config) { c.Log.Level = "LOUD" },
+	} {
+		c := Default()
+		broken(c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+	if err := Default().RequireSyncAccount(); err == nil {
+		t.Error("expected default configuration to have no sync account")
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kdc-config")
+	defer os.RemoveAll(dir)
+	configFile := writeFile(t, dir, "kdc.yaml", "chain:\n  uri: http://node:8545\n")
+	if err := Default().loadFile(configFile); err == nil {
+		t.Error("expected unknown key to be rejected")
+	}
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"github.com/op/go-logging"
+	"io"
+	"os"
+)
+
+var logFormat = logging.MustStringFormatter(`%{time:2006-01-02 15:04:05.000} %{level:.4s} [%{module}] %{message}`)
+
+func logLevel(level string) (logging.Level, error) {
+	return logging.LogLevel(level)
+}
+
+// SetupLogging sends every go-logging logger to the configured file at the configured level.
+func (c *Config) SetupLogging() error {
+	level, err := logLevel(c.Log.Level)
+	if err != nil {
+		return err
+	}
+	var out io.Writer = os.Stderr
+	if "" != c.Log.File {
+		file, err := os.OpenFile(c.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+	backend := logging.NewBackendFormatter(logging.NewLogBackend(out, "", 0), logFormat)
+	leveled := logging.AddModuleLevel(backend)
+	leveled.SetLevel(level, "")
+	logging.SetBackend(leveled)
+	return nil
+}
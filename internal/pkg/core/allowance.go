@@ -0,0 +1,85 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var InvalidAllowanceErr = errors.New("invalid allowance")
+var AllowanceExceededErr = errors.New("amount above the allowance")
+
+// AllowanceT is what a spender, e.g. a payee, may still charge to the balance of a
+// user in a file, like an ERC-20 allowance.
+type AllowanceT struct {
+	FileId    string
+	User      string
+	Spender   string
+	Remaining *CoinUnitT
+	// signature of the request of the user that set the allowance
+	Signature  string
+	UpdateTime int64
+}
+
+// Approve sets what spender may charge to the balance of user in a file to amount,
+// whatever was left of a previous allowance. Zero removes the allowance. The user must
+// be allowed to charge.
+func Approve(user string, fileId string, spender string, amount *CoinUnitT, signature string) (*AllowanceT, error) {
+	if user == spender || nil == amount || amount.Sign() < 0 {
+		return nil, InvalidAllowanceErr
+	}
+	if err := authorize(user, fileId, CapCharge); err != nil {
+		return nil, err
+	}
+	allowance := &AllowanceT{FileId: fileId, User: user, Spender: spender, Remaining: amount, Signature: signature,
+		UpdateTime: time.Now().Unix()}
+	return allowance, putAllowance(allowance)
+}
+
+// GetAllowance returns the allowance user gave spender in a file and the balance of the
+// user, to the user, to the spender while something is left of the allowance or to a
+// user allowed to read all balances.
+func GetAllowance(readingUser string, fileId string, user string, spender string) (*AllowanceT, *CoinUnitT, error) {
+	allowance, err := getAllowance(fileId, user, spender)
+	if err != nil {
+		return nil, nil, err
+	}
+	if readingUser != user && (readingUser != spender || allowance.Remaining.Sign() == 0) {
+		if err := authorize(readingUser, fileId, CapReadAll); err != nil {
+			return nil, nil, err
+		}
+	} else if _, err := getFileInfo(fileId); err == sql.ErrNoRows {
+		return nil, nil, NoPermissionErr
+	}
+	balance, err := readValueDirect(fileId, user)
+	if err != nil {
+		return nil, nil, err
+	}
+	return allowance, balance, nil
+}
+
+// ChargeAllowance subtracts amount from the balance of user in a file on behalf of
+// spender, within the allowance user gave it and the privilege of the user, and credits
+// it to the spender, see SubtractValueTo. It returns the balance and the allowance after
+// the charge.
+func ChargeAllowance(spender string, user string, fileId string, amount *CoinUnitT, meta *OperationMetaT) (*CoinUnitT, *AllowanceT, error) {
+	if amount.Sign() < 0 {
+		return nil, nil, NoNegativeValueAllowedErr
+	}
+	if err := checkMeta(meta); err != nil {
+		return nil, nil, err
+	}
+	// the allowance is taken first so that concurrent charges cannot exceed it
+	allowance, err := spendAllowance(fileId, user, spender, amount)
+	if err != nil {
+		return nil, nil, err
+	}
+	balance, err := SubtractValueTo(user, fileId, amount, spender, meta)
+	if err != nil {
+		if _, rollbackErr := spendAllowance(fileId, user, spender, new(CoinUnitT).Neg(amount)); rollbackErr != nil {
+			dbLog.Errorf("give back %s to the allowance of %s to %s in %s: %s", amount, user, spender, fileId, rollbackErr)
+		}
+		return nil, nil, err
+	}
+	return balance, allowance, nil
+}
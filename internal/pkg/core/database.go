@@ -7,8 +7,8 @@ import (
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/op/go-logging"
+	"math/big"
 	"os"
-	"os/user"
 	"path/filepath"
 	"sync"
 	"time"
@@ -23,53 +23,50 @@ func getModificationTableName(fileId string) string {
 	return fmt.Sprintf("FILE_%s", fileId)
 }
 
-func init() {
-	usr, err := user.Current()
+func openConnection(dir string) error {
+	dbHome = dir
+	err := os.MkdirAll(dbHome, os.ModePerm)
 	if err != nil {
-		dbLog.Fatal(err)
+		return err
 	}
-	homeDir := usr.HomeDir
-	dbHome = filepath.Join(homeDir, ".kdc")
-	os.MkdirAll(dbHome, os.ModePerm)
 	dbLog.Debug("database home dir: %s", dbHome)
-	// ensure owner table exist
-	{
-		dbFileFullPath := filepath.Join(dbHome, "own.db")
-		dbLog.Debug(dbFileFullPath)
-		dbConn, err = sql.Open("sqlite3", dbFileFullPath)
-		if err != nil {
-			dbLog.Fatal(err)
-			return
-		}
-
-		fileIndexSql := `create table if not exists fileIndex 
-		                 (fileId text not null primary key, 
-		                 owner text not null, 
-		                 isopen INTEGER DEFAULT 1, 
-		                 originjson text, 
-		                 state text,
-		                 createTime int not null);`
-
-		privilegeSql := `create table if not exists privilege
-						 (fileId text not null, 
-						 user text not null, 
-					  	 privilege INTEGER not null,
-					  	 createTime int not null);`
+	dbFileFullPath := filepath.Join(dbHome, "own.db")
+	dbLog.Debug(dbFileFullPath)
+	dbConn, err = sql.Open("sqlite3", dbFileFullPath)
+	return err
+}
 
-		_, err = dbConn.Exec(fileIndexSql)
-		if err != nil {
-			dbLog.Fatal("%q: %s\n", err, fileIndexSql)
-			return
-		}
-		_, err = dbConn.Exec(privilegeSql)
-		if err != nil {
-			dbLog.Fatal("%q: %s\n", err, fileIndexSql)
-			return
-		}
+// OpenDatabase opens the ledger in dir. A new ledger gets the current schema, an
+// existing one must be at the current schema version, see MigrateDatabase.
+func OpenDatabase(dir string) error {
+	err := openConnection(dir)
+	if err != nil {
+		return err
+	}
+	version, err := SchemaVersion()
+	if err != nil {
+		return err
 	}
+	if version == len(migrations) {
+		return nil
+	}
+	var tables int
+	err = dbConn.QueryRow("select count(1) from sqlite_master where type = 'table' and name = 'fileIndex'").Scan(&tables)
+	if err != nil {
+		return err
+	}
+	if version == 0 && tables == 0 {
+		// fresh ledger
+		_, _, err = migrate()
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("%s: version %d is newer than this kdc (%d)", SchemaMismatchErr, version, len(migrations))
+	}
+	return fmt.Errorf("%s: version %d, expected %d, run kdc migrate", SchemaMismatchErr, version, len(migrations))
 }
 
-func initNewFile(fileId string, owner string, originJson string, allow *AllowTableT, mortgage *MortgageTableT) error {
+func initNewFile(fileId string, owner string, originJson string, allow *AllowTableT, mortgage *MortgageTableT, startTime int64, endTime int64) error {
 	dbMutex.Lock()
 	defer dbMutex.Unlock()
 	nowTime := time.Now().Unix()
@@ -78,9 +75,9 @@ func initNewFile(fileId string, owner string, originJson string, allow *AllowTab
 	if err != nil {
 		dbLog.Fatal(err)
 	}
-	// insert into fileIndex TODO:
-	sqlIndex := fmt.Sprintf(`insert into fileIndex (fileId, owner, originjson, createTime) values ('%s', '%s', '%s', %d);`, fileId, owner, originJson, nowTime)
-	_, err1 := tx.Exec(sqlIndex)
+	// insert into fileIndex
+	sqlIndex := `insert into fileIndex (fileId, owner, originjson, startTime, endTime, createTime) values (?, ?, ?, ?, ?, ?);`
+	_, err1 := tx.Exec(sqlIndex, fileId, owner, originJson, startTime, endTime, nowTime)
 	if err1 != nil {
 		dbLog.Error("%q: %s\n", err1, sqlIndex)
 		return err1
@@ -92,7 +89,16 @@ func initNewFile(fileId string, owner string, originJson string, allow *AllowTab
 		dbLog.Fatal(err)
 	}
 	for userA, privA := range *allow {
-		stmtP.Exec(fileId, userA, privA, nowTime)
+		stmtP.Exec(fileId, userA, LegacyCapability(privA), nowTime)
+	}
+	// the ingested privileges open the audit log of the file
+	stmtE, err := tx.Prepare("insert into privilegeEvent(fileId, user, action, privilege, previous, actor, createTime) values(?, ?, ?, ?, ?, ?, ?)")
+	defer stmtE.Close()
+	if err != nil {
+		dbLog.Fatal(err)
+	}
+	for userA, privA := range *allow {
+		stmtE.Exec(fileId, userA, PrivilegeInit, LegacyCapability(privA), NoCapability, owner, nowTime)
 	}
 	// create modify table and insert init value
 	tableName := getModificationTableName(fileId)
@@ -138,6 +144,20 @@ func isOwner(fileId string, user string) (bool, error) {
 	return count == 1, nil
 }
 
+// isParticipant reports whether user holds a privilege or a balance in a file.
+func isParticipant(fileId string, user string) (bool, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	var count int
+	err := dbConn.QueryRow(fmt.Sprintf("select (select count(1) from privilege where fileId = ? and user = ?) + (select count(1) from %s where userId = ?)",
+		getModificationTableName(fileId)), fileId, user, user).Scan(&count)
+	if err != nil {
+		dbLog.Error("isParticipant sql err: %s", err)
+		return false, err
+	}
+	return count > 0, nil
+}
+
 func setFileTerminate(fileId string) error {
 	dbMutex.Lock()
 	defer dbMutex.Unlock()
@@ -147,12 +167,12 @@ func setFileTerminate(fileId string) error {
 		dbLog.Fatal(err)
 	}
 
-	stmtM, err := tx.Prepare("update fileIndex set isopen = 0 where fileId = ?")
+	stmtM, err := tx.Prepare("update fileIndex set isopen = 0, state = ? where fileId = ?")
 	defer stmtM.Close()
 	if err != nil {
 		dbLog.Fatal(err)
 	}
-	result, err := stmtM.Exec(fileId)
+	result, err := stmtM.Exec(FileStateSettling, fileId)
 	if err != nil {
 		return err
 	}
@@ -167,42 +187,75 @@ func setFileTerminate(fileId string) error {
 	return nil
 }
 
-func getPermissionForFile(user string, fileId string) (int, error) {
+// privilege columns holding the limits of a privilege, see scanLimits
+const limitColumns = "validFrom, validUntil, ifnull(maxAmount, ''), ifnull(dailyCap, '')"
+
+// scanLimits scans the limitColumns of row, after the columns in dest.
+func scanLimits(row rowScanner, limits *PrivilegeLimitsT, dest ...interface{}) error {
+	var maxAmount, dailyCap string
+	err := row.Scan(append(dest, &limits.ValidFrom, &limits.ValidUntil, &maxAmount, &dailyCap)...)
+	if err != nil {
+		return err
+	}
+	limits.MaxAmount, limits.DailyCap = limitAmount(maxAmount), limitAmount(dailyCap)
+	return nil
+}
+
+func limitAmount(value string) *CoinUnitT {
+	amount, err := hexutil.DecodeBig(value)
+	if err != nil {
+		return nil
+	}
+	return amount
+}
+
+func limitValue(amount *CoinUnitT) interface{} {
+	if nil == amount {
+		return nil
+	}
+	return hexutil.EncodeBig(amount)
+}
+
+func getPermissionForFile(user string, fileId string) (Capability, *PrivilegeLimitsT, error) {
 	dbMutex.Lock()
 	defer dbMutex.Unlock()
-	stmt, err := dbConn.Prepare("select privilege from privilege where fileId = ? and user = ? ")
+	stmt, err := dbConn.Prepare("select privilege, " + limitColumns + " from privilege where fileId = ? and user = ? ")
 	if err != nil {
 		dbLog.Error("select privilege err: %s", err)
-		return -1, err
+		return NoCapability, nil, err
 	}
 	defer stmt.Close()
-	var privilege int
-	err = stmt.QueryRow(fileId, user).Scan(&privilege)
+	var privilege Capability
+	limits := new(PrivilegeLimitsT)
+	err = scanLimits(stmt.QueryRow(fileId, user), limits, &privilege)
+	if err == sql.ErrNoRows {
+		return NoCapability, limits, nil
+	}
 	if err != nil {
 		dbLog.Error("select privilege err: %s", err)
-		return -1, err
+		return NoCapability, nil, err
 	}
 
-	return privilege, nil
+	return privilege, limits, nil
 }
 
 func getOperationsForFile(fileId string, userId string) (*[]ModificationT, error) {
-	var modifications []ModificationT
-	tableName := getModificationTableName(fileId)
 	dbMutex.Lock()
 	defer dbMutex.Unlock()
-	stmt, err := dbConn.Prepare(fmt.Sprintf("select operation, value from %s where and user = ? ", tableName))
+	return queryModifications(dbConn, fileId, userId)
+}
+
+// queryModifications returns the operations of userId in a file, queried with q while
+// dbMutex is held.
+func queryModifications(q dbExecutor, fileId string, userId string) (*[]ModificationT, error) {
+	var modifications []ModificationT
+	tableName := getModificationTableName(fileId)
+	rows, err := q.Query(fmt.Sprintf("select opration, value from %s where userId = ? ", tableName), userId)
 	if err != nil {
 		dbLog.Error("select operation, value err: %s", err)
 		return nil, err
 	}
-	defer stmt.Close()
-	rows, err := stmt.Query(fileId, userId)
 	defer rows.Close()
-	if err != nil {
-		dbLog.Error("select operation, value err: %s", err)
-		return nil, err
-	}
 	for rows.Next() {
 		var value string
 		var operation string
@@ -210,7 +263,6 @@ func getOperationsForFile(fileId string, userId string) (*[]ModificationT, error
 		if err != nil {
 			dbLog.Error("select operation, value err: %s", err)
 		}
-		fmt.Println(operation, value)
 		intVal, err := hexutil.DecodeBig(value)
 		if err != nil {
 			dbLog.Error("cannot DecodeBig: %s", err)
@@ -264,8 +316,1262 @@ func listAllUsersForFile(fileId string) (*[]string, error) {
 			dbLog.Error("select userId, value err: %s", err)
 			return nil, err
 		}
-		fmt.Println(userId)
 		userIds = append(userIds, userId)
 	}
 	return &userIds, nil
-}
\ No newline at end of file
+}
+func listFiles() ([]FileInfoT, error) {
+	var files []FileInfoT
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	rows, err := dbConn.Query("select fileId, owner, isopen, ifnull(originjson, ''), ifnull(state, ''), startTime, endTime, createTime from fileIndex order by createTime")
+	if err != nil {
+		dbLog.Error("select fileIndex err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		file, err := scanFileInfo(rows)
+		if err != nil {
+			dbLog.Error("select fileIndex err: %s", err)
+			return nil, err
+		}
+		files = append(files, *file)
+	}
+	return files, rows.Err()
+}
+
+func getFileInfo(fileId string) (*FileInfoT, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	row := dbConn.QueryRow("select fileId, owner, isopen, ifnull(originjson, ''), ifnull(state, ''), startTime, endTime, createTime from fileIndex where fileId = ?", fileId)
+	file, err := scanFileInfo(row)
+	if err != nil {
+		dbLog.Error("select fileIndex err: %s", err)
+		return nil, err
+	}
+	return file, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanFileInfo(row rowScanner) (*FileInfoT, error) {
+	var file FileInfoT
+	var isOpen int
+	err := row.Scan(&file.FileId, &file.Owner, &isOpen, &file.OriginJson, &file.State, &file.StartTime, &file.EndTime, &file.CreateTime)
+	if err != nil {
+		return nil, err
+	}
+	file.IsOpen = isOpen == 1
+	return &file, nil
+}
+
+func getInitMortgageForFile(fileId string) (*MortgageTableT, error) {
+	mortgage := make(MortgageTableT)
+	tableName := getModificationTableName(fileId)
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	rows, err := dbConn.Query(fmt.Sprintf("select userId, value from %s where opration = 'init'", tableName))
+	if err != nil {
+		dbLog.Error("select init operations err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userId string
+		var value string
+		err = rows.Scan(&userId, &value)
+		if err != nil {
+			dbLog.Error("select init operations err: %s", err)
+			return nil, err
+		}
+		intVal, err := hexutil.DecodeBig(value)
+		if err != nil {
+			dbLog.Error("cannot DecodeBig: %s", err)
+			return nil, err
+		}
+		sum := mortgage[userId]
+		sum.Add(&sum, intVal)
+		mortgage[userId] = sum
+	}
+	return &mortgage, rows.Err()
+}
+
+// setFileSettling closes the file and queues the chunkCount chunks of its settlement
+// as unsent, at once so that a file is never closed without a settlement to send.
+func setFileSettling(fileId string, chunkCount int) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	tx, err := dbConn.Begin()
+	if err != nil {
+		dbLog.Error("setFileSettling err: %s", err)
+		return err
+	}
+	result, err := tx.Exec("update fileIndex set isopen = 0, state = ? where fileId = ? and isopen = 1", FileStateSettling, fileId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if affected == int64(0) {
+		tx.Rollback()
+		return FileClosedErr
+	}
+	now := time.Now().Unix()
+	for chunk := 0; chunk < chunkCount; chunk++ {
+		_, err = tx.Exec("insert into settlement (fileId, txHash, terminate, chunk, chunkCount, status, createTime) values (?, '', 1, ?, ?, ?, ?)",
+			fileId, chunk, chunkCount, SettlementStatusUnsent, now)
+		if err != nil {
+			tx.Rollback()
+			dbLog.Error("setFileSettling err: %s", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insertSettlement records the sync transaction sent for a chunk as pending, on the
+// queued row of the chunk when it is still unsent.
+func insertSettlement(settlement *SettlementT) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	result, err := dbConn.Exec("update settlement set txHash = ?, status = ? where fileId = ? and chunk = ? and status = ?",
+		settlement.TxHash, SettlementStatusPending, settlement.FileId, settlement.Chunk, SettlementStatusUnsent)
+	if err != nil {
+		dbLog.Error("insertSettlement err: %s", err)
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected > 0 {
+		return nil
+	}
+	terminate := 0
+	if settlement.Terminate {
+		terminate = 1
+	}
+	_, err = dbConn.Exec("insert into settlement (fileId, txHash, terminate, chunk, chunkCount, status, createTime) values (?, ?, ?, ?, ?, ?, ?)",
+		settlement.FileId, settlement.TxHash, terminate, settlement.Chunk, settlement.ChunkCount, SettlementStatusPending, time.Now().Unix())
+	if err != nil {
+		dbLog.Error("insertSettlement err: %s", err)
+		return err
+	}
+	return nil
+}
+
+func querySettlements(where string, args ...interface{}) ([]SettlementT, error) {
+	var settlements []SettlementT
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	rows, err := dbConn.Query("select fileId, txHash, terminate, chunk, chunkCount, status, createTime from settlement where "+where+" order by createTime, chunk", args...)
+	if err != nil {
+		dbLog.Error("select settlement err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var settlement SettlementT
+		var terminate int
+		err = rows.Scan(&settlement.FileId, &settlement.TxHash, &terminate, &settlement.Chunk, &settlement.ChunkCount, &settlement.Status, &settlement.CreateTime)
+		if err != nil {
+			dbLog.Error("select settlement err: %s", err)
+			return nil, err
+		}
+		settlement.Terminate = terminate == 1
+		settlements = append(settlements, settlement)
+	}
+	return settlements, rows.Err()
+}
+
+func listSettlementsForFile(fileId string) ([]SettlementT, error) {
+	return querySettlements("fileId = ?", fileId)
+}
+
+func listPendingSettlements() ([]SettlementT, error) {
+	return querySettlements("status = ?", SettlementStatusPending)
+}
+
+// setSettlementStatus updates the chunks sent by the transaction, one per file when
+// the transaction is a batch, and marks each file settled once every chunk of its
+// settlement has been confirmed.
+func setSettlementStatus(txHash string, status string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	tx, err := dbConn.Begin()
+	if err != nil {
+		dbLog.Error("setSettlementStatus err: %s", err)
+		return err
+	}
+	rows, err := tx.Query("select distinct fileId, chunkCount from settlement where txHash = ?", txHash)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	chunkCounts := make(map[string]int)
+	for rows.Next() {
+		var fileId string
+		var chunkCount int
+		err = rows.Scan(&fileId, &chunkCount)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		chunkCounts[fileId] = chunkCount
+	}
+	rows.Close()
+	if len(chunkCounts) == 0 {
+		tx.Rollback()
+		return sql.ErrNoRows
+	}
+	_, err = tx.Exec("update settlement set status = ? where txHash = ?", status, txHash)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for fileId, chunkCount := range chunkCounts {
+		var confirmed int
+		err = tx.QueryRow("select count(distinct chunk) from settlement where fileId = ? and chunkCount = ? and status = ?",
+			fileId, chunkCount, SettlementStatusConfirmed).Scan(&confirmed)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if confirmed == chunkCount {
+			_, err = tx.Exec("update fileIndex set state = ? where fileId = ?", FileStateSettled, fileId)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func listExpiredFiles(now int64) ([]FileInfoT, error) {
+	var files []FileInfoT
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	rows, err := dbConn.Query("select fileId, owner, isopen, ifnull(originjson, ''), ifnull(state, ''), startTime, endTime, createTime from fileIndex where isopen = 1 and endTime > 0 and endTime <= ?", now)
+	if err != nil {
+		dbLog.Error("select expired files err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		file, err := scanFileInfo(rows)
+		if err != nil {
+			dbLog.Error("select expired files err: %s", err)
+			return nil, err
+		}
+		files = append(files, *file)
+	}
+	return files, rows.Err()
+}
+
+func getSyncState(name string) (string, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	var value string
+	err := dbConn.QueryRow("select value from syncState where name = ?", name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func setSyncState(name string, value string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	_, err := dbConn.Exec("insert or replace into syncState (name, value) values (?, ?)", name, value)
+	return err
+}
+
+func insertSeenRequest(key string, signer string, expiry int64) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	var seen int
+	err := dbConn.QueryRow("select count(1) from seenRequest where requestKey = ?", key).Scan(&seen)
+	if err != nil {
+		return err
+	}
+	if seen > 0 {
+		return RequestReusedErr
+	}
+	_, err = dbConn.Exec("insert into seenRequest (requestKey, signer, expiry, createTime) values (?, ?, ?, ?)",
+		key, signer, expiry, time.Now().Unix())
+	return err
+}
+
+func deleteSeenRequest(key string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	_, err := dbConn.Exec("delete from seenRequest where requestKey = ?", key)
+	return err
+}
+
+func deleteExpiredSeenRequests(now int64) (int64, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	// legacy requests have no expiry and are remembered for good
+	result, err := dbConn.Exec("delete from seenRequest where expiry > 0 and expiry < ?", now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// claimIdempotencyKey claims a free key for payload, or returns what its request returned
+// or failed with.
+func claimIdempotencyKey(signer string, fileId string, key string, payload string, now int64) (string, string, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	var claimed string
+	var result, failure sql.NullString
+	err := dbConn.QueryRow("select payload, result, failure from idempotencyKey where signer = ? and fileId = ? and key = ?",
+		signer, fileId, key).Scan(&claimed, &result, &failure)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = dbConn.Exec("insert into idempotencyKey (signer, fileId, key, payload, createTime) values (?, ?, ?, ?, ?)",
+			signer, fileId, key, payload, now)
+		return "", "", err
+	case err != nil:
+		return "", "", err
+	case claimed != payload:
+		return "", "", IdempotencyKeyReusedErr
+	case !result.Valid && !failure.Valid:
+		return "", "", IdempotencyKeyPendingErr
+	}
+	return result.String, failure.String, nil
+}
+
+func setIdempotencyResult(signer string, fileId string, key string, result string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	_, err := dbConn.Exec("update idempotencyKey set result = ? where signer = ? and fileId = ? and key = ?", result, signer, fileId, key)
+	if err != nil {
+		dbLog.Error("update idempotency key err: %s", err)
+	}
+	return err
+}
+
+func setIdempotencyFailure(signer string, fileId string, key string, failure string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	_, err := dbConn.Exec("update idempotencyKey set failure = ? where signer = ? and fileId = ? and key = ?", failure, signer, fileId, key)
+	if err != nil {
+		dbLog.Error("update idempotency key err: %s", err)
+	}
+	return err
+}
+
+func deleteIdempotencyKey(signer string, fileId string, key string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	_, err := dbConn.Exec("delete from idempotencyKey where signer = ? and fileId = ? and key = ?", signer, fileId, key)
+	return err
+}
+
+func deleteIdempotencyKeysBefore(before int64) (int64, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	result, err := dbConn.Exec("delete from idempotencyKey where createTime < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func listPrivilegesForFile(fileId string) (map[string]ParticipantT, error) {
+	privileges := make(map[string]ParticipantT)
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	rows, err := dbConn.Query("select user, privilege, "+limitColumns+" from privilege where fileId = ?", fileId)
+	if err != nil {
+		dbLog.Error("select privilege err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var participant ParticipantT
+		err = scanLimits(rows, &participant.Limits, &participant.User, &participant.Privilege)
+		if err != nil {
+			dbLog.Error("select privilege err: %s", err)
+			return nil, err
+		}
+		privileges[participant.User] = participant
+	}
+	return privileges, rows.Err()
+}
+
+func queryOperations(fileId string, filter OperationFilterT) ([]OperationT, int, error) {
+	where := "1 = 1"
+	var args []interface{}
+	if "" != filter.User {
+		where += " and m.userId = ?"
+		args = append(args, filter.User)
+	}
+	if filter.From > 0 {
+		where += " and m.createTime >= ?"
+		args = append(args, filter.From)
+	}
+	if filter.To > 0 {
+		where += " and m.createTime <= ?"
+		args = append(args, filter.To)
+	}
+	tableName := getModificationTableName(fileId)
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	var total int
+	err := dbConn.QueryRow(fmt.Sprintf("select count(1) from %s m where %s", tableName, where), args...).Scan(&total)
+	if err != nil {
+		dbLog.Error("select operations err: %s", err)
+		return nil, 0, err
+	}
+	rows, err := dbConn.Query(fmt.Sprintf(`select m.rowid, m.userId, ifnull(m.opration, ''), ifnull(m.value, ''), m.createTime, ifnull(r.operationId, 0),
+		o.reference, o.memo, o.request, o.signer, o.requestId
+		from %s m left join reversal r on r.fileId = ? and r.reversalId = m.rowid
+		left join operationMeta o on o.fileId = ? and o.operationId = m.rowid where %s order by m.rowid limit ? offset ?`, tableName, where),
+		append(append([]interface{}{fileId, fileId}, args...), filter.Limit, filter.Offset)...)
+	if err != nil {
+		dbLog.Error("select operations err: %s", err)
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var operations []OperationT
+	for rows.Next() {
+		var operation OperationT
+		var reference, memo, request, signer, requestId sql.NullString
+		err = rows.Scan(&operation.Id, &operation.User, &operation.Operation, &operation.Value, &operation.CreateTime, &operation.Reverses,
+			&reference, &memo, &request, &signer, &requestId)
+		if err != nil {
+			dbLog.Error("select operations err: %s", err)
+			return nil, 0, err
+		}
+		if signer.Valid {
+			operation.Meta = &OperationMetaT{Reference: reference.String, Memo: memo.String, Request: request.String,
+				Signer: signer.String, RequestId: requestId.String}
+		}
+		operations = append(operations, operation)
+	}
+	return operations, total, rows.Err()
+}
+
+func listFilesForUser(user string) ([]UserFileT, error) {
+	var files []UserFileT
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	rows, err := dbConn.Query(`select f.fileId, f.owner, f.isopen, ifnull(f.originjson, ''), ifnull(f.state, ''), f.startTime, f.endTime, f.createTime, ifnull(p.privilege, ?)
+		from fileIndex f left join privilege p on p.fileId = f.fileId and p.user = ?
+		where f.owner = ? or p.user is not null order by f.createTime`, NoCapability, user, user)
+	if err != nil {
+		dbLog.Error("select files for user err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var file UserFileT
+		var isOpen int
+		err = rows.Scan(&file.FileId, &file.Owner, &isOpen, &file.OriginJson, &file.State, &file.StartTime, &file.EndTime, &file.CreateTime, &file.Privilege)
+		if err != nil {
+			dbLog.Error("select files for user err: %s", err)
+			return nil, err
+		}
+		file.IsOpen = isOpen == 1
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// changePrivilege sets the privilege of user in a file and its limits, NoCapability
+// revoking it, and records the change in the same transaction. The privilege it
+// replaces must be within limit, the capabilities of actor.
+func changePrivilege(fileId string, user string, privilege Capability, limits *PrivilegeLimitsT, limit Capability, actor string, signature string) (*PrivilegeEventT, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	event := &PrivilegeEventT{FileId: fileId, User: user, Privilege: privilege, Limits: *limits, Previous: NoCapability,
+		Actor: actor, Signature: signature, CreateTime: time.Now().Unix()}
+	var previousLimits PrivilegeLimitsT
+	err = scanLimits(tx.QueryRow("select privilege, "+limitColumns+" from privilege where fileId = ? and user = ?", fileId, user),
+		&previousLimits, &event.Previous)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return nil, err
+	}
+	switch {
+	case !limit.Has(event.Previous):
+		tx.Rollback()
+		return nil, EscalationErr
+	case event.Previous == privilege && privilege == NoCapability:
+		tx.Rollback()
+		return nil, NoSuchPrivilegeErr
+	case event.Previous == privilege && previousLimits.equal(limits):
+		tx.Rollback()
+		return nil, PrivilegeUnchangedErr
+	case privilege == NoCapability:
+		event.Action = PrivilegeRevoke
+	case event.Previous == NoCapability:
+		event.Action = PrivilegeGrant
+	default:
+		event.Action = PrivilegeChange
+	}
+	limitArgs := []interface{}{limits.ValidFrom, limits.ValidUntil, limitValue(limits.MaxAmount), limitValue(limits.DailyCap)}
+	_, err = tx.Exec("delete from privilege where fileId = ? and user = ?", fileId, user)
+	if err == nil && privilege != NoCapability {
+		_, err = tx.Exec("insert into privilege (fileId, user, privilege, createTime, validFrom, validUntil, maxAmount, dailyCap) values (?, ?, ?, ?, ?, ?, ?, ?)",
+			append([]interface{}{fileId, user, privilege, event.CreateTime}, limitArgs...)...)
+	}
+	if err == nil {
+		_, err = tx.Exec(`insert into privilegeEvent (fileId, user, action, privilege, previous, actor, signature, createTime, validFrom, validUntil, maxAmount, dailyCap)
+			values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			append([]interface{}{fileId, user, event.Action, privilege, event.Previous, actor, signature, event.CreateTime}, limitArgs...)...)
+	}
+	if err != nil {
+		dbLog.Error("change privilege err: %s", err)
+		tx.Rollback()
+		return nil, err
+	}
+	return event, tx.Commit()
+}
+
+func listPrivilegeEvents(fileId string) ([]PrivilegeEventT, error) {
+	var events []PrivilegeEventT
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	rows, err := dbConn.Query(`select fileId, user, action, privilege, previous, actor, ifnull(signature, ''), createTime, `+limitColumns+`
+		from privilegeEvent where fileId = ? order by rowid`, fileId)
+	if err != nil {
+		dbLog.Error("select privilege events err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event PrivilegeEventT
+		err = scanLimits(rows, &event.Limits, &event.FileId, &event.User, &event.Action, &event.Privilege, &event.Previous, &event.Actor, &event.Signature, &event.CreateTime)
+		if err != nil {
+			dbLog.Error("select privilege events err: %s", err)
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// sumOperationsSince returns the total of the operations of user in a file made after
+// since, queried with q while dbMutex is held.
+func sumOperationsSince(q dbExecutor, fileId string, userId string, operation string, since int64) (*CoinUnitT, error) {
+	tableName := getModificationTableName(fileId)
+	rows, err := q.Query(fmt.Sprintf("select value from %s where userId = ? and opration = ? and createTime > ?", tableName),
+		userId, operation, since)
+	if err != nil {
+		dbLog.Error("select operations err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	total := new(CoinUnitT)
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			return nil, err
+		}
+		amount, err := hexutil.DecodeBig(value)
+		if err != nil {
+			return nil, err
+		}
+		total.Add(total, amount)
+	}
+	return total, rows.Err()
+}
+
+const delegationColumns = "fileId, user, delegate, cap, spent, validUntil, ifnull(signature, ''), createTime"
+
+func scanDelegation(row rowScanner) (*DelegationT, error) {
+	var delegation DelegationT
+	var capValue, spent string
+	err := row.Scan(&delegation.FileId, &delegation.User, &delegation.Delegate, &capValue, &spent, &delegation.ValidUntil,
+		&delegation.Signature, &delegation.CreateTime)
+	if err != nil {
+		return nil, err
+	}
+	delegation.Cap, err = hexutil.DecodeBig(capValue)
+	if err != nil {
+		return nil, err
+	}
+	delegation.Spent, err = hexutil.DecodeBig(spent)
+	if err != nil {
+		return nil, err
+	}
+	return &delegation, nil
+}
+
+// putDelegation stores a delegation, replacing the one user gave delegate in the file.
+func putDelegation(delegation *DelegationT) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	_, err := dbConn.Exec("insert or replace into delegation (fileId, user, delegate, cap, spent, validUntil, signature, createTime) values (?, ?, ?, ?, ?, ?, ?, ?)",
+		delegation.FileId, delegation.User, delegation.Delegate, hexutil.EncodeBig(delegation.Cap), hexutil.EncodeBig(delegation.Spent),
+		delegation.ValidUntil, delegation.Signature, delegation.CreateTime)
+	if err != nil {
+		dbLog.Error("insert delegation err: %s", err)
+	}
+	return err
+}
+
+func deleteDelegation(fileId string, user string, delegate string) (bool, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	result, err := dbConn.Exec("delete from delegation where fileId = ? and user = ? and delegate = ?", fileId, user, delegate)
+	if err != nil {
+		dbLog.Error("delete delegation err: %s", err)
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+func listDelegations(fileId string, user string) ([]DelegationT, error) {
+	var delegations []DelegationT
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	rows, err := dbConn.Query("select "+delegationColumns+" from delegation where fileId = ? and user = ? order by rowid", fileId, user)
+	if err != nil {
+		dbLog.Error("select delegations err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		delegation, err := scanDelegation(rows)
+		if err != nil {
+			dbLog.Error("select delegations err: %s", err)
+			return nil, err
+		}
+		delegations = append(delegations, *delegation)
+	}
+	return delegations, rows.Err()
+}
+
+// spendDelegation adds amount to what delegate spent of the delegation user gave it in
+// the file, in one transaction with the checks that the delegation is valid at now and
+// that the amount fits in its allowance. A negative amount gives back what was spent.
+func spendDelegation(fileId string, user string, delegate string, amount *CoinUnitT, now int64) (*DelegationT, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	delegation, err := scanDelegation(tx.QueryRow("select "+delegationColumns+" from delegation where fileId = ? and user = ? and delegate = ?",
+		fileId, user, delegate))
+	if err == sql.ErrNoRows || (nil == err && amount.Sign() > 0 && now > delegation.ValidUntil) {
+		tx.Rollback()
+		return nil, NoDelegationErr
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	delegation.Spent.Add(delegation.Spent, amount)
+	if delegation.Spent.Cmp(delegation.Cap) > 0 {
+		tx.Rollback()
+		return nil, DelegationCapErr
+	}
+	if delegation.Spent.Sign() < 0 {
+		delegation.Spent.SetInt64(0)
+	}
+	_, err = tx.Exec("update delegation set spent = ? where fileId = ? and user = ? and delegate = ?",
+		hexutil.EncodeBig(delegation.Spent), fileId, user, delegate)
+	if err != nil {
+		dbLog.Error("update delegation err: %s", err)
+		tx.Rollback()
+		return nil, err
+	}
+	return delegation, tx.Commit()
+}
+
+const allowanceColumns = "fileId, user, spender, remaining, ifnull(signature, ''), updateTime"
+
+func scanAllowance(row rowScanner) (*AllowanceT, error) {
+	var allowance AllowanceT
+	var remaining string
+	err := row.Scan(&allowance.FileId, &allowance.User, &allowance.Spender, &remaining, &allowance.Signature, &allowance.UpdateTime)
+	if err != nil {
+		return nil, err
+	}
+	allowance.Remaining, err = hexutil.DecodeBig(remaining)
+	if err != nil {
+		return nil, err
+	}
+	return &allowance, nil
+}
+
+// putAllowance stores an allowance, deleting it when nothing remains of it.
+func putAllowance(allowance *AllowanceT) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	var err error
+	if allowance.Remaining.Sign() == 0 {
+		_, err = dbConn.Exec("delete from allowance where fileId = ? and user = ? and spender = ?", allowance.FileId, allowance.User, allowance.Spender)
+	} else {
+		_, err = dbConn.Exec("insert or replace into allowance (fileId, user, spender, remaining, signature, updateTime) values (?, ?, ?, ?, ?, ?)",
+			allowance.FileId, allowance.User, allowance.Spender, hexutil.EncodeBig(allowance.Remaining), allowance.Signature, allowance.UpdateTime)
+	}
+	if err != nil {
+		dbLog.Error("store allowance err: %s", err)
+	}
+	return err
+}
+
+// getAllowance returns the allowance user gave spender in a file, zero when there is none.
+func getAllowance(fileId string, user string, spender string) (*AllowanceT, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	allowance, err := scanAllowance(dbConn.QueryRow("select "+allowanceColumns+" from allowance where fileId = ? and user = ? and spender = ?",
+		fileId, user, spender))
+	if err == sql.ErrNoRows {
+		return &AllowanceT{FileId: fileId, User: user, Spender: spender, Remaining: new(CoinUnitT)}, nil
+	}
+	if err != nil {
+		dbLog.Error("select allowance err: %s", err)
+	}
+	return allowance, err
+}
+
+// spendAllowance takes amount from the allowance user gave spender in a file, in one
+// transaction with the check that the allowance covers it. A negative amount gives back
+// what was taken.
+func spendAllowance(fileId string, user string, spender string, amount *CoinUnitT) (*AllowanceT, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	allowance, err := scanAllowance(tx.QueryRow("select "+allowanceColumns+" from allowance where fileId = ? and user = ? and spender = ?",
+		fileId, user, spender))
+	if err == sql.ErrNoRows {
+		allowance, err = &AllowanceT{FileId: fileId, User: user, Spender: spender, Remaining: new(CoinUnitT)}, nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	allowance.Remaining.Sub(allowance.Remaining, amount)
+	if allowance.Remaining.Sign() < 0 {
+		tx.Rollback()
+		return nil, AllowanceExceededErr
+	}
+	allowance.UpdateTime = time.Now().Unix()
+	_, err = tx.Exec("insert or replace into allowance (fileId, user, spender, remaining, signature, updateTime) values (?, ?, ?, ?, ?, ?)",
+		fileId, user, spender, hexutil.EncodeBig(allowance.Remaining), allowance.Signature, allowance.UpdateTime)
+	if err != nil {
+		dbLog.Error("update allowance err: %s", err)
+		tx.Rollback()
+		return nil, err
+	}
+	return allowance, tx.Commit()
+}
+
+// appendSubtract records a subtract of amount from the balance of userId within limits
+// and what holds do not reserve of it, and credits it to payee, with meta unless nil, in
+// one transaction. It returns the balance of userId after the subtract.
+func appendSubtract(fileId string, userId string, amount *CoinUnitT, payee string, limits *PrivilegeLimitsT, meta *OperationMetaT) (*CoinUnitT, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	nowTime := time.Now().Unix()
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = checkLimits(tx, userId, fileId, amount, limits, nowTime)
+	var balance *BalanceT
+	if err == nil {
+		balance, err = checkAvailable(tx, fileId, userId, amount, nowTime)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = insertSubtract(tx, fileId, userId, amount, payee, meta, nowTime)
+	if err != nil {
+		dbLog.Error("appendSubtract err: %s", err)
+		tx.Rollback()
+		return nil, err
+	}
+	return balance.Balance.Sub(balance.Balance, amount), tx.Commit()
+}
+
+// insertSubtract writes a subtract and the earning of its payee, which names it.
+func insertSubtract(tx *sql.Tx, fileId string, userId string, amount *CoinUnitT, payee string, meta *OperationMetaT, nowTime int64) error {
+	value := hexutil.EncodeBig(amount)
+	result, err := tx.Exec(fmt.Sprintf("insert into %s (userId, opration, value, createTime) values (?, ?, ?, ?);", getModificationTableName(fileId)),
+		userId, "subtract", value, nowTime)
+	if err != nil {
+		return err
+	}
+	operationId, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into earning (fileId, payee, payer, value, createTime, operationId) values (?, ?, ?, ?, ?, ?)",
+		fileId, payee, userId, value, nowTime, operationId)
+	if err != nil {
+		return err
+	}
+	return insertMeta(tx, fileId, meta, nowTime, operationId)
+}
+
+// insertMeta records meta, unless nil, with the operations operationIds of a file.
+func insertMeta(tx *sql.Tx, fileId string, meta *OperationMetaT, nowTime int64, operationIds ...int64) error {
+	if nil == meta {
+		return nil
+	}
+	for _, operationId := range operationIds {
+		_, err := tx.Exec(`insert into operationMeta (fileId, operationId, reference, memo, request, signer, requestId, createTime)
+			values (?, ?, ?, ?, ?, ?, ?, ?)`, fileId, operationId, meta.Reference, meta.Memo, meta.Request, meta.Signer, meta.RequestId, nowTime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendTransfer records a transfer within the limits of from and what holds do not
+// reserve of its balance as a transferOut of from and a transferIn of to, both or
+// neither, with meta unless nil. It returns the balance of from after the transfer.
+func appendTransfer(fileId string, from string, to string, amount *CoinUnitT, limits *PrivilegeLimitsT, meta *OperationMetaT) (*CoinUnitT, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	nowTime := time.Now().Unix()
+	value := hexutil.EncodeBig(amount)
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	insert := fmt.Sprintf("insert into %s (userId, opration, value, createTime) values (?, ?, ?, ?);", getModificationTableName(fileId))
+	err = checkLimits(tx, from, fileId, amount, limits, nowTime)
+	var balance *BalanceT
+	if err == nil {
+		balance, err = checkAvailable(tx, fileId, from, amount, nowTime)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	var out, in int64
+	out, err = insertOperation(tx, insert, from, "transferOut", value, nowTime)
+	if err == nil {
+		in, err = insertOperation(tx, insert, to, "transferIn", value, nowTime)
+	}
+	if err == nil {
+		err = insertMeta(tx, fileId, meta, nowTime, out, in)
+	}
+	if err != nil {
+		dbLog.Error("appendTransfer err: %s", err)
+		tx.Rollback()
+		return nil, err
+	}
+	return balance.Balance.Sub(balance.Balance, amount), tx.Commit()
+}
+
+// insertOperation writes a row of the history of a file with insert and returns its id.
+func insertOperation(tx *sql.Tx, insert string, args ...interface{}) (int64, error) {
+	result, err := tx.Exec(insert, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func getEarnings(fileId string) (*MortgageT, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	// reversals take back what the payee of the subtract they reverse earned
+	rows, err := dbConn.Query(`select payee, value, 1 from earning where fileId = ?
+		union all select payee, value, -1 from reversal where fileId = ? and payee != ''`, fileId, fileId)
+	if err != nil {
+		dbLog.Error("select earnings err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	totals := make(map[string]*CoinUnitT)
+	for rows.Next() {
+		var payee, value string
+		var sign int64
+		err = rows.Scan(&payee, &value, &sign)
+		if err != nil {
+			return nil, err
+		}
+		amount, err := hexutil.DecodeBig(value)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := totals[payee]; !ok {
+			totals[payee] = new(CoinUnitT)
+		}
+		totals[payee].Add(totals[payee], amount.Mul(amount, big.NewInt(sign)))
+	}
+	earnings := make(MortgageT)
+	for payee, total := range totals {
+		earnings[payee] = hexutil.EncodeBig(total)
+	}
+	return &earnings, rows.Err()
+}
+
+// appendDeposit records a deposit, adds its amounts to the balances of the file and
+// gives the users of allow without a privilege theirs, all or nothing.
+func appendDeposit(deposit *DepositT, mortgage *MortgageTableT, allow *AllowTableT) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	err = insertDeposit(tx, deposit, mortgage, allow)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertDeposit(tx *sql.Tx, deposit *DepositT, mortgage *MortgageTableT, allow *AllowTableT) error {
+	var isOpen, known int
+	err := tx.QueryRow("select isOpen, (select count(1) from deposit where txHash = ?) from fileIndex where fileId = ?",
+		deposit.TxHash, deposit.FileId).Scan(&isOpen, &known)
+	if err != nil {
+		return err
+	}
+	if known > 0 {
+		return DepositExistsErr
+	}
+	if isOpen != 1 {
+		return FileClosedErr
+	}
+	_, err = tx.Exec("insert into deposit (txHash, fileId, fromAccount, value, blockNumber, createTime) values (?, ?, ?, ?, ?, ?)",
+		deposit.TxHash, deposit.FileId, deposit.From, hexutil.EncodeBig(deposit.Value), deposit.BlockNumber, deposit.CreateTime)
+	if err != nil {
+		dbLog.Error("insert deposit err: %s", err)
+		return err
+	}
+	insert := fmt.Sprintf("insert into %s (userId, opration, value, createTime) values (?, ?, ?, ?);", getModificationTableName(deposit.FileId))
+	for user, amount := range *mortgage {
+		_, err = tx.Exec(insert, user, "deposit", hexutil.EncodeBig(&amount), deposit.CreateTime)
+		if err != nil {
+			dbLog.Error("insert deposit operation err: %s", err)
+			return err
+		}
+	}
+	if nil == allow {
+		return nil
+	}
+	for user, privilege := range *allow {
+		var count int
+		err = tx.QueryRow("select count(1) from privilege where fileId = ? and user = ?", deposit.FileId, user).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		_, err = tx.Exec("insert into privilege(fileId, user, privilege, createTime) values(?, ?, ?, ?)",
+			deposit.FileId, user, LegacyCapability(privilege), deposit.CreateTime)
+		if err == nil {
+			_, err = tx.Exec("insert into privilegeEvent(fileId, user, action, privilege, previous, actor, signature, createTime) values(?, ?, ?, ?, ?, ?, ?, ?)",
+				deposit.FileId, user, PrivilegeDeposit, LegacyCapability(privilege), NoCapability, deposit.From, deposit.TxHash, deposit.CreateTime)
+		}
+		if err != nil {
+			dbLog.Error("insert deposit privilege err: %s", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func listDeposits(fileId string) ([]DepositT, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	rows, err := dbConn.Query("select txHash, fileId, fromAccount, value, ifnull(blockNumber, ''), createTime from deposit where fileId = ? order by createTime, rowid", fileId)
+	if err != nil {
+		dbLog.Error("select deposits err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	deposits := make([]DepositT, 0)
+	for rows.Next() {
+		var deposit DepositT
+		var value string
+		err = rows.Scan(&deposit.TxHash, &deposit.FileId, &deposit.From, &value, &deposit.BlockNumber, &deposit.CreateTime)
+		if err != nil {
+			return nil, err
+		}
+		deposit.Value, err = hexutil.DecodeBig(value)
+		if err != nil {
+			return nil, err
+		}
+		deposits = append(deposits, deposit)
+	}
+	return deposits, rows.Err()
+}
+
+const holdColumns = "id, fileId, user, payee, amount, ifnull(captured, ''), status, validUntil, createTime, updateTime"
+
+func scanHold(row rowScanner) (*HoldT, error) {
+	var hold HoldT
+	var amount, captured string
+	err := row.Scan(&hold.Id, &hold.FileId, &hold.User, &hold.Payee, &amount, &captured, &hold.Status, &hold.ValidUntil,
+		&hold.CreateTime, &hold.UpdateTime)
+	if err != nil {
+		return nil, err
+	}
+	hold.Amount, err = hexutil.DecodeBig(amount)
+	if err != nil {
+		return nil, err
+	}
+	if "" != captured {
+		hold.Captured, err = hexutil.DecodeBig(captured)
+	}
+	return &hold, err
+}
+
+// insertHold records a hold its user places within limits and what other holds do not
+// reserve of its balance, in one transaction.
+func insertHold(hold *HoldT, limits *PrivilegeLimitsT) (int64, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	err = checkLimits(tx, hold.User, hold.FileId, hold.Amount, limits, hold.CreateTime)
+	if err == nil {
+		_, err = checkAvailable(tx, hold.FileId, hold.User, hold.Amount, hold.CreateTime)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	var id int64
+	result, err := tx.Exec("insert into hold (fileId, user, payee, amount, status, validUntil, createTime, updateTime) values (?, ?, ?, ?, ?, ?, ?, ?)",
+		hold.FileId, hold.User, hold.Payee, hexutil.EncodeBig(hold.Amount), hold.Status, hold.ValidUntil, hold.CreateTime, hold.UpdateTime)
+	if err == nil {
+		id, err = result.LastInsertId()
+	}
+	if err != nil {
+		dbLog.Error("insert hold err: %s", err)
+		tx.Rollback()
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func getHold(fileId string, id int64) (*HoldT, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	return scanHold(dbConn.QueryRow("select "+holdColumns+" from hold where fileId = ? and id = ?", fileId, id))
+}
+
+// closeHold moves an active hold to status, subtracting captured from the balance of
+// its user for its payee with meta, all or nothing.
+func closeHold(fileId string, id int64, status string, captured *CoinUnitT, meta *OperationMetaT, now int64) (*HoldT, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	hold, err := scanHold(tx.QueryRow("select "+holdColumns+" from hold where fileId = ? and id = ?", fileId, id))
+	if nil == err && (hold.Status != HoldActive || hold.ValidUntil < now) {
+		err = HoldNotActiveErr
+	}
+	if nil == err && nil != captured && captured.Sign() > 0 {
+		err = insertSubtract(tx, fileId, hold.User, captured, hold.Payee, meta, now)
+	}
+	if nil == err {
+		hold.Status, hold.Captured, hold.UpdateTime = status, captured, now
+		capturedValue := sql.NullString{}
+		if nil != captured {
+			capturedValue = sql.NullString{String: hexutil.EncodeBig(captured), Valid: true}
+		}
+		_, err = tx.Exec("update hold set status = ?, captured = ?, updateTime = ? where id = ?", status, capturedValue, now, id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return hold, tx.Commit()
+}
+
+func expireHolds(now int64) (int64, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	result, err := dbConn.Exec("update hold set status = ?, updateTime = ? where status = ? and validUntil < ?", HoldExpired, now, HoldActive, now)
+	if err != nil {
+		dbLog.Error("expire holds err: %s", err)
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// activeHolds returns what the active holds of userId in a file reserve, of every
+// user when userId is empty, by user.
+func activeHolds(fileId string, userId string, now int64) (map[string]*CoinUnitT, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	return queryActiveHolds(dbConn, fileId, userId, now)
+}
+
+// queryActiveHolds is activeHolds, queried with q while dbMutex is held.
+func queryActiveHolds(q dbExecutor, fileId string, userId string, now int64) (map[string]*CoinUnitT, error) {
+	rows, err := q.Query("select user, amount from hold where fileId = ? and (? = '' or user = ?) and status = ? and validUntil >= ?",
+		fileId, userId, userId, HoldActive, now)
+	if err != nil {
+		dbLog.Error("select holds err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	held := make(map[string]*CoinUnitT)
+	for rows.Next() {
+		var user, value string
+		err = rows.Scan(&user, &value)
+		if err != nil {
+			return nil, err
+		}
+		amount, err := hexutil.DecodeBig(value)
+		if err != nil {
+			return nil, err
+		}
+		if nil == held[user] {
+			held[user] = new(CoinUnitT)
+		}
+		held[user].Add(held[user], amount)
+	}
+	return held, rows.Err()
+}
+
+// queryBalance returns the balance of userId in a file with what its active holds
+// reserve, queried with q while dbMutex is held.
+func queryBalance(q dbExecutor, fileId string, userId string, now int64) (*BalanceT, error) {
+	modifications, err := queryModifications(q, fileId, userId)
+	if err != nil {
+		return nil, err
+	}
+	balance, err := calculateAllValue(modifications)
+	if err != nil {
+		return nil, err
+	}
+	held, err := queryActiveHolds(q, fileId, userId, now)
+	if err != nil {
+		return nil, err
+	}
+	if nil == held[userId] {
+		held[userId] = new(CoinUnitT)
+	}
+	return &BalanceT{Balance: balance, Held: held[userId], Available: new(CoinUnitT).Sub(balance, held[userId])}, nil
+}
+
+// checkAvailable returns the balance of userId in a file, InsufficientBalanceErr if what
+// holds do not reserve of it is below amount, queried with q while dbMutex is held.
+func checkAvailable(q dbExecutor, fileId string, userId string, amount *CoinUnitT, now int64) (*BalanceT, error) {
+	balance, err := queryBalance(q, fileId, userId, now)
+	if err != nil {
+		return nil, err
+	}
+	if balance.Available.Cmp(amount) == -1 {
+		return nil, InsufficientBalanceErr
+	}
+	return balance, nil
+}
+
+// appendReversal checks a reversal against the subtract it reverses and records it,
+// filling in its user, payee and id, with meta unless nil.
+func appendReversal(reversal *ReversalT, meta *OperationMetaT) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	err = insertReversal(tx, reversal, meta)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertReversal(tx *sql.Tx, reversal *ReversalT, meta *OperationMetaT) error {
+	var isOpen int
+	err := tx.QueryRow("select isOpen from fileIndex where fileId = ?", reversal.FileId).Scan(&isOpen)
+	if err != nil {
+		return err
+	}
+	if isOpen != 1 {
+		return FileClosedErr
+	}
+	tableName := getModificationTableName(reversal.FileId)
+	var operation, value string
+	err = tx.QueryRow(fmt.Sprintf("select userId, ifnull(opration, ''), ifnull(value, '') from %s where rowid = ?", tableName),
+		reversal.OperationId).Scan(&reversal.User, &operation, &value)
+	if err == sql.ErrNoRows || (nil == err && operation != "subtract") {
+		return NoSuchSubtractErr
+	}
+	if err != nil {
+		return err
+	}
+	left, err := hexutil.DecodeBig(value)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query("select value from reversal where fileId = ? and operationId = ?", reversal.FileId, reversal.OperationId)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		err = rows.Scan(&value)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		reversed, err := hexutil.DecodeBig(value)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		left.Sub(left, reversed)
+	}
+	rows.Close()
+	if reversal.Value.Cmp(left) > 0 {
+		return ReversalExceededErr
+	}
+	err = tx.QueryRow("select payee from earning where fileId = ? and operationId = ? limit 1", reversal.FileId, reversal.OperationId).Scan(&reversal.Payee)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	amount := hexutil.EncodeBig(reversal.Value)
+	result, err := tx.Exec(fmt.Sprintf("insert into %s (userId, opration, value, createTime) values (?, ?, ?, ?);", tableName),
+		reversal.User, "reversal", amount, reversal.CreateTime)
+	if err != nil {
+		return err
+	}
+	reversal.ReversalId, err = result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`insert into reversal (fileId, operationId, reversalId, user, payee, value, actor, reason, createTime)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?)`, reversal.FileId, reversal.OperationId, reversal.ReversalId, reversal.User, reversal.Payee,
+		amount, reversal.Actor, reversal.Reason, reversal.CreateTime)
+	if err != nil {
+		dbLog.Error("insert reversal err: %s", err)
+		return err
+	}
+	return insertMeta(tx, reversal.FileId, meta, reversal.CreateTime, reversal.ReversalId)
+}
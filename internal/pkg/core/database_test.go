@@ -103,7 +103,7 @@ func TestGetOrCreateFileDB(t *testing.T) {
 		"userAsss": 1,
 	}
 	for i := 1; i <= 100; i++ {
-		go initNewFile("0xbbbb"+strconv.Itoa(i), "0xowner", "{}", &at, &mt)
+		go initNewFile("0xbbbb"+strconv.Itoa(i), "0xowner", "{}", &at, &mt, 0, 0)
 	}
 	time.Sleep(time.Second * 5)
 }
@@ -127,3 +127,145 @@ func TestArr(t *testing.T) {
 	aaa = append(aaa, 3)
 	fmt.Println(aaa)
 }
+
+func TestGetInitMortgageForFile(t *testing.T) {
+	fileId := "0xinit" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	mt := MortgageTableT{
+		"0xa": *big.NewInt(5),
+		"0xb": *big.NewInt(7),
+	}
+	err := initNewFile(fileId, "0xowner", "{}", &AllowTableT{}, &mt, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = appendNewOperation(fileId, "0xa", "subtract", "0x2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	init, err := getInitMortgageForFile(fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := (*init)["0xa"]
+	if a.Cmp(big.NewInt(5)) != 0 {
+		t.Errorf("expected init 5 for 0xa, got %s", a.String())
+	}
+	remain, err := getRemainMontage(fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (*remain)["0xa"] != "0x3" || (*remain)["0xb"] != "0x7" {
+		t.Errorf("unexpected remain %v", *remain)
+	}
+}
+
+func TestSetSettlementStatus(t *testing.T) {
+	fileId := "0xsettle" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	err := initNewFile(fileId, "0xowner", "{}", &AllowTableT{}, &MortgageTableT{}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setFileTerminate(fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, txHash := range []string{fileId + "a", fileId + "b"} {
+		err = insertSettlement(&SettlementT{FileId: fileId, TxHash: txHash, Terminate: i == 1, Chunk: i, ChunkCount: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// chunk 1 fails and is resent
+	insertSettlement(&SettlementT{FileId: fileId, TxHash: fileId + "c", Terminate: true, Chunk: 1, ChunkCount: 2})
+	setSettlementStatus(fileId+"b", SettlementStatusFailed)
+	setSettlementStatus(fileId+"a", SettlementStatusConfirmed)
+	file, _ := getFileInfo(fileId)
+	if file.State != FileStateSettling {
+		t.Fatalf("expected %s, got %s", FileStateSettling, file.State)
+	}
+	setSettlementStatus(fileId+"c", SettlementStatusConfirmed)
+	file, _ = getFileInfo(fileId)
+	if file.State != FileStateSettled {
+		t.Fatalf("expected %s, got %s", FileStateSettled, file.State)
+	}
+	pending, _ := listPendingSettlements()
+	for _, settlement := range pending {
+		if settlement.FileId == fileId {
+			t.Errorf("unexpected pending settlement %v", settlement)
+		}
+	}
+}
+
+func TestSetFileSettling(t *testing.T) {
+	fileId := "0xsettling" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	initNewFile(fileId, "0xowner", "{}", &AllowTableT{}, &MortgageTableT{}, 0, 0)
+	err := setFileSettling(fileId, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = setFileSettling(fileId, 2); err != FileClosedErr {
+		t.Errorf("expected FileClosedErr, got %v", err)
+	}
+	next, _ := NextSettlementChunk(fileId)
+	if nil == next || next.Chunk != 0 || next.ChunkCount != 2 || next.Status != SettlementStatusUnsent {
+		t.Fatalf("expected chunk 0 to be sent first, got %v", next)
+	}
+	insertSettlement(&SettlementT{FileId: fileId, TxHash: fileId + "a", Terminate: true, Chunk: 0, ChunkCount: 2})
+	if next, _ = NextSettlementChunk(fileId); nil != next {
+		t.Errorf("expected to wait for chunk 0, got %v", next)
+	}
+	setSettlementStatus(fileId+"a", SettlementStatusConfirmed)
+	if next, _ = NextSettlementChunk(fileId); nil == next || next.Chunk != 1 {
+		t.Errorf("expected chunk 1 next, got %v", next)
+	}
+	settlements, _ := listSettlementsForFile(fileId)
+	if len(settlements) != 2 {
+		t.Errorf("expected the sent chunk to be recorded on its queued row, got %v", settlements)
+	}
+}
+
+func TestSetSettlementStatusBatch(t *testing.T) {
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	txHash := "0xbatch" + suffix
+	var fileIds []string
+	for i := 0; i < 2; i++ {
+		fileId := "0xbatch" + strconv.Itoa(i) + suffix
+		fileIds = append(fileIds, fileId)
+		initNewFile(fileId, "0xowner", "{}", &AllowTableT{}, &MortgageTableT{}, 0, 0)
+		setFileTerminate(fileId)
+		insertSettlement(&SettlementT{FileId: fileId, TxHash: txHash, Terminate: true, ChunkCount: 1})
+	}
+	err := setSettlementStatus(txHash, SettlementStatusConfirmed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileId := range fileIds {
+		file, _ := getFileInfo(fileId)
+		if file.State != FileStateSettled {
+			t.Errorf("expected file %s to be settled, got %s", fileId, file.State)
+		}
+	}
+}
+
+func TestSeenRequests(t *testing.T) {
+	err := insertSeenRequest("0xseen1", "0x01", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = insertSeenRequest("0xseen1", "0x01", 100); err != RequestReusedErr {
+		t.Errorf("expected RequestReusedErr, got %v", err)
+	}
+	if err = insertSeenRequest("0xseen2", "0x01", 0); err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := deleteExpiredSeenRequests(101)
+	if err != nil || pruned != 1 {
+		t.Errorf("pruned %d requests, %v", pruned, err)
+	}
+	if err = insertSeenRequest("0xseen1", "0x01", 200); err != nil {
+		t.Errorf("expected pruned request to be accepted again, got %v", err)
+	}
+	if err = insertSeenRequest("0xseen2", "0x01", 0); err != RequestReusedErr {
+		t.Errorf("expected legacy request to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package core
+
+import (
+	"errors"
+	"time"
+)
+
+var NoDelegationErr = errors.New("no valid delegation")
+var InvalidDelegationErr = errors.New("invalid delegation")
+var DelegationCapErr = errors.New("allowance of the delegation exhausted")
+
+// DelegationT lets a session key or a service address subtract from the balance of a
+// user in a file, up to a cap until an expiry, without the key of the user.
+type DelegationT struct {
+	FileId   string
+	User     string
+	Delegate string
+	// total the delegate may subtract, and what it did
+	Cap   *CoinUnitT
+	Spent *CoinUnitT
+	// unix time after which the delegate is refused
+	ValidUntil int64
+	// signature of the request of the user that created the delegation
+	Signature  string
+	CreateTime int64
+}
+
+// Remaining returns what the delegate may still subtract.
+func (d *DelegationT) Remaining() *CoinUnitT {
+	return new(CoinUnitT).Sub(d.Cap, d.Spent)
+}
+
+// Delegate lets delegate subtract up to limit from the balance of user in a file until
+// validUntil, replacing a previous delegation to it. The user must be allowed to charge.
+func Delegate(user string, fileId string, delegate string, limit *CoinUnitT, validUntil int64, signature string) (*DelegationT, error) {
+	now := time.Now().Unix()
+	if user == delegate || nil == limit || limit.Sign() <= 0 || validUntil < now {
+		return nil, InvalidDelegationErr
+	}
+	if err := authorize(user, fileId, CapCharge); err != nil {
+		return nil, err
+	}
+	delegation := &DelegationT{FileId: fileId, User: user, Delegate: delegate, Cap: limit, Spent: new(CoinUnitT),
+		ValidUntil: validUntil, Signature: signature, CreateTime: now}
+	return delegation, putDelegation(delegation)
+}
+
+// RevokeDelegation ends the delegation user gave delegate in a file.
+func RevokeDelegation(user string, fileId string, delegate string) error {
+	found, err := deleteDelegation(fileId, user, delegate)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return NoDelegationErr
+	}
+	return nil
+}
+
+// ListDelegations returns the delegations user gave in a file, expired ones included.
+func ListDelegations(user string, fileId string) ([]DelegationT, error) {
+	return listDelegations(fileId, user)
+}
+
+// SubtractAsDelegate subtracts amount from the balance of user in a file on behalf of
+// delegate, within the allowance of its delegation and the privilege of the user, and
+// credits it to payee, see SubtractValueTo. It returns the balance and the delegation
+// after the subtract.
+func SubtractAsDelegate(delegate string, user string, fileId string, amount *CoinUnitT, payee string, meta *OperationMetaT) (*CoinUnitT, *DelegationT, error) {
+	if amount.Sign() < 0 {
+		return nil, nil, NoNegativeValueAllowedErr
+	}
+	if err := checkMeta(meta); err != nil {
+		return nil, nil, err
+	}
+	// the allowance is taken first so that concurrent subtracts cannot exceed it
+	delegation, err := spendDelegation(fileId, user, delegate, amount, time.Now().Unix())
+	if err != nil {
+		return nil, nil, err
+	}
+	balance, err := SubtractValueTo(user, fileId, amount, payee, meta)
+	if err != nil {
+		if _, rollbackErr := spendDelegation(fileId, user, delegate, new(CoinUnitT).Neg(amount), 0); rollbackErr != nil {
+			dbLog.Errorf("give back %s to the delegation of %s to %s in %s: %s", amount, user, delegate, fileId, rollbackErr)
+		}
+		return nil, nil, err
+	}
+	return balance, delegation, nil
+}
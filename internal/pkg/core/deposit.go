@@ -0,0 +1,52 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var DepositExistsErr = errors.New("deposit already ingested")
+var FileClosedErr = errors.New("file is not open")
+var InvalidDepositErr = errors.New("invalid deposit")
+
+// DepositT is a top-up of an open file by a chain transaction, Value being what it
+// locked and added to the balances of the file.
+type DepositT struct {
+	TxHash      string
+	FileId      string
+	From        string
+	Value       *CoinUnitT
+	BlockNumber string
+	CreateTime  int64
+}
+
+// Deposit adds mortgage to the balances of an open file, once per transaction of the
+// deposit. Users of allow who have no privilege in the file yet are added to it, which
+// only the owner of the file may do.
+func Deposit(deposit *DepositT, mortgage *MortgageTableT, allow *AllowTableT) error {
+	if "" == deposit.TxHash || 0 == len(*mortgage) {
+		return InvalidDepositErr
+	}
+	info, err := getFileInfo(deposit.FileId)
+	if err != nil {
+		return err
+	}
+	if nil != allow && len(*allow) > 0 && !strings.EqualFold(info.Owner, deposit.From) {
+		return NotOwnerErr
+	}
+	deposit.Value = new(CoinUnitT)
+	for _, amount := range *mortgage {
+		if amount.Sign() < 0 {
+			return NoNegativeValueAllowedErr
+		}
+		deposit.Value.Add(deposit.Value, &amount)
+	}
+	deposit.CreateTime = time.Now().Unix()
+	return appendDeposit(deposit, mortgage, allow)
+}
+
+// ListDeposits returns the deposits of a file, oldest first.
+func ListDeposits(fileId string) ([]DepositT, error) {
+	return listDeposits(fileId)
+}
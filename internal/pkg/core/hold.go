@@ -0,0 +1,145 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// states of a hold
+const (
+	HoldActive   = "active"
+	HoldCaptured = "captured"
+	HoldReleased = "released"
+	HoldExpired  = "expired"
+)
+
+var InvalidHoldErr = errors.New("invalid hold")
+var NoSuchHoldErr = errors.New("no such hold")
+var HoldNotActiveErr = errors.New("hold was captured, released or expired")
+var HoldExceededErr = errors.New("amount above the hold")
+
+// HoldT reserves an amount of the balance of a user in a file until its payee captures
+// part or all of it or releases it, or it expires.
+type HoldT struct {
+	Id     int64
+	FileId string
+	User   string
+	// may capture the hold, and is credited with what it captures
+	Payee    string
+	Amount   *CoinUnitT
+	Captured *CoinUnitT
+	Status   string
+	// unix time after which the hold expires
+	ValidUntil int64
+	CreateTime int64
+	UpdateTime int64
+}
+
+// BalanceT is the balance of a user in a file with what active holds reserve of it.
+type BalanceT struct {
+	Balance   *CoinUnitT
+	Held      *CoinUnitT
+	Available *CoinUnitT
+}
+
+// Reserve places a hold of amount on the balance of user in a file, which payee may
+// capture until validUntil. The user must be allowed to charge amount, which the
+// limits of its privilege are checked against once, here.
+func Reserve(user string, fileId string, payee string, amount *CoinUnitT, validUntil int64) (*HoldT, error) {
+	now := time.Now().Unix()
+	if "" == payee || user == payee || nil == amount || amount.Sign() <= 0 || validUntil < now {
+		return nil, InvalidHoldErr
+	}
+	if err := authorize(user, fileId, CapCharge); err != nil {
+		return nil, err
+	}
+	limits, err := chargeLimits(user, fileId)
+	if err != nil {
+		return nil, err
+	}
+	hold := &HoldT{FileId: fileId, User: user, Payee: payee, Amount: amount, Status: HoldActive, ValidUntil: validUntil,
+		CreateTime: now, UpdateTime: now}
+	hold.Id, err = insertHold(hold, limits)
+	if err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// Capture subtracts amount, at most the hold, from the balance of its user and credits
+// it to its payee, releasing the rest, on behalf of actor, the user or the payee of the
+// hold. The user must still be allowed to charge, its privilege being valid, else the
+// hold can only be released by its payee or expire. meta, unless nil, is recorded with
+// the subtract. It returns the hold and the balance of the user after the capture.
+func Capture(actor string, fileId string, id int64, amount *CoinUnitT, meta *OperationMetaT) (*HoldT, *CoinUnitT, error) {
+	if nil == amount || amount.Sign() < 0 {
+		return nil, nil, NoNegativeValueAllowedErr
+	}
+	if err := checkMeta(meta); err != nil {
+		return nil, nil, err
+	}
+	hold, err := holdOf(actor, fileId, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = authorize(hold.User, fileId, CapCharge); err != nil {
+		return nil, nil, err
+	}
+	if amount.Cmp(hold.Amount) > 0 {
+		return nil, nil, HoldExceededErr
+	}
+	hold, err = closeHold(fileId, id, HoldCaptured, amount, meta, time.Now().Unix())
+	if err != nil {
+		return nil, nil, err
+	}
+	balance, err := readValueDirect(fileId, hold.User)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hold, balance, nil
+}
+
+// Release ends a hold without charging it, on behalf of actor, the payee of the hold,
+// whatever the privilege of the user is now. The user cannot void a hold it placed, it
+// expires instead.
+func Release(actor string, fileId string, id int64) (*HoldT, error) {
+	hold, err := holdOf(actor, fileId, id)
+	if err != nil {
+		return nil, err
+	}
+	if actor != hold.Payee {
+		return nil, NoPermissionErr
+	}
+	return closeHold(fileId, id, HoldReleased, nil, nil, time.Now().Unix())
+}
+
+// holds of other users are not told apart from missing ones
+func holdOf(actor string, fileId string, id int64) (*HoldT, error) {
+	hold, err := getHold(fileId, id)
+	if err == sql.ErrNoRows || (nil == err && actor != hold.User && actor != hold.Payee) {
+		return nil, NoSuchHoldErr
+	}
+	return hold, err
+}
+
+// ExpireHolds marks the active holds whose validity ended before now as expired and
+// returns how many there were. Expired holds reserve nothing even before.
+func ExpireHolds(now int64) (int64, error) {
+	return expireHolds(now)
+}
+
+// ReadBalance returns the balance of userId in a file with what active holds reserve
+// of it, to the users ReadValue returns it to.
+func ReadBalance(readingUser string, fileId string, userId string) (*BalanceT, error) {
+	if err := authorizeRead(readingUser, fileId, userId); err != nil {
+		return nil, err
+	}
+	return readBalanceDirect(fileId, userId, time.Now().Unix())
+}
+
+func readBalanceDirect(fileId string, userId string, now int64) (*BalanceT, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	return queryBalance(dbConn, fileId, userId, now)
+}
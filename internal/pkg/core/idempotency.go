@@ -0,0 +1,46 @@
+package core
+
+import (
+	"errors"
+	"time"
+)
+
+const maxIdempotencyKeyLength = 255
+
+var InvalidIdempotencyKeyErr = errors.New("invalid idempotency key")
+var IdempotencyKeyReusedErr = errors.New("idempotency key used by another request")
+var IdempotencyKeyPendingErr = errors.New("request with the idempotency key is in progress")
+
+// BeginIdempotent claims key, an idempotency key of signer in a file, for the request
+// payload identifies. It returns the result, or the failure, of the request that
+// completed under key earlier, both empty when the key was free,
+// IdempotencyKeyReusedErr if that request was another one and IdempotencyKeyPendingErr
+// while it has not completed.
+func BeginIdempotent(signer string, fileId string, key string, payload string) (string, string, error) {
+	if "" == key || len(key) > maxIdempotencyKeyLength {
+		return "", "", InvalidIdempotencyKeyErr
+	}
+	return claimIdempotencyKey(signer, fileId, key, payload, time.Now().Unix())
+}
+
+// CompleteIdempotent records result, the json result of the request key was claimed
+// for, to be returned to its retries.
+func CompleteIdempotent(signer string, fileId string, key string, result string) error {
+	return setIdempotencyResult(signer, fileId, key, result)
+}
+
+// FailIdempotent records failure, how the request key was claimed for was rejected, to
+// be returned to its retries.
+func FailIdempotent(signer string, fileId string, key string, failure string) error {
+	return setIdempotencyFailure(signer, fileId, key, failure)
+}
+
+// ForgetIdempotent frees key after its request failed, so that it can be retried.
+func ForgetIdempotent(signer string, fileId string, key string) error {
+	return deleteIdempotencyKey(signer, fileId, key)
+}
+
+// PruneIdempotencyKeys frees the keys claimed before and returns their number.
+func PruneIdempotencyKeys(before int64) (int64, error) {
+	return deleteIdempotencyKeysBefore(before)
+}
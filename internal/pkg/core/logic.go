@@ -1,18 +1,31 @@
 package core
 
 import (
+	"database/sql"
 	"errors"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"math/big"
+	"sort"
+	"time"
 )
 
+// actions of privilege events
 const (
-	Readwrite = 0
-	Readonly  = 1
-	Write     = 2
+	// privileges of the file when it was ingested from the chain
+	PrivilegeInit   = "init"
+	PrivilegeGrant  = "grant"
+	PrivilegeChange = "change"
+	PrivilegeRevoke = "revoke"
+	// privileges of the users a deposit added to the file
+	PrivilegeDeposit = "deposit"
 )
 
+// maximum number of operations ListOperations returns at once
+const MaxOperationsPage = 100
+
 type CoinUnitT = big.Int
+
+// privileges of the chain's AuthorityTable, see LegacyCapability
 type AllowTableT = map[string]int
 type MortgageTableT = map[string]CoinUnitT
 type ModificationT struct {
@@ -22,82 +35,236 @@ type ModificationT struct {
 
 type MortgageT = map[string]string
 
-type fireSyncFuncT func (isTerminate bool, fromAccount, fileId string, mortgage *MortgageT) bool
+const (
+	// file was terminated and its sync transactions are not all confirmed yet
+	FileStateSettling = "settling"
+	// every chunk of the settlement is confirmed on chain
+	FileStateSettled = "settled"
+)
+
+const (
+	// the chunk is queued, no sync transaction was sent for it yet
+	SettlementStatusUnsent    = "unsent"
+	SettlementStatusPending   = "pending"
+	SettlementStatusConfirmed = "confirmed"
+	SettlementStatusFailed    = "failed"
+)
+
+type FileInfoT struct {
+	FileId     string
+	Owner      string
+	IsOpen     bool
+	OriginJson string
+	State      string
+	StartTime  int64
+	EndTime    int64
+	CreateTime int64
+}
+
+// SettlementT is one sync transaction. A settlement of a file with many participants
+// is split into ChunkCount transactions, Chunk being the index of this one.
+type SettlementT struct {
+	FileId     string
+	TxHash     string
+	Terminate  bool
+	Chunk      int
+	ChunkCount int
+	Status     string
+	CreateTime int64
+}
+
+// ParticipantT is a user holding a privilege or a balance in a file.
+type ParticipantT struct {
+	User string
+	// NoCapability when the user only has a balance
+	Privilege Capability
+	Limits    PrivilegeLimitsT
+	Balance   *CoinUnitT
+	// reserved by active holds
+	Held *CoinUnitT
+}
+
+// OperationT is one entry of the history of a file.
+type OperationT struct {
+	Id         int64
+	User       string
+	Operation  string
+	Value      string
+	CreateTime int64
+	// id of the subtract a reversal reverses
+	Reverses int64
+	// the request the operation was made by, nil when not known
+	Meta *OperationMetaT
+}
+
+// OperationFilterT selects a page of the history of a file. Zero values do not filter.
+type OperationFilterT struct {
+	User   string
+	From   int64
+	To     int64
+	Offset int
+	Limit  int
+}
+
+// UserFileT is a file a user owns or has a privilege in.
+type UserFileT struct {
+	FileInfoT
+	Privilege Capability
+}
+
+// PrivilegeEventT is one change of the privilege of a user in a file, with the user
+// who made it and the signature of the request that authorised it.
+type PrivilegeEventT struct {
+	FileId string
+	User   string
+	Action string
+	// NoCapability after a revoke
+	Privilege Capability
+	// limits of the new privilege
+	Limits PrivilegeLimitsT
+	// NoCapability before a grant
+	Previous   Capability
+	Actor      string
+	Signature  string
+	CreateTime int64
+}
+
+type fireSyncFuncT func(fileId string) error
+
+// chunkCountFuncT tells in how many sync transactions the final balances of a file
+// are sent.
+type chunkCountFuncT func(mortgage *MortgageT) int
 
 var InsufficientBalanceErr = errors.New("insufficient balance")
 var NotOwnerErr = errors.New("insufficient privilege: not owner")
 var NoPermissionErr = errors.New("user has no permission")
 var UnSupportedOperationErr = errors.New("UnSupportedOperationErr")
 var NoNegativeValueAllowedErr = errors.New("NoNegativeValueAllowedErr")
+var SyncTransactionErr = errors.New("failed to send sync transaction")
+var RequestReusedErr = errors.New("request already processed")
+var InvalidPrivilegeErr = errors.New("invalid privilege")
+var EscalationErr = errors.New("insufficient privilege: cannot grant or revoke capabilities not held")
+var PrivilegeUnchangedErr = errors.New("user already has this privilege")
+var NoSuchPrivilegeErr = errors.New("user has no privilege in file")
 
 var fireSyncFunc fireSyncFuncT
+var chunkCountFunc chunkCountFuncT
 
 func SetSyncFunc(fun fireSyncFuncT) {
 	fireSyncFunc = fun
 }
 
-func InitFile(userId string, fileId string, allow *AllowTableT, mortgage *MortgageTableT, startTime int64, EndTime int64) error {
-	err := initNewFile(fileId, userId, "", allow, mortgage)
+// SetChunkCountFunc sets how settlements are split, in a single chunk when unset.
+func SetChunkCountFunc(fun chunkCountFuncT) {
+	chunkCountFunc = fun
+}
+
+func InitFile(userId string, fileId string, originJson string, allow *AllowTableT, mortgage *MortgageTableT, startTime int64, EndTime int64) error {
+	err := initNewFile(fileId, userId, originJson, allow, mortgage, startTime, EndTime)
 	return err
 }
 
 func Terminate(userId string, fileId string) (string, error) {
 	// 1. check privilege
-	bOwner, _ := isOwner(fileId, userId)
-	if !bOwner {
-		return "", NotOwnerErr
-	}
-	// 2. update db.
-	err := setFileTerminate(fileId)
+	err := authorize(userId, fileId, CapTerminate)
 	if err != nil {
 		return "", err
 	}
-	// 3. get final state
+	return "", settleFile(fileId)
+}
+
+// settleFile closes the file and queues the chunks of its settlement in one transaction,
+// then sends the first chunk. The settlement worker sends the next ones and retries the
+// chunks that could not be sent.
+func settleFile(fileId string) error {
+	// 1. get final state
 	mt, err := getRemainMontage(fileId)
 	if err != nil {
-		return "", err
+		return err
 	}
-	// 4. send terminate transaction
-	bOK := fireSyncFunc(true, userId, fileId, mt)
-	if !bOK {
-		return "", err
+	chunkCount := 1
+	if nil != chunkCountFunc {
+		chunkCount = chunkCountFunc(mt)
+	}
+	// 2. update db.
+	err = setFileSettling(fileId, chunkCount)
+	if err != nil {
+		return err
+	}
+	// 3. send terminate transaction
+	if nil != fireSyncFunc {
+		err = fireSyncFunc(fileId)
+		if err != nil {
+			dbLog.Errorf("unable to send the settlement of file %s, it will be retried: %s", fileId, err)
+		}
+	}
+	return nil
+}
+
+// SettleExpiredFiles terminates the open files whose end time is not after now and
+// returns their ids.
+func SettleExpiredFiles(now int64) ([]string, error) {
+	files, err := listExpiredFiles(now)
+	if err != nil {
+		return nil, err
+	}
+	var settled []string
+	for _, file := range files {
+		err = settleFile(file.FileId)
+		if err != nil {
+			dbLog.Errorf("unable to settle expired file %s: %s", file.FileId, err)
+			continue
+		}
+		settled = append(settled, file.FileId)
 	}
-	return "", nil
+	return settled, nil
 }
 
 func SubtractValue(userId string, fileId string, amount *CoinUnitT) (*CoinUnitT, error) {
+	return SubtractValueTo(userId, fileId, amount, "", nil)
+}
+
+// SubtractValueTo subtracts amount from the balance of userId and credits it to the
+// earnings of payee in the file, the owner of the file when payee is empty, recording
+// meta with it unless nil. It returns the balance after the subtract.
+func SubtractValueTo(userId string, fileId string, amount *CoinUnitT, payee string, meta *OperationMetaT) (*CoinUnitT, error) {
+	if err := checkMeta(meta); err != nil {
+		return nil, err
+	}
 	// 1. check privilege
-	permi, _ := getPermissionForFile(userId, fileId)
-	if permi == Readwrite || permi == Write {
+	if err := authorize(userId, fileId, CapCharge); err == nil {
 		// 2. check input
 		if amount.Cmp(big.NewInt(0)) == -1 {
 			return nil, NoNegativeValueAllowedErr
 		}
-		// 3. check balance
-		bal, err := readValueDirect(fileId, userId)
+		limits, err := chargeLimits(userId, fileId)
 		if err != nil {
 			return nil, err
 		}
-		if bal.Cmp(amount) == -1 {
-			return nil, InsufficientBalanceErr
-		}
-		// 4. insert modify table
-		err = appendNewOperation(fileId, userId, "subtract", hexutil.EncodeBig(amount))
-		if err != nil {
-			return nil, err
+		if "" == payee {
+			info, err := getFileInfo(fileId)
+			if err != nil {
+				return nil, err
+			}
+			payee = info.Owner
 		}
-		// 5. return if success
-		return bal.Sub(bal, amount), nil
+		// 3. check the limits and the balance, what holds reserve being unavailable,
+		// insert modify table and credit the payee, all in one transaction
+		return appendSubtract(fileId, userId, amount, payee, limits, meta)
+	} else {
+		return nil, err
 	}
-	return nil, NoPermissionErr
 }
 
 func singleOperation(operation string, lValue *CoinUnitT, rValue *CoinUnitT) (result *CoinUnitT, err error) {
+	result = new(CoinUnitT)
 	switch operation {
-	case "init":
+	case "init", "deposit":
 		return result.Add(lValue, rValue), nil
-	case "subtract":
+	case "subtract", "transferOut":
 		return result.Sub(lValue, rValue), nil
+	case "transferIn", "reversal":
+		return result.Add(lValue, rValue), nil
 	default:
 		return nil, UnSupportedOperationErr
 	}
@@ -130,13 +297,156 @@ func readValueDirect(fileId string, userId string) (*CoinUnitT, error) {
 func ReadValue(readingUser string, fileId string, userId string) (*CoinUnitT, error) {
 	// TODO: consider performance improve
 	// 1. check privilege
-	permi, _ := getPermissionForFile(readingUser, fileId)
-	if permi == Readwrite || permi == Readonly {
+	err := authorizeRead(readingUser, fileId, userId)
+	if err == nil {
 		// proceed to read
 		return readValueDirect(fileId, userId)
 	} else {
-		return nil, NoPermissionErr
+		return nil, err
+	}
+}
+
+// authorizeRead returns nil if readingUser may read the balance of userId in a file.
+func authorizeRead(readingUser string, fileId string, userId string) error {
+	err := authorize(readingUser, fileId, CapReadAll)
+	if err != nil && readingUser == userId {
+		err = authorize(readingUser, fileId, CapReadOwn)
+	}
+	return err
+}
+
+// FileStatus returns the file and its settlements to a user allowed to read its own
+// balance in it.
+func FileStatus(readingUser string, fileId string) (*FileInfoT, []SettlementT, error) {
+	err := authorize(readingUser, fileId, CapReadOwn)
+	if err != nil {
+		err = authorize(readingUser, fileId, CapReadAll)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := getFileInfo(fileId)
+	if err != nil {
+		return nil, nil, err
+	}
+	settlements, err := listSettlementsForFile(fileId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return info, settlements, nil
+}
+
+// ListParticipants returns the privileges and balances of a file, ordered by user, to
+// a user allowed to read all balances.
+func ListParticipants(readingUser string, fileId string) ([]ParticipantT, error) {
+	if err := authorize(readingUser, fileId, CapReadAll); err != nil {
+		return nil, err
+	}
+	privileges, err := listPrivilegesForFile(fileId)
+	if err != nil {
+		return nil, err
+	}
+	userIds, err := listAllUsersForFile(fileId)
+	if err != nil {
+		return nil, err
+	}
+	for _, userId := range *userIds {
+		if _, ok := privileges[userId]; !ok {
+			privileges[userId] = ParticipantT{User: userId}
+		}
+	}
+	held, err := activeHolds(fileId, "", time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	var participants []ParticipantT
+	for userId, participant := range privileges {
+		participant.Balance, err = readValueDirect(fileId, userId)
+		if err != nil {
+			return nil, err
+		}
+		participant.Held = new(CoinUnitT)
+		if nil != held[userId] {
+			participant.Held = held[userId]
+		}
+		participants = append(participants, participant)
+	}
+	sort.Slice(participants, func(i, j int) bool { return participants[i].User < participants[j].User })
+	return participants, nil
+}
+
+// ListOperations returns a page of the history of a file, oldest first, and the number
+// of operations matching the filter, to a user allowed to read all balances, or its
+// own operations to a user allowed to read its own balance.
+func ListOperations(readingUser string, fileId string, filter OperationFilterT) ([]OperationT, int, error) {
+	err := authorize(readingUser, fileId, CapReadAll)
+	if err != nil && filter.User == readingUser {
+		err = authorize(readingUser, fileId, CapReadOwn)
 	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if filter.Limit <= 0 || filter.Limit > MaxOperationsPage {
+		filter.Limit = MaxOperationsPage
+	}
+	if filter.Offset < 0 {
+		filter.Offset = 0
+	}
+	return queryOperations(fileId, filter)
+}
+
+// ListFilesForUser returns the files user owns or has a privilege in, the owner
+// holding RoleOwner.
+func ListFilesForUser(user string) ([]UserFileT, error) {
+	files, err := listFilesForUser(user)
+	for i := range files {
+		if files[i].Owner == user {
+			files[i].Privilege = RoleOwner
+		}
+	}
+	return files, err
+}
+
+// GrantPrivilege gives user privilege in a file within limits, or changes the one it
+// has, on behalf of manager. manager must hold CapManage and every capability it grants
+// or takes away. The change is recorded with the signature that authorised it.
+func GrantPrivilege(manager string, fileId string, user string, privilege Capability, limits *PrivilegeLimitsT, signature string) (*PrivilegeEventT, error) {
+	if privilege == NoCapability || !AllCapabilities.Has(privilege) {
+		return nil, InvalidPrivilegeErr
+	}
+	if !limits.valid() {
+		return nil, InvalidLimitsErr
+	}
+	return managePrivilege(manager, fileId, user, privilege, limits, signature)
+}
+
+// RevokePrivilege takes the privilege of user in a file away, on behalf of manager, see
+// GrantPrivilege.
+func RevokePrivilege(manager string, fileId string, user string, signature string) (*PrivilegeEventT, error) {
+	return managePrivilege(manager, fileId, user, NoCapability, &PrivilegeLimitsT{}, signature)
+}
+
+func managePrivilege(manager string, fileId string, user string, privilege Capability, limits *PrivilegeLimitsT, signature string) (*PrivilegeEventT, error) {
+	if err := authorize(manager, fileId, CapManage); err != nil {
+		return nil, err
+	}
+	held, err := capabilities(manager, fileId)
+	if err != nil {
+		return nil, err
+	}
+	if !held.Has(privilege) {
+		return nil, EscalationErr
+	}
+	return changePrivilege(fileId, user, privilege, limits, held, manager, signature)
+}
+
+// ListPrivilegeEvents returns the privilege changes of a file, oldest first, to a user
+// allowed to read all balances.
+func ListPrivilegeEvents(readingUser string, fileId string) ([]PrivilegeEventT, error) {
+	if err := authorize(readingUser, fileId, CapReadAll); err != nil {
+		return nil, err
+	}
+	return listPrivilegeEvents(fileId)
 }
 
 func getRemainMontage(fileId string) (*MortgageT, error){
@@ -156,4 +466,157 @@ func getRemainMontage(fileId string) (*MortgageT, error){
 		mt[userId] = hexutil.EncodeBig(balance)
 	}
 	return &mt, nil
-}
\ No newline at end of file
+}
+
+// Earnings returns what subtracts credited to each payee of the file.
+func Earnings(fileId string) (*MortgageT, error) {
+	return getEarnings(fileId)
+}
+
+// ListEarnings returns the earnings of the payees of a file to a user allowed to read all
+// balances, and only its own earnings to anybody else.
+func ListEarnings(readingUser string, fileId string) (*MortgageT, error) {
+	if _, err := getFileInfo(fileId); err == sql.ErrNoRows {
+		return nil, NoPermissionErr
+	}
+	earnings, err := getEarnings(fileId)
+	if err != nil {
+		return nil, err
+	}
+	if authorize(readingUser, fileId, CapReadAll) == nil {
+		return earnings, nil
+	}
+	own := make(MortgageT)
+	if earned, ok := (*earnings)[readingUser]; ok {
+		own[readingUser] = earned
+	}
+	return &own, nil
+}
+
+// ListFiles returns every file known to the local ledger.
+func ListFiles() ([]FileInfoT, error) {
+	return listFiles()
+}
+
+// InitMortgage returns the amounts each user funded the file with at init time.
+func InitMortgage(fileId string) (*MortgageTableT, error) {
+	return getInitMortgageForFile(fileId)
+}
+
+// RemainMortgage returns the current balance of every user of the file.
+func RemainMortgage(fileId string) (*MortgageT, error) {
+	return getRemainMontage(fileId)
+}
+
+// GetFileInfo returns the fileIndex row of the file.
+func GetFileInfo(fileId string) (*FileInfoT, error) {
+	return getFileInfo(fileId)
+}
+
+// RecordSettlement remembers a sync transaction sent for a chunk of the file as pending.
+func RecordSettlement(settlement *SettlementT) error {
+	return insertSettlement(settlement)
+}
+
+// ListSettlements returns the sync transactions sent for the file, oldest first.
+func ListSettlements(fileId string) ([]SettlementT, error) {
+	return listSettlementsForFile(fileId)
+}
+
+// NextSettlementChunk returns the chunk of the settlement of the file to send next, nil
+// when the file is not settling or a chunk is waiting for its receipt. Chunks are sent
+// one at a time and in order, so the last one, carrying the terminate flag, reaches the
+// chain once every other chunk is confirmed.
+func NextSettlementChunk(fileId string) (*SettlementT, error) {
+	file, err := getFileInfo(fileId)
+	if err != nil {
+		return nil, err
+	}
+	if file.State != FileStateSettling {
+		return nil, nil
+	}
+	settlements, err := listSettlementsForFile(fileId)
+	if err != nil {
+		return nil, err
+	}
+	// a chunk is confirmed or pending as soon as one of its transactions is
+	rank := map[string]int{SettlementStatusFailed: 1, SettlementStatusUnsent: 2, SettlementStatusPending: 3, SettlementStatusConfirmed: 4}
+	statuses := make(map[int]string)
+	chunkCount := 0
+	for _, settlement := range settlements {
+		chunkCount = settlement.ChunkCount
+		if rank[settlement.Status] > rank[statuses[settlement.Chunk]] {
+			statuses[settlement.Chunk] = settlement.Status
+		}
+	}
+	if 0 == chunkCount {
+		// closed before its chunks were queued along with it
+		mt, err := getRemainMontage(fileId)
+		if err != nil {
+			return nil, err
+		}
+		chunkCount = 1
+		if nil != chunkCountFunc {
+			chunkCount = chunkCountFunc(mt)
+		}
+	}
+	for chunk := 0; chunk < chunkCount; chunk++ {
+		switch statuses[chunk] {
+		case SettlementStatusConfirmed:
+			continue
+		case SettlementStatusPending:
+			return nil, nil
+		}
+		return &SettlementT{
+			FileId:     fileId,
+			Terminate:  true,
+			Chunk:      chunk,
+			ChunkCount: chunkCount,
+			Status:     statuses[chunk],
+		}, nil
+	}
+	return nil, nil
+}
+
+// ListPendingSettlements returns the sync transactions whose receipt has not been checked yet.
+func ListPendingSettlements() ([]SettlementT, error) {
+	return listPendingSettlements()
+}
+
+// ConfirmSettlement marks the sync transaction as mined successfully. The file becomes
+// settled when all chunks of its settlement are confirmed.
+func ConfirmSettlement(txHash string) error {
+	return setSettlementStatus(txHash, SettlementStatusConfirmed)
+}
+
+// FailSettlement marks the sync transaction as reverted so its chunk can be sent again.
+func FailSettlement(txHash string) error {
+	return setSettlementStatus(txHash, SettlementStatusFailed)
+}
+
+// GetSyncState returns a value remembered by SetSyncState, or "" if there is none.
+func GetSyncState(name string) (string, error) {
+	return getSyncState(name)
+}
+
+// SetSyncState remembers progress of chain ingestion across restarts.
+func SetSyncState(name string, value string) error {
+	return setSyncState(name, value)
+}
+
+// RecordRequest remembers the signed request identified by key so it is accepted once.
+// It returns RequestReusedErr if the request was seen before. Requests with an expiry
+// are forgotten by PruneRequests once it has passed, when they are refused anyway.
+func RecordRequest(key string, signer string, expiry int64) error {
+	return insertSeenRequest(key, signer, expiry)
+}
+
+// ForgetRequest lets a recorded request be sent again, after it failed.
+func ForgetRequest(key string) error {
+	return deleteSeenRequest(key)
+}
+
+// PruneRequests forgets the requests that expired before now and returns their number.
+func PruneRequests(now int64) (int64, error) {
+	return deleteExpiredSeenRequests(now)
+}
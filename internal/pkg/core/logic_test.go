@@ -1,6 +1,14 @@
 package core
 
-import "testing"
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestInitFile(t *testing.T) {
 	//err := InitFile("0x123", `{"aaa": "100"}`, &AllowTableT{}, &MortgageTableT{})
@@ -9,3 +17,949 @@ func TestInitFile(t *testing.T) {
 	//	t.Fail()
 	//}
 }
+
+func TestQueries(t *testing.T) {
+	fileId := "queryfile1"
+	err := InitFile("0xowner", fileId, "", &AllowTableT{"0xowner": Readonly, "0xa": Readwrite, "0xb": Write},
+		&MortgageTableT{"0xa": *big.NewInt(100), "0xb": *big.NewInt(50), "0xc": *big.NewInt(7)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SubtractValue("0xa", fileId, big.NewInt(30)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = FileStatus("0xb", fileId); err != NoPermissionErr {
+		t.Errorf("expected a write-only user to be refused, got %v", err)
+	}
+	info, _, err := FileStatus("0xowner", fileId)
+	if err != nil || info.Owner != "0xowner" || !info.IsOpen {
+		t.Errorf("unexpected file %+v, %v", info, err)
+	}
+
+	participants, err := ListParticipants("0xa", fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		user      string
+		privilege Capability
+		balance   int64
+	}{{"0xa", RoleReadwrite, 70}, {"0xb", RoleWrite, 50}, {"0xc", NoCapability, 7}, {"0xowner", RoleReadonly, 0}}
+	if len(participants) != len(expected) {
+		t.Fatalf("unexpected participants %+v", participants)
+	}
+	for i, e := range expected {
+		p := participants[i]
+		if p.User != e.user || p.Privilege != e.privilege || p.Balance.Int64() != e.balance {
+			t.Errorf("participant %d: %+v, expected %+v", i, p, e)
+		}
+	}
+
+	operations, total, err := ListOperations("0xa", fileId, OperationFilterT{User: "0xa"})
+	if err != nil || total != 2 || len(operations) != 2 || operations[1].Operation != "subtract" {
+		t.Errorf("unexpected operations %+v (%d), %v", operations, total, err)
+	}
+	operations, total, err = ListOperations("0xa", fileId, OperationFilterT{Offset: 3, Limit: 2})
+	if err != nil || total != 4 || len(operations) != 1 {
+		t.Errorf("unexpected page %+v (%d), %v", operations, total, err)
+	}
+	if _, _, err = ListOperations("0xc", fileId, OperationFilterT{}); err != NoPermissionErr {
+		t.Errorf("expected a user without privilege to be refused, got %v", err)
+	}
+
+	files, err := ListFilesForUser("0xb")
+	if err != nil || len(files) != 1 || files[0].FileId != fileId || files[0].Privilege != RoleWrite {
+		t.Errorf("unexpected files %+v, %v", files, err)
+	}
+	if files, _ = ListFilesForUser("0xc"); len(files) != 0 {
+		t.Errorf("expected no files for a user without privilege, got %+v", files)
+	}
+}
+
+func TestPrivilegeChanges(t *testing.T) {
+	fileId := "privilegefile1"
+	err := InitFile("0xowner", fileId, "", &AllowTableT{"0xa": Readonly}, &MortgageTableT{"0xb": *big.NewInt(10)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GrantPrivilege("0xa", fileId, "0xb", RoleWrite, &PrivilegeLimitsT{}, "sig0"); err != NotOwnerErr {
+		t.Errorf("expected a non-owner to be refused, got %v", err)
+	}
+	if _, err = GrantPrivilege("0xowner", fileId, "0xb", CapRefund<<1, &PrivilegeLimitsT{}, "sig0"); err != InvalidPrivilegeErr {
+		t.Errorf("expected an unknown privilege to be refused, got %v", err)
+	}
+	event, err := GrantPrivilege("0xowner", fileId, "0xb", RoleWrite, &PrivilegeLimitsT{}, "sig1")
+	if err != nil || event.Action != PrivilegeGrant || event.Previous != NoCapability {
+		t.Fatalf("unexpected grant %+v, %v", event, err)
+	}
+	if _, err = SubtractValue("0xb", fileId, big.NewInt(4)); err != nil {
+		t.Errorf("expected the granted user to subtract, got %v", err)
+	}
+	if _, err = GrantPrivilege("0xowner", fileId, "0xb", RoleWrite, &PrivilegeLimitsT{}, "sig2"); err != PrivilegeUnchangedErr {
+		t.Errorf("expected a grant of the same privilege to be refused, got %v", err)
+	}
+	event, err = GrantPrivilege("0xowner", fileId, "0xa", RoleReadwrite, &PrivilegeLimitsT{}, "sig3")
+	if err != nil || event.Action != PrivilegeChange || event.Previous != RoleReadonly {
+		t.Errorf("unexpected change %+v, %v", event, err)
+	}
+	if _, err = RevokePrivilege("0xowner", fileId, "0xb", "sig4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SubtractValue("0xb", fileId, big.NewInt(1)); err != NoPermissionErr {
+		t.Errorf("expected the revoked user to be refused, got %v", err)
+	}
+	if _, err = RevokePrivilege("0xowner", fileId, "0xb", "sig5"); err != NoSuchPrivilegeErr {
+		t.Errorf("expected a second revoke to be refused, got %v", err)
+	}
+
+	if _, err = ListPrivilegeEvents("0xb", fileId); err != NoPermissionErr {
+		t.Errorf("expected a user without privilege to be refused, got %v", err)
+	}
+	events, err := ListPrivilegeEvents("0xowner", fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		user, action, signature string
+		privilege               Capability
+	}{{"0xa", PrivilegeInit, "", RoleReadonly}, {"0xb", PrivilegeGrant, "sig1", RoleWrite},
+		{"0xa", PrivilegeChange, "sig3", RoleReadwrite}, {"0xb", PrivilegeRevoke, "sig4", NoCapability}}
+	if len(events) != len(expected) {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	for i, e := range expected {
+		ev := events[i]
+		if ev.User != e.user || ev.Action != e.action || ev.Signature != e.signature || ev.Privilege != e.privilege || ev.Actor != "0xowner" {
+			t.Errorf("event %d: %+v, expected %+v", i, ev, e)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	for legacy, role := range map[int]Capability{Readwrite: RoleReadwrite, Readonly: RoleReadonly, Write: RoleWrite, 9: NoCapability} {
+		if c := LegacyCapability(legacy); c != role {
+			t.Errorf("legacy privilege %d: %s, expected %s", legacy, c, role)
+		}
+	}
+	for _, s := range []string{"none", "readwrite", "manager", "readOwn|charge", "readAll|terminate|manage"} {
+		c, err := ParseCapability(s)
+		if s == "none" {
+			if err == nil {
+				t.Errorf("expected none not to parse, got %s", c)
+			}
+			continue
+		}
+		if err != nil || c.String() != s {
+			t.Errorf("%q parsed as %s, %v", s, c, err)
+		}
+	}
+	if c, _ := ParseCapability("readOwn|readAll|charge"); c != RoleReadwrite {
+		t.Errorf("expected the capabilities of a role to parse as it, got %s", c)
+	}
+
+	fileId := "capabilityfile1"
+	err := InitFile("0xowner", fileId, "", &AllowTableT{"0xw": Write}, &MortgageTableT{"0xw": *big.NewInt(10), "0xr": *big.NewInt(5)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GrantPrivilege("0xowner", fileId, "0xm", RoleManager, &PrivilegeLimitsT{}, "sig1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GrantPrivilege("0xowner", fileId, "0xr", CapReadOwn, &PrivilegeLimitsT{}, "sig2"); err != nil {
+		t.Fatal(err)
+	}
+	// a manager hands out what it holds, and only takes away what it holds
+	if _, err = GrantPrivilege("0xm", fileId, "0xx", CapTerminate, &PrivilegeLimitsT{}, "sig3"); err != EscalationErr {
+		t.Errorf("expected a manager to be refused the terminate capability, got %v", err)
+	}
+	if _, err = RevokePrivilege("0xm", fileId, "0xw", "sig4"); err != EscalationErr {
+		t.Errorf("expected a manager to be refused revoking charge, got %v", err)
+	}
+	if _, err = GrantPrivilege("0xm", fileId, "0xx", RoleReadonly, &PrivilegeLimitsT{}, "sig5"); err != nil {
+		t.Errorf("expected a manager to grant readonly, got %v", err)
+	}
+	if _, err = GrantPrivilege("0xw", fileId, "0xx", RoleWrite, &PrivilegeLimitsT{}, "sig6"); err != NotOwnerErr {
+		t.Errorf("expected a user without manage to be refused, got %v", err)
+	}
+
+	if _, err = ReadValue("0xw", fileId, "0xw"); err != NoPermissionErr {
+		t.Errorf("expected a write-only user not to read its balance, got %v", err)
+	}
+	if balance, err := ReadValue("0xr", fileId, "0xr"); err != nil || balance.Int64() != 5 {
+		t.Errorf("expected readOwn to read the own balance, got %v, %v", balance, err)
+	}
+	if _, err = ReadValue("0xr", fileId, "0xw"); err != NoPermissionErr {
+		t.Errorf("expected readOwn not to read another balance, got %v", err)
+	}
+	if _, _, err = ListOperations("0xr", fileId, OperationFilterT{User: "0xr"}); err != nil {
+		t.Errorf("expected readOwn to list its own operations, got %v", err)
+	}
+	if _, err = Terminate("0xm", fileId); err != NotOwnerErr {
+		t.Errorf("expected a manager not to terminate, got %v", err)
+	}
+	// the owner holds every capability without a privilege row
+	if balance, err := ReadValue("0xowner", fileId, "0xw"); err != nil || balance.Int64() != 10 {
+		t.Errorf("expected the owner to read any balance, got %v, %v", balance, err)
+	}
+}
+
+func TestPrivilegeLimits(t *testing.T) {
+	fileId := "limitfile1"
+	err := InitFile("0xowner", fileId, "", &AllowTableT{}, &MortgageTableT{"0xc": *big.NewInt(100), "0xt": *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	if _, err = GrantPrivilege("0xowner", fileId, "0xc", RoleReadwrite, &PrivilegeLimitsT{ValidFrom: now, ValidUntil: now - 1}, "sig0"); err != InvalidLimitsErr {
+		t.Errorf("expected a window ending before it starts to be refused, got %v", err)
+	}
+	limits := &PrivilegeLimitsT{MaxAmount: big.NewInt(20), DailyCap: big.NewInt(30)}
+	if _, err = GrantPrivilege("0xowner", fileId, "0xc", RoleReadwrite, limits, "sig1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SubtractValue("0xc", fileId, big.NewInt(21)); err != AmountLimitErr {
+		t.Errorf("expected a subtract above the maximum to be refused, got %v", err)
+	}
+	if _, err = SubtractValue("0xc", fileId, big.NewInt(20)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SubtractValue("0xc", fileId, big.NewInt(11)); err != DailyCapErr {
+		t.Errorf("expected a subtract above the daily cap to be refused, got %v", err)
+	}
+	if _, err = SubtractValue("0xc", fileId, big.NewInt(10)); err != nil {
+		t.Errorf("expected a subtract up to the daily cap, got %v", err)
+	}
+	// the same privilege with other limits is a change
+	event, err := GrantPrivilege("0xowner", fileId, "0xc", RoleReadwrite, &PrivilegeLimitsT{}, "sig2")
+	if err != nil || event.Action != PrivilegeChange {
+		t.Errorf("unexpected change %+v, %v", event, err)
+	}
+
+	// a window in the past or the future grants nothing
+	for i, window := range []PrivilegeLimitsT{{ValidFrom: now - 100, ValidUntil: now - 10}, {ValidFrom: now + 10}} {
+		if _, err = GrantPrivilege("0xowner", fileId, "0xt", RoleReadwrite, &window, fmt.Sprintf("sig%d", 3+i)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ReadValue("0xt", fileId, "0xt"); err != NoPermissionErr {
+			t.Errorf("window %d: expected a read to be refused, got %v", i, err)
+		}
+		if _, err = SubtractValue("0xt", fileId, big.NewInt(1)); err != NoPermissionErr {
+			t.Errorf("window %d: expected a subtract to be refused, got %v", i, err)
+		}
+	}
+	if _, err = GrantPrivilege("0xowner", fileId, "0xt", RoleReadwrite, &PrivilegeLimitsT{ValidFrom: now - 10, ValidUntil: now + 10}, "sig5"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SubtractValue("0xt", fileId, big.NewInt(1)); err != nil {
+		t.Errorf("expected a subtract within the window, got %v", err)
+	}
+
+	participants, err := ListParticipants("0xowner", fileId)
+	if err != nil || len(participants) != 2 || participants[1].Limits.ValidUntil != now+10 {
+		t.Errorf("unexpected participants %+v, %v", participants, err)
+	}
+	events, err := ListPrivilegeEvents("0xowner", fileId)
+	if err != nil || len(events) != 5 || events[0].Limits.DailyCap.Int64() != 30 {
+		t.Errorf("unexpected events %+v, %v", events, err)
+	}
+}
+
+func TestConcurrentDailyCap(t *testing.T) {
+	fileId := "limitfile2"
+	err := InitFile("0xowner", fileId, "", &AllowTableT{"0xv": Readwrite},
+		&MortgageTableT{"0xc": *big.NewInt(100), "0xv": *big.NewInt(0)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GrantPrivilege("0xowner", fileId, "0xc", RoleReadwrite, &PrivilegeLimitsT{DailyCap: big.NewInt(30)}, "sig1"); err != nil {
+		t.Fatal(err)
+	}
+	// each charge passes the cap alone, ten of them reach it
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			SubtractValue("0xc", fileId, big.NewInt(3))
+		}()
+		go func() {
+			defer wg.Done()
+			Transfer("0xc", fileId, "0xv", big.NewInt(3), nil)
+		}()
+	}
+	wg.Wait()
+	balance, err := readValueDirect(fileId, "0xc")
+	if err != nil || balance.Int64() != 70 {
+		t.Errorf("expected the charges to stop at the daily cap, got %v, %v", balance, err)
+	}
+}
+
+func TestConcurrentCharges(t *testing.T) {
+	fileId := "overdraftfile1"
+	err := InitFile("0xowner", fileId, "", &AllowTableT{"0xc": Readwrite, "0xv": Readwrite},
+		&MortgageTableT{"0xc": *big.NewInt(10), "0xv": *big.NewInt(0)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each charge or hold fits in the balance alone, three of them do together
+	now := time.Now().Unix()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			SubtractValue("0xc", fileId, big.NewInt(3))
+		}()
+		go func() {
+			defer wg.Done()
+			Transfer("0xc", fileId, "0xv", big.NewInt(3), nil)
+		}()
+		go func() {
+			defer wg.Done()
+			Reserve("0xc", fileId, "0xp", big.NewInt(3), now+100)
+		}()
+	}
+	wg.Wait()
+	balance, err := readBalanceDirect(fileId, "0xc", now)
+	if err != nil || balance.Available.Int64() != 1 {
+		t.Errorf("expected the charges and holds to stop at the balance, got %+v, %v", balance, err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	defer SetPolicy(&DefaultPolicy)
+	for _, content := range []string{
+		"rules: [{effect: maybe}]",
+		"rules: [{effect: allow, actions: [fly]}]",
+		"rules: [{effect: allow, when: [tuesday]}]",
+		"rulez: []",
+	} {
+		if _, err := ParsePolicy([]byte(content)); !errors.Is(err, InvalidPolicyErr) {
+			t.Errorf("%s: expected an invalid policy, got %v", content, err)
+		}
+	}
+	p, err := ParsePolicy([]byte(`
+rules:
+  - name: privilege
+    effect: allow
+    when: [capability]
+  - name: ownersReadAll
+    effect: allow
+    actions: [readOwn, readAll]
+    when: [owner]
+  - name: participantsReadOwn
+    effect: allow
+    actions: [readOwn]
+    when: [participant]
+  - name: terminateAfterEnd
+    effect: allow
+    actions: [terminate]
+    when: [participant, afterEnd]
+  - name: noChargeAfterEnd
+    effect: deny
+    actions: [charge]
+    when: [afterEnd]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetPolicy(p)
+
+	now := time.Now().Unix()
+	fileId := "policyfile1"
+	err = InitFile("0xowner", fileId, "", &AllowTableT{"0xw": Readwrite}, &MortgageTableT{"0xw": *big.NewInt(10), "0xp": *big.NewInt(5)}, 0, now+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		user, action string
+		at           int64
+		allowed      bool
+		rule         string
+	}{
+		{"0xp", "readOwn", now, true, "participantsReadOwn"},
+		{"0xp", "readAll", now, false, ""},
+		{"0xp", "terminate", now, false, ""},
+		{"0xp", "terminate", now + 101, true, "terminateAfterEnd"},
+		{"0xx", "terminate", now + 101, false, ""},
+		{"0xw", "charge", now, true, "privilege"},
+		{"0xw", "charge", now + 101, false, "noChargeAfterEnd"},
+		{"0xowner", "readAll", now, true, "privilege"},
+	} {
+		_, decision, err := EvaluateRequest(c.user, fileId, c.action, c.at)
+		if err != nil || decision.Allowed != c.allowed || decision.Rule != c.rule {
+			t.Errorf("%s %s at %d: %+v, %v", c.user, c.action, c.at, decision, err)
+		}
+	}
+	if _, _, err = EvaluateRequest("0xp", fileId, "fly", now); !errors.Is(err, UnknownCapabilityErr) {
+		t.Errorf("expected an unknown action to be refused, got %v", err)
+	}
+	// the entry points follow the policy
+	if balance, err := ReadValue("0xp", fileId, "0xp"); err != nil || balance.Int64() != 5 {
+		t.Errorf("expected a participant to read its balance, got %v, %v", balance, err)
+	}
+	if _, err = ReadValue("0xp", fileId, "0xw"); err != NoPermissionErr {
+		t.Errorf("expected a participant not to read another balance, got %v", err)
+	}
+	if _, err = Terminate("0xp", fileId); err != NotOwnerErr {
+		t.Errorf("expected a participant not to terminate before the end, got %v", err)
+	}
+
+	SetPolicy(&PolicyT{})
+	if _, err = ReadValue("0xowner", fileId, "0xw"); err != NoPermissionErr {
+		t.Errorf("expected an empty policy to refuse everything, got %v", err)
+	}
+}
+
+func TestDelegations(t *testing.T) {
+	fileId := "delegationfile1"
+	err := InitFile("0xowner", fileId, "", &AllowTableT{"0xu": Readwrite, "0xr": Readonly},
+		&MortgageTableT{"0xu": *big.NewInt(100), "0xr": *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().Unix() + 60
+	if _, err = Delegate("0xr", fileId, "0xs", big.NewInt(10), until, "sig0"); err != NoPermissionErr {
+		t.Errorf("expected a user who cannot charge not to delegate, got %v", err)
+	}
+	for _, invalid := range []struct {
+		delegate string
+		limit    int64
+		until    int64
+	}{{"0xu", 10, until}, {"0xs", 0, until}, {"0xs", 10, until - 120}} {
+		if _, err = Delegate("0xu", fileId, invalid.delegate, big.NewInt(invalid.limit), invalid.until, "sig1"); err != InvalidDelegationErr {
+			t.Errorf("expected %+v to be refused, got %v", invalid, err)
+		}
+	}
+	if _, err = Delegate("0xu", fileId, "0xs", big.NewInt(30), until, "sig2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = SubtractAsDelegate("0xx", "0xu", fileId, big.NewInt(1), "", nil); err != NoDelegationErr {
+		t.Errorf("expected a key without delegation to be refused, got %v", err)
+	}
+	balance, delegation, err := SubtractAsDelegate("0xs", "0xu", fileId, big.NewInt(20), "", nil)
+	if err != nil || balance.Int64() != 80 || delegation.Remaining().Int64() != 10 {
+		t.Errorf("unexpected delegated subtract %v, %+v, %v", balance, delegation, err)
+	}
+	if _, _, err = SubtractAsDelegate("0xs", "0xu", fileId, big.NewInt(11), "", nil); err != DelegationCapErr {
+		t.Errorf("expected a subtract above the allowance to be refused, got %v", err)
+	}
+	// a failed subtract gives its allowance back
+	if _, err = RevokePrivilege("0xowner", fileId, "0xu", "sig3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = SubtractAsDelegate("0xs", "0xu", fileId, big.NewInt(10), "", nil); err != NoPermissionErr {
+		t.Errorf("expected the delegate to be bound by the privilege of the user, got %v", err)
+	}
+	delegations, err := ListDelegations("0xu", fileId)
+	if err != nil || len(delegations) != 1 || delegations[0].Spent.Int64() != 20 || delegations[0].Signature != "sig2" {
+		t.Errorf("unexpected delegations %+v, %v", delegations, err)
+	}
+
+	if err = RevokeDelegation("0xu", fileId, "0xs"); err != nil {
+		t.Fatal(err)
+	}
+	if err = RevokeDelegation("0xu", fileId, "0xs"); err != NoDelegationErr {
+		t.Errorf("expected a second revoke to find nothing, got %v", err)
+	}
+	if _, _, err = SubtractAsDelegate("0xs", "0xu", fileId, big.NewInt(1), "", nil); err != NoDelegationErr {
+		t.Errorf("expected a revoked delegate to be refused, got %v", err)
+	}
+}
+
+func TestAllowances(t *testing.T) {
+	fileId := "allowancefile1"
+	err := InitFile("0xowner", fileId, "", &AllowTableT{"0xu": Readwrite, "0xr": Readonly},
+		&MortgageTableT{"0xu": *big.NewInt(100), "0xr": *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Approve("0xr", fileId, "0xp", big.NewInt(10), "sig0"); err != NoPermissionErr {
+		t.Errorf("expected a user who cannot charge not to approve, got %v", err)
+	}
+	if _, err = Approve("0xu", fileId, "0xu", big.NewInt(10), "sig1"); err != InvalidAllowanceErr {
+		t.Errorf("expected an allowance to oneself to be refused, got %v", err)
+	}
+	if _, err = Approve("0xu", fileId, "0xp", big.NewInt(30), "sig2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ChargeAllowance("0xx", "0xu", fileId, big.NewInt(1), nil); err != AllowanceExceededErr {
+		t.Errorf("expected a spender without allowance to be refused, got %v", err)
+	}
+	balance, allowance, err := ChargeAllowance("0xp", "0xu", fileId, big.NewInt(25), nil)
+	if err != nil || balance.Int64() != 75 || allowance.Remaining.Int64() != 5 {
+		t.Errorf("unexpected charge %v, %+v, %v", balance, allowance, err)
+	}
+	if _, _, err = ChargeAllowance("0xp", "0xu", fileId, big.NewInt(6), nil); err != AllowanceExceededErr {
+		t.Errorf("expected a charge above the allowance to be refused, got %v", err)
+	}
+
+	// a charge the balance cannot cover gives its allowance back
+	if _, err = Approve("0xu", fileId, "0xp", big.NewInt(500), "sig3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ChargeAllowance("0xp", "0xu", fileId, big.NewInt(200), nil); err != InsufficientBalanceErr {
+		t.Errorf("expected a charge above the balance to be refused, got %v", err)
+	}
+	allowance, balance, err = GetAllowance("0xp", fileId, "0xu", "0xp")
+	if err != nil || allowance.Remaining.Int64() != 500 || balance.Int64() != 75 {
+		t.Errorf("unexpected allowance %+v, balance %v, %v", allowance, balance, err)
+	}
+	if _, _, err = GetAllowance("0xx", fileId, "0xu", "0xp"); err != NoPermissionErr {
+		t.Errorf("expected a third party not to read the allowance, got %v", err)
+	}
+	if _, _, err = GetAllowance("0xx", fileId, "0xu", "0xx"); err != NoPermissionErr {
+		t.Errorf("expected a spender without allowance not to read the balance, got %v", err)
+	}
+	if allowance, _, err = GetAllowance("0xr", fileId, "0xu", "0xp"); err != nil || allowance.Remaining.Int64() != 500 {
+		t.Errorf("expected readAll to read the allowance, got %+v, %v", allowance, err)
+	}
+
+	if _, err = Approve("0xu", fileId, "0xp", big.NewInt(0), "sig4"); err != nil {
+		t.Fatal(err)
+	}
+	if allowance, _, err = GetAllowance("0xu", fileId, "0xu", "0xp"); err != nil || allowance.Remaining.Sign() != 0 {
+		t.Errorf("expected an approve of zero to remove the allowance, got %+v, %v", allowance, err)
+	}
+	if _, _, err = GetAllowance("0xp", fileId, "0xu", "0xp"); err != NoPermissionErr {
+		t.Errorf("expected a removed allowance not to be read by its spender, got %v", err)
+	}
+}
+
+func TestEarnings(t *testing.T) {
+	fileId := "earningfile1"
+	err := InitFile("0xowner", fileId, "", &AllowTableT{"0xu": Readwrite, "0xv": Readwrite},
+		&MortgageTableT{"0xu": *big.NewInt(100), "0xv": *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SubtractValue("0xu", fileId, big.NewInt(10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SubtractValueTo("0xv", fileId, big.NewInt(20), "0xprovider", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SubtractValueTo("0xu", fileId, big.NewInt(5), "0xprovider", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Approve("0xv", fileId, "0xspender", big.NewInt(10), "sig0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ChargeAllowance("0xspender", "0xv", fileId, big.NewInt(7), nil); err != nil {
+		t.Fatal(err)
+	}
+	// a refused subtract credits nothing
+	if _, err = SubtractValueTo("0xu", fileId, big.NewInt(1000), "0xprovider", nil); err != InsufficientBalanceErr {
+		t.Errorf("expected a subtract above the balance to be refused, got %v", err)
+	}
+
+	earnings, err := Earnings(fileId)
+	expected := MortgageT{"0xowner": "0xa", "0xprovider": "0x19", "0xspender": "0x7"}
+	if err != nil || len(*earnings) != len(expected) {
+		t.Fatalf("unexpected earnings %v, %v", earnings, err)
+	}
+	for payee, earned := range expected {
+		if (*earnings)[payee] != earned {
+			t.Errorf("earnings of %s: %s, expected %s", payee, (*earnings)[payee], earned)
+		}
+	}
+	// the remaining balances are unaffected by who was credited
+	remain, err := RemainMortgage(fileId)
+	if err != nil || (*remain)["0xu"] != "0x55" || (*remain)["0xv"] != "0x49" {
+		t.Errorf("unexpected balances %v, %v", remain, err)
+	}
+	if own, err := ListEarnings("0xprovider", fileId); err != nil || len(*own) != 1 || (*own)["0xprovider"] != "0x19" {
+		t.Errorf("expected a payee to read only its earnings, got %v, %v", own, err)
+	}
+	if all, err := ListEarnings("0xowner", fileId); err != nil || len(*all) != 3 {
+		t.Errorf("expected the owner to read every earning, got %v, %v", all, err)
+	}
+}
+
+func TestTransfers(t *testing.T) {
+	fileId := "transferfile1"
+	err := InitFile("0xowner", fileId, "", &AllowTableT{"0xu": Readwrite, "0xv": Readwrite, "0xr": Readonly},
+		&MortgageTableT{"0xu": *big.NewInt(100), "0xv": *big.NewInt(50), "0xr": *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Transfer("0xr", fileId, "0xu", big.NewInt(10), nil); err != NoPermissionErr {
+		t.Errorf("expected a user who cannot charge not to transfer, got %v", err)
+	}
+	if _, err = Transfer("0xu", fileId, "0xu", big.NewInt(10), nil); err != InvalidTransferErr {
+		t.Errorf("expected a transfer to oneself to be refused, got %v", err)
+	}
+	if _, err = Transfer("0xu", fileId, "0xx", big.NewInt(10), nil); err != NoSuchParticipantErr {
+		t.Errorf("expected a transfer to a stranger to be refused, got %v", err)
+	}
+	if _, err = Transfer("0xu", fileId, "0xv", big.NewInt(-1), nil); err != NoNegativeValueAllowedErr {
+		t.Errorf("expected a negative transfer to be refused, got %v", err)
+	}
+	if _, err = Transfer("0xu", fileId, "0xv", big.NewInt(101), nil); err != InsufficientBalanceErr {
+		t.Errorf("expected a transfer above the balance to be refused, got %v", err)
+	}
+	balance, err := Transfer("0xu", fileId, "0xv", big.NewInt(30), nil)
+	if err != nil || balance.Int64() != 70 {
+		t.Fatalf("unexpected transfer %v, %v", balance, err)
+	}
+	// the recipient may pass it on, and a reader may receive
+	if _, err = Transfer("0xv", fileId, "0xr", big.NewInt(80), nil); err != nil {
+		t.Fatal(err)
+	}
+	remain, err := RemainMortgage(fileId)
+	if err != nil || (*remain)["0xu"] != "0x46" || (*remain)["0xv"] != "0x0" || (*remain)["0xr"] != "0xb4" {
+		t.Errorf("unexpected balances %v, %v", remain, err)
+	}
+	operations, _, err := ListOperations("0xowner", fileId, OperationFilterT{})
+	if err != nil || len(operations) != 7 || operations[3].Operation != "transferOut" || operations[4].Operation != "transferIn" ||
+		operations[4].User != "0xv" || operations[4].Value != "0x1e" {
+		t.Errorf("expected paired transfer operations, got %+v, %v", operations, err)
+	}
+	// transfers are not earnings
+	if earnings, err := Earnings(fileId); err != nil || len(*earnings) != 0 {
+		t.Errorf("unexpected earnings %v, %v", earnings, err)
+	}
+
+	// the transfer of 30 above and subtracts count against the daily cap
+	if _, err = GrantPrivilege("0xowner", fileId, "0xu", RoleReadwrite, &PrivilegeLimitsT{DailyCap: big.NewInt(70)}, "sig0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SubtractValue("0xu", fileId, big.NewInt(25)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Transfer("0xu", fileId, "0xv", big.NewInt(16), nil); err != DailyCapErr {
+		t.Errorf("expected a transfer above the daily cap to be refused, got %v", err)
+	}
+	if _, err = Transfer("0xu", fileId, "0xv", big.NewInt(15), nil); err != nil {
+		t.Errorf("expected a transfer up to the daily cap, got %v", err)
+	}
+}
+
+func TestDeposits(t *testing.T) {
+	fileId := "depositfile1"
+	err := InitFile("0xowner", fileId, "", &AllowTableT{"0xu": Readwrite}, &MortgageTableT{"0xu": *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SubtractValue("0xn", fileId, big.NewInt(1)); err != NoPermissionErr {
+		t.Errorf("expected a user outside the file not to subtract, got %v", err)
+	}
+	deposit := &DepositT{TxHash: "0xtx1", FileId: fileId, From: "0xowner", BlockNumber: "0x10"}
+	err = Deposit(deposit, &MortgageTableT{"0xu": *big.NewInt(20), "0xn": *big.NewInt(30)},
+		&AllowTableT{"0xu": Readonly, "0xn": Readwrite})
+	if err != nil || deposit.Value.Int64() != 50 {
+		t.Fatalf("unexpected deposit %+v, %v", deposit, err)
+	}
+	// the deposit added 0xn and left the privilege of 0xu alone
+	if _, err = SubtractValue("0xn", fileId, big.NewInt(5)); err != nil {
+		t.Errorf("expected an added participant to subtract, got %v", err)
+	}
+	if _, err = SubtractValue("0xu", fileId, big.NewInt(5)); err != nil {
+		t.Errorf("expected a deposit not to change an existing privilege, got %v", err)
+	}
+	events, err := ListPrivilegeEvents("0xowner", fileId)
+	if err != nil || len(events) != 2 || events[1].Action != PrivilegeDeposit || events[1].User != "0xn" || events[1].Signature != "0xtx1" {
+		t.Errorf("unexpected privilege events %+v, %v", events, err)
+	}
+
+	// a transaction is deposited once
+	err = Deposit(&DepositT{TxHash: "0xtx1", FileId: fileId, From: "0xowner"}, &MortgageTableT{"0xu": *big.NewInt(20)}, nil)
+	if err != DepositExistsErr {
+		t.Errorf("expected a deposit to be applied once, got %v", err)
+	}
+	// anyone may top up, only the owner may add participants
+	err = Deposit(&DepositT{TxHash: "0xtx2", FileId: fileId, From: "0xu"}, &MortgageTableT{"0xm": *big.NewInt(1)}, &AllowTableT{"0xm": Readwrite})
+	if err != NotOwnerErr {
+		t.Errorf("expected a user not to add participants, got %v", err)
+	}
+	// the owner is recognised whatever the case of its address
+	err = Deposit(&DepositT{TxHash: "0xtx2", FileId: fileId, From: "0xOWNER"}, &MortgageTableT{"0xm": *big.NewInt(-1)}, &AllowTableT{"0xm": Readwrite})
+	if err != NoNegativeValueAllowedErr {
+		t.Errorf("expected the owner to pass the owner check, got %v", err)
+	}
+	err = Deposit(&DepositT{TxHash: "0xtx3", FileId: fileId, From: "0xu"}, &MortgageTableT{"0xu": *big.NewInt(-1)}, nil)
+	if err != NoNegativeValueAllowedErr {
+		t.Errorf("expected a negative deposit to be refused, got %v", err)
+	}
+	if err = Deposit(&DepositT{TxHash: "0xtx4", FileId: fileId, From: "0xu"}, &MortgageTableT{"0xu": *big.NewInt(10)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	remain, err := RemainMortgage(fileId)
+	if err != nil || (*remain)["0xu"] != "0x7d" || (*remain)["0xn"] != "0x19" {
+		t.Errorf("unexpected balances %v, %v", remain, err)
+	}
+	// the init mortgage is what the file was created with
+	initMortgage, err := InitMortgage(fileId)
+	if err != nil || len(*initMortgage) != 1 {
+		t.Errorf("unexpected init mortgage %v, %v", initMortgage, err)
+	}
+	deposits, err := ListDeposits(fileId)
+	if err != nil || len(deposits) != 2 || deposits[0].TxHash != "0xtx1" || deposits[1].Value.Int64() != 10 {
+		t.Errorf("unexpected deposits %+v, %v", deposits, err)
+	}
+
+	if err = setFileTerminate(fileId); err != nil {
+		t.Fatal(err)
+	}
+	err = Deposit(&DepositT{TxHash: "0xtx5", FileId: fileId, From: "0xu"}, &MortgageTableT{"0xu": *big.NewInt(10)}, nil)
+	if err != FileClosedErr {
+		t.Errorf("expected a deposit to a closed file to be refused, got %v", err)
+	}
+}
+
+func TestHolds(t *testing.T) {
+	fileId := "holdfile1"
+	err := InitFile("0xowner", fileId, "", &AllowTableT{"0xu": Readwrite, "0xr": Readonly},
+		&MortgageTableT{"0xu": *big.NewInt(100), "0xr": *big.NewInt(10)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	if _, err = Reserve("0xr", fileId, "0xp", big.NewInt(5), now+100); err != NoPermissionErr {
+		t.Errorf("expected a user who cannot charge not to reserve, got %v", err)
+	}
+	if _, err = Reserve("0xu", fileId, "0xp", big.NewInt(5), now-1); err != InvalidHoldErr {
+		t.Errorf("expected an expired hold to be refused, got %v", err)
+	}
+	hold, err := Reserve("0xu", fileId, "0xp", big.NewInt(60), now+100)
+	if err != nil || hold.Status != HoldActive {
+		t.Fatalf("unexpected hold %+v, %v", hold, err)
+	}
+	balance, err := ReadBalance("0xu", fileId, "0xu")
+	if err != nil || balance.Balance.Int64() != 100 || balance.Held.Int64() != 60 || balance.Available.Int64() != 40 {
+		t.Errorf("unexpected balance %+v, %v", balance, err)
+	}
+	// what is held is not available to subtracts, transfers and other holds
+	if _, err = SubtractValue("0xu", fileId, big.NewInt(41)); err != InsufficientBalanceErr {
+		t.Errorf("expected a subtract of held value to be refused, got %v", err)
+	}
+	if _, err = Transfer("0xu", fileId, "0xr", big.NewInt(41), nil); err != InsufficientBalanceErr {
+		t.Errorf("expected a transfer of held value to be refused, got %v", err)
+	}
+	if _, err = Reserve("0xu", fileId, "0xq", big.NewInt(41), now+100); err != InsufficientBalanceErr {
+		t.Errorf("expected a hold of held value to be refused, got %v", err)
+	}
+	participants, err := ListParticipants("0xr", fileId)
+	if err != nil || len(participants) != 2 || participants[1].User != "0xu" || participants[1].Held.Int64() != 60 {
+		t.Errorf("unexpected participants %+v, %v", participants, err)
+	}
+
+	if _, _, err = Capture("0xx", fileId, hold.Id, big.NewInt(1), nil); err != NoSuchHoldErr {
+		t.Errorf("expected a stranger not to capture, got %v", err)
+	}
+	if _, _, err = Capture("0xp", fileId, hold.Id, big.NewInt(61), nil); err != HoldExceededErr {
+		t.Errorf("expected a capture above the hold to be refused, got %v", err)
+	}
+	captured, bal, err := Capture("0xp", fileId, hold.Id, big.NewInt(25), nil)
+	if err != nil || captured.Status != HoldCaptured || captured.Captured.Int64() != 25 || bal.Int64() != 75 {
+		t.Fatalf("unexpected capture %+v, %v, %v", captured, bal, err)
+	}
+	if _, _, err = Capture("0xp", fileId, hold.Id, big.NewInt(1), nil); err != HoldNotActiveErr {
+		t.Errorf("expected a hold to be captured once, got %v", err)
+	}
+	if balance, err = ReadBalance("0xr", fileId, "0xu"); err != nil || balance.Held.Sign() != 0 || balance.Available.Int64() != 75 {
+		t.Errorf("expected the rest of the hold to be released, got %+v, %v", balance, err)
+	}
+	if earnings, err := Earnings(fileId); err != nil || (*earnings)["0xp"] != "0x19" {
+		t.Errorf("expected the payee to earn the capture, got %v, %v", earnings, err)
+	}
+
+	hold, err = Reserve("0xu", fileId, "0xp", big.NewInt(10), now+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the user cannot void a hold before its payee captures it
+	if _, err = Release("0xu", fileId, hold.Id); err != NoPermissionErr {
+		t.Errorf("expected the user not to release its hold, got %v", err)
+	}
+	if released, err := Release("0xp", fileId, hold.Id); err != nil || released.Status != HoldReleased || nil != released.Captured {
+		t.Errorf("unexpected release %+v, %v", released, err)
+	}
+	if _, err = Release("0xp", fileId, hold.Id); err != HoldNotActiveErr {
+		t.Errorf("expected a released hold to stay released, got %v", err)
+	}
+
+	// a hold is not captured once the user may no longer charge
+	hold, err = Reserve("0xu", fileId, "0xp", big.NewInt(10), now+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = RevokePrivilege("0xowner", fileId, "0xu", "sig1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = Capture("0xp", fileId, hold.Id, big.NewInt(10), nil); err != NoPermissionErr {
+		t.Errorf("expected a hold of a revoked user not to be captured, got %v", err)
+	}
+	if _, err = Release("0xp", fileId, hold.Id); err != nil {
+		t.Errorf("expected a hold of a revoked user to be released, got %v", err)
+	}
+	if _, err = GrantPrivilege("0xowner", fileId, "0xu", RoleReadwrite, &PrivilegeLimitsT{}, "sig2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a hold stops reserving once its validity ends, before the worker expires it
+	hold, err = Reserve("0xu", fileId, "0xp", big.NewInt(10), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance, err = readBalanceDirect(fileId, "0xu", now+1); err != nil || balance.Held.Sign() != 0 {
+		t.Errorf("expected a stale hold to reserve nothing, got %+v, %v", balance, err)
+	}
+	if expired, err := ExpireHolds(now + 1); err != nil || expired != 1 {
+		t.Errorf("expected one hold to expire, got %d, %v", expired, err)
+	}
+	if _, _, err = Capture("0xp", fileId, hold.Id, big.NewInt(1), nil); err != HoldNotActiveErr {
+		t.Errorf("expected an expired hold not to be captured, got %v", err)
+	}
+}
+
+func TestReversals(t *testing.T) {
+	fileId := "reversalfile1"
+	err := InitFile("0xowner", fileId, "", &AllowTableT{"0xu": Readwrite},
+		&MortgageTableT{"0xu": *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SubtractValueTo("0xu", fileId, big.NewInt(30), "0xp", nil); err != nil {
+		t.Fatal(err)
+	}
+	operations, _, err := ListOperations("0xowner", fileId, OperationFilterT{})
+	if err != nil || len(operations) != 2 || operations[1].Operation != "subtract" {
+		t.Fatalf("unexpected operations %+v, %v", operations, err)
+	}
+	subtract := operations[1].Id
+	if _, err = Reverse("0xu", fileId, subtract, big.NewInt(30), "", nil); err != NotOwnerErr {
+		t.Errorf("expected a user not to reverse its own subtract, got %v", err)
+	}
+	if _, err = GrantPrivilege("0xowner", fileId, "0xm", RoleManager, &PrivilegeLimitsT{}, "sig1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Reverse("0xm", fileId, subtract, big.NewInt(30), "", nil); err != NotOwnerErr {
+		t.Errorf("expected a manager not to reverse, got %v", err)
+	}
+	if _, err = GrantPrivilege("0xowner", fileId, "0xr", CapRefund, &PrivilegeLimitsT{}, "sig2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Reverse("0xr", fileId, subtract, big.NewInt(1), "", nil); err != nil {
+		t.Errorf("expected a user granted refund to reverse, got %v", err)
+	}
+	if _, err = Reverse("0xowner", fileId, operations[0].Id, big.NewInt(1), "", nil); err != NoSuchSubtractErr {
+		t.Errorf("expected only subtracts to be reversed, got %v", err)
+	}
+	if _, err = Reverse("0xowner", fileId, subtract, big.NewInt(30), "", nil); err != ReversalExceededErr {
+		t.Errorf("expected a reversal above the subtract to be refused, got %v", err)
+	}
+	reversal, err := Reverse("0xowner", fileId, subtract, big.NewInt(19), "charged twice", nil)
+	if err != nil || reversal.User != "0xu" || reversal.Payee != "0xp" || reversal.ReversalId <= subtract {
+		t.Fatalf("unexpected reversal %+v, %v", reversal, err)
+	}
+	// what was reversed before counts against the subtract
+	if _, err = Reverse("0xowner", fileId, subtract, big.NewInt(11), "", nil); err != ReversalExceededErr {
+		t.Errorf("expected reversals above the subtract to be refused, got %v", err)
+	}
+	if balance, err := ReadValue("0xu", fileId, "0xu"); err != nil || balance.Int64() != 90 {
+		t.Errorf("expected the reversal to be credited back, got %v, %v", balance, err)
+	}
+	if earnings, err := Earnings(fileId); err != nil || (*earnings)["0xp"] != "0xa" {
+		t.Errorf("expected the reversal to be taken from the payee, got %v, %v", earnings, err)
+	}
+	operations, _, err = ListOperations("0xowner", fileId, OperationFilterT{})
+	if err != nil || len(operations) != 4 || operations[3].Operation != "reversal" || operations[3].Reverses != subtract {
+		t.Errorf("expected the reversal in the history, got %+v, %v", operations, err)
+	}
+
+	if err = setFileTerminate(fileId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Reverse("0xowner", fileId, subtract, big.NewInt(10), "", nil); err != FileClosedErr {
+		t.Errorf("expected the subtracts of closed files not to be reversed, got %v", err)
+	}
+}
+
+func TestOperationMeta(t *testing.T) {
+	fileId := "metafile1"
+	err := InitFile("0xowner", fileId, "", &AllowTableT{"0xu": Readwrite, "0xv": Readwrite},
+		&MortgageTableT{"0xu": *big.NewInt(100), "0xv": *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := &OperationMetaT{Reference: "invoice-1", Memo: "march", Request: `{"method":"subtract"}`, Signer: "0xu", RequestId: "7"}
+	if _, err = SubtractValueTo("0xu", fileId, big.NewInt(10), "", meta); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Transfer("0xu", fileId, "0xv", big.NewInt(5), &OperationMetaT{Reference: "invoice-2", Signer: "0xu"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SubtractValue("0xv", fileId, big.NewInt(1)); err != nil {
+		t.Fatal(err)
+	}
+	long := &OperationMetaT{Memo: strings.Repeat("m", maxMemoLength+1)}
+	if _, err = SubtractValueTo("0xu", fileId, big.NewInt(1), "", long); err != InvalidMetadataErr {
+		t.Errorf("expected a memo too long to be refused, got %v", err)
+	}
+
+	operations, _, err := ListOperations("0xowner", fileId, OperationFilterT{})
+	if err != nil || len(operations) != 6 {
+		t.Fatalf("unexpected operations %+v, %v", operations, err)
+	}
+	if operations[0].Meta != nil || operations[5].Meta != nil {
+		t.Errorf("expected no meta for operations made without, got %+v, %+v", operations[0].Meta, operations[5].Meta)
+	}
+	if got := operations[2].Meta; nil == got || *got != *meta {
+		t.Errorf("unexpected meta of the subtract %+v", got)
+	}
+	// both sides of a transfer carry its meta
+	for _, operation := range operations[3:5] {
+		if nil == operation.Meta || operation.Meta.Reference != "invoice-2" {
+			t.Errorf("unexpected meta of %s: %+v", operation.Operation, operation.Meta)
+		}
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	if _, _, err := BeginIdempotent("0xu", "keyfile1", "", "0x01"); err != InvalidIdempotencyKeyErr {
+		t.Errorf("expected an empty key to be refused, got %v", err)
+	}
+	if result, _, err := BeginIdempotent("0xu", "keyfile1", "k1", "0x01"); err != nil || "" != result {
+		t.Fatalf("expected a free key to be claimed, got %q, %v", result, err)
+	}
+	if _, _, err := BeginIdempotent("0xu", "keyfile1", "k1", "0x01"); err != IdempotencyKeyPendingErr {
+		t.Errorf("expected a retry before completion to be refused, got %v", err)
+	}
+	if _, _, err := BeginIdempotent("0xu", "keyfile1", "k1", "0x02"); err != IdempotencyKeyReusedErr {
+		t.Errorf("expected another request with the key to be refused, got %v", err)
+	}
+	// keys are scoped to the signer and the file
+	if result, _, err := BeginIdempotent("0xv", "keyfile1", "k1", "0x02"); err != nil || "" != result {
+		t.Errorf("expected the key of another signer to be free, got %q, %v", result, err)
+	}
+	if result, _, err := BeginIdempotent("0xu", "keyfile2", "k1", "0x02"); err != nil || "" != result {
+		t.Errorf("expected the key in another file to be free, got %q, %v", result, err)
+	}
+	if err := CompleteIdempotent("0xu", "keyfile1", "k1", `"0x5a"`); err != nil {
+		t.Fatal(err)
+	}
+	if result, _, err := BeginIdempotent("0xu", "keyfile1", "k1", "0x01"); err != nil || `"0x5a"` != result {
+		t.Errorf("expected a retry to get the result, got %q, %v", result, err)
+	}
+	if err := FailIdempotent("0xu", "keyfile2", "k1", `{"code":-32003}`); err != nil {
+		t.Fatal(err)
+	}
+	if result, failure, err := BeginIdempotent("0xu", "keyfile2", "k1", "0x02"); err != nil || "" != result || `{"code":-32003}` != failure {
+		t.Errorf("expected a retry to get the failure, got %q, %q, %v", result, failure, err)
+	}
+	if err := ForgetIdempotent("0xv", "keyfile1", "k1"); err != nil {
+		t.Fatal(err)
+	}
+	if result, _, err := BeginIdempotent("0xv", "keyfile1", "k1", "0x03"); err != nil || "" != result {
+		t.Errorf("expected a forgotten key to be free, got %q, %v", result, err)
+	}
+	if pruned, err := PruneIdempotencyKeys(time.Now().Unix() + 1); err != nil || pruned < 3 {
+		t.Errorf("expected the keys to be pruned, got %d, %v", pruned, err)
+	}
+	if result, _, err := BeginIdempotent("0xu", "keyfile1", "k1", "0x02"); err != nil || "" != result {
+		t.Errorf("expected a pruned key to be free, got %q, %v", result, err)
+	}
+}
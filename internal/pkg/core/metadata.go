@@ -0,0 +1,31 @@
+package core
+
+import (
+	"errors"
+)
+
+// limits of what clients attach to their operations
+const (
+	maxReferenceLength = 128
+	maxMemoLength      = 1024
+)
+
+var InvalidMetadataErr = errors.New("reference or memo too long")
+
+// OperationMetaT is what is known of the request an operation was made by: the reference
+// and memo the client gave it, and the raw signed request with its signer and json-rpc id.
+type OperationMetaT struct {
+	Reference string
+	Memo      string
+	Request   string
+	Signer    string
+	RequestId string
+}
+
+// checkMeta reports whether meta, which may be nil, can be recorded.
+func checkMeta(meta *OperationMetaT) error {
+	if nil != meta && (len(meta.Reference) > maxReferenceLength || len(meta.Memo) > maxMemoLength) {
+		return InvalidMetadataErr
+	}
+	return nil
+}
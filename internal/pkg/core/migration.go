@@ -0,0 +1,342 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var SchemaMismatchErr = errors.New("database schema mismatch")
+
+// dbExecutor is implemented by both *sql.DB and *sql.Tx.
+type dbExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// migrations[i] upgrades the schema from version i to version i+1. Each step must also
+// work on ledgers created before schema versions existed, which already have part of it.
+var migrations = []func(tx dbExecutor) error{
+	// 1: base tables
+	func(tx dbExecutor) error {
+		fileIndexSql := `create table if not exists fileIndex
+		                 (fileId text not null primary key,
+		                 owner text not null,
+		                 isopen INTEGER DEFAULT 1,
+		                 originjson text,
+		                 state text,
+		                 createTime int not null);`
+
+		privilegeSql := `create table if not exists privilege
+						 (fileId text not null,
+						 user text not null,
+					  	 privilege INTEGER not null,
+					  	 createTime int not null);`
+
+		settlementSql := `create table if not exists settlement
+						  (fileId text not null,
+						  txHash text not null,
+						  terminate INTEGER not null,
+						  createTime int not null);`
+		return execAll(tx, fileIndexSql, privilegeSql, settlementSql)
+	},
+	// 2: chunked settlements
+	func(tx dbExecutor) error {
+		return addColumnsIfMissing(tx, "settlement", [][2]string{
+			{"chunk", "INTEGER DEFAULT 0"},
+			{"chunkCount", "INTEGER DEFAULT 1"},
+			{"status", "text DEFAULT 'pending'"},
+		})
+	},
+	// 3: file window and ingestion progress
+	func(tx dbExecutor) error {
+		err := addColumnsIfMissing(tx, "fileIndex", [][2]string{
+			{"startTime", "int DEFAULT 0"},
+			{"endTime", "int DEFAULT 0"},
+		})
+		if err != nil {
+			return err
+		}
+		return execAll(tx, `create table if not exists syncState (name text not null primary key, value text);`)
+	},
+	// 4: accepted signed requests
+	func(tx dbExecutor) error {
+		return execAll(tx, `create table if not exists seenRequest
+							(requestKey text not null primary key,
+							signer text not null,
+							expiry int not null,
+							createTime int not null);`)
+	},
+	// 5: audit log of privilege changes
+	func(tx dbExecutor) error {
+		return execAll(tx, `create table if not exists privilegeEvent
+							(fileId text not null,
+							user text not null,
+							action text not null,
+							privilege INTEGER not null,
+							previous INTEGER not null,
+							actor text not null,
+							signature text,
+							createTime int not null);`)
+	},
+	// 6: privileges become capability sets, see LegacyCapability
+	func(tx dbExecutor) error {
+		legacy := func(column string) string {
+			return fmt.Sprintf("case %s when %d then %d when %d then %d when %d then %d else %d end", column,
+				Readwrite, RoleReadwrite, Readonly, RoleReadonly, Write, RoleWrite, NoCapability)
+		}
+		return execAll(tx,
+			"update privilege set privilege = "+legacy("privilege"),
+			"update privilegeEvent set privilege = "+legacy("privilege")+", previous = "+legacy("previous"))
+	},
+	// 7: validity window and amount limits of privileges
+	func(tx dbExecutor) error {
+		limits := [][2]string{
+			{"validFrom", "int DEFAULT 0"},
+			{"validUntil", "int DEFAULT 0"},
+			{"maxAmount", "text"},
+			{"dailyCap", "text"},
+		}
+		err := addColumnsIfMissing(tx, "privilege", limits)
+		if err != nil {
+			return err
+		}
+		return addColumnsIfMissing(tx, "privilegeEvent", limits)
+	},
+	// 8: session keys charging on behalf of users
+	func(tx dbExecutor) error {
+		return execAll(tx, `create table if not exists delegation
+							(fileId text not null,
+							user text not null,
+							delegate text not null,
+							cap text not null,
+							spent text not null,
+							validUntil int not null,
+							signature text,
+							createTime int not null,
+							primary key (fileId, user, delegate));`)
+	},
+	// 9: allowances letting a spender charge a participant
+	func(tx dbExecutor) error {
+		return execAll(tx, `create table if not exists allowance
+							(fileId text not null,
+							user text not null,
+							spender text not null,
+							remaining text not null,
+							signature text,
+							updateTime int not null,
+							primary key (fileId, user, spender));`)
+	},
+	// 10: what subtracts credited to their payees
+	func(tx dbExecutor) error {
+		return execAll(tx, `create table if not exists earning
+							(fileId text not null,
+							payee text not null,
+							payer text not null,
+							value text not null,
+							createTime int not null);`)
+	},
+	// 11: top-ups of open files, once per chain transaction
+	func(tx dbExecutor) error {
+		return execAll(tx, `create table if not exists deposit
+							(txHash text primary key,
+							fileId text not null,
+							fromAccount text not null,
+							value text not null,
+							blockNumber text,
+							createTime int not null);`)
+	},
+	// 12: amounts reserved on balances until captured, released or expired
+	func(tx dbExecutor) error {
+		return execAll(tx, `create table if not exists hold
+							(id integer primary key autoincrement,
+							fileId text not null,
+							user text not null,
+							payee text not null,
+							amount text not null,
+							captured text,
+							status text not null,
+							validUntil int not null,
+							createTime int not null,
+							updateTime int not null);`)
+	},
+	// 13: reversals of subtracts, which earnings now name
+	func(tx dbExecutor) error {
+		err := addColumnsIfMissing(tx, "earning", [][2]string{{"operationId", "int"}})
+		if err != nil {
+			return err
+		}
+		err = linkEarnings(tx)
+		if err != nil {
+			return err
+		}
+		return execAll(tx, `create table if not exists reversal
+							(fileId text not null,
+							operationId int not null,
+							reversalId int not null,
+							user text not null,
+							payee text not null,
+							value text not null,
+							actor text not null,
+							reason text,
+							createTime int not null);`)
+	},
+	// 14: what is known of the requests operations were made by
+	func(tx dbExecutor) error {
+		return execAll(tx, `create table if not exists operationMeta
+							(fileId text not null,
+							operationId int not null,
+							reference text,
+							memo text,
+							request text,
+							signer text,
+							requestId text,
+							createTime int not null,
+							primary key (fileId, operationId));`,
+			`create index if not exists operationMetaReference on operationMeta (fileId, reference);`)
+	},
+	// 15: results of the requests made under idempotency keys
+	func(tx dbExecutor) error {
+		return execAll(tx, `create table if not exists idempotencyKey
+							(signer text not null,
+							fileId text not null,
+							key text not null,
+							payload text not null,
+							result text,
+							createTime int not null,
+							primary key (signer, fileId, key));`)
+	},
+	// 16: rejections of the requests made under idempotency keys
+	func(tx dbExecutor) error {
+		return addColumnsIfMissing(tx, "idempotencyKey", [][2]string{
+			{"failure", "text"},
+		})
+	},
+}
+
+// SchemaVersion returns the schema version of the open ledger.
+func SchemaVersion() (int, error) {
+	var version int
+	err := dbConn.QueryRow("pragma user_version").Scan(&version)
+	return version, err
+}
+
+// MigrateDatabase opens the ledger in dir whatever its schema version and upgrades it
+// to the current one, one transaction per step. It returns the versions it went from
+// and to.
+func MigrateDatabase(dir string) (int, int, error) {
+	err := openConnection(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	return migrate()
+}
+
+func migrate() (int, int, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	from, err := SchemaVersion()
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > len(migrations) {
+		return from, from, fmt.Errorf("%s: version %d is newer than this kdc (%d)", SchemaMismatchErr, from, len(migrations))
+	}
+	for version := from; version < len(migrations); version++ {
+		tx, err := dbConn.Begin()
+		if err != nil {
+			return from, version, err
+		}
+		err = migrations[version](tx)
+		if err == nil {
+			// pragma does not take parameters
+			_, err = tx.Exec(fmt.Sprintf("pragma user_version = %d", version+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			dbLog.Errorf("migration to version %d failed: %s", version+1, err)
+			return from, version, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return from, version, err
+		}
+		dbLog.Infof("database migrated to version %d", version+1)
+	}
+	return from, len(migrations), nil
+}
+
+func execAll(tx dbExecutor, statements ...string) error {
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			dbLog.Errorf("%q: %s\n", err, statement)
+			return err
+		}
+	}
+	return nil
+}
+
+// linkEarnings names the subtract of each earning written before earnings named it,
+// which was written with the same payer, value and time.
+func linkEarnings(tx dbExecutor) error {
+	rows, err := tx.Query("select distinct fileId from earning where operationId is null")
+	if err != nil {
+		return err
+	}
+	var fileIds []string
+	for rows.Next() {
+		var fileId string
+		err = rows.Scan(&fileId)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		fileIds = append(fileIds, fileId)
+	}
+	rows.Close()
+	for _, fileId := range fileIds {
+		_, err = tx.Exec(fmt.Sprintf(`update earning set operationId = (select m.rowid from %s m where m.userId = earning.payer
+			and m.opration = 'subtract' and m.value = earning.value and m.createTime = earning.createTime order by m.rowid limit 1)
+			where fileId = ? and operationId is null`, getModificationTableName(fileId)), fileId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addColumnsIfMissing(tx dbExecutor, table string, columns [][2]string) error {
+	rows, err := tx.Query(fmt.Sprintf("pragma table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		err = rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	for _, column := range columns {
+		if existing[column[0]] {
+			continue
+		}
+		_, err = tx.Exec(fmt.Sprintf("alter table %s add column %s %s", table, column[0], column[1]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LatestSchemaVersion returns the schema version this kdc migrates ledgers to.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
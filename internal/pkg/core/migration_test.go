@@ -0,0 +1,71 @@
+package core
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateDatabase(t *testing.T) {
+	savedConn, savedHome := dbConn, dbHome
+	defer func() { dbConn, dbHome = savedConn, savedHome }()
+
+	dir, err := ioutil.TempDir("", "kdc-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// ledger created before schema versions existed
+	legacy, err := sql.Open("sqlite3", filepath.Join(dir, "own.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Exec(`create table fileIndex (fileId text not null primary key, owner text not null,
+		isopen INTEGER DEFAULT 1, originjson text, state text, createTime int not null);
+		create table settlement (fileId text not null, txHash text not null, terminate INTEGER not null,
+		createTime int not null);
+		create table privilege (fileId text not null, user text not null, privilege INTEGER not null,
+		createTime int not null);
+		insert into fileIndex (fileId, owner, createTime) values ('legacy', '0x01', 1);
+		insert into privilege (fileId, user, privilege, createTime) values ('legacy', '0x02', 0, 1), ('legacy', '0x03', 2, 1);`)
+	legacy.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = OpenDatabase(dir)
+	if err == nil || !strings.Contains(err.Error(), SchemaMismatchErr.Error()) {
+		t.Fatalf("expected schema mismatch, got %v", err)
+	}
+	from, to, err := MigrateDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 0 || to != LatestSchemaVersion() {
+		t.Errorf("migrated from %d to %d", from, to)
+	}
+	err = OpenDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := GetFileInfo("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Owner != "0x01" || info.EndTime != 0 {
+		t.Errorf("unexpected file after migration: %+v", info)
+	}
+	// legacy privileges become their roles
+	for user, role := range map[string]Capability{"0x02": RoleReadwrite, "0x03": RoleWrite} {
+		if privilege, _, _ := getPermissionForFile(user, "legacy"); privilege != role {
+			t.Errorf("privilege of %s after migration: %s, expected %s", user, privilege, role)
+		}
+	}
+	from, to, err = MigrateDatabase(dir)
+	if err != nil || from != to {
+		t.Errorf("second migration: %d to %d, %v", from, to, err)
+	}
+}
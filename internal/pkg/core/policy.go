@@ -0,0 +1,262 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+var InvalidPolicyErr = errors.New("invalid policy")
+
+// PolicyRuleT allows or denies actions to the users it applies to when all its
+// conditions hold. Actions are capability names.
+type PolicyRuleT struct {
+	Name   string `yaml:"name"`
+	Effect string `yaml:"effect"`
+	// every action when empty
+	Actions []string `yaml:"actions"`
+	// every user when empty
+	Users []string `yaml:"users"`
+	// conditions, see policyConditions, "!" negating one
+	When []string `yaml:"when"`
+}
+
+// PolicyT decides which requests the core entry points accept. A request is accepted
+// when an allow rule applies to it and no deny rule does.
+type PolicyT struct {
+	Rules []PolicyRuleT `yaml:"rules"`
+}
+
+// RequestContextT is what policy rules are evaluated against.
+type RequestContextT struct {
+	User   string
+	FileId string
+	// capability name
+	Action string
+	Now    int64
+	// the file is known to the ledger
+	Known bool
+	Owner bool
+	// the user has a privilege or a balance in the file
+	Participant bool
+	// capabilities granted by the privilege of the user, within its window
+	Capabilities Capability
+	Open         bool
+	EndTime      int64
+}
+
+// DecisionT is the outcome of a policy for a request, with the rule that decided it.
+type DecisionT struct {
+	Allowed bool
+	// empty when no rule applies
+	Rule string
+}
+
+var policyConditions = map[string]func(ctx *RequestContextT, action Capability) bool{
+	// the privilege of the user grants the action
+	"capability":  func(ctx *RequestContextT, action Capability) bool { return ctx.Capabilities.Has(action) },
+	"owner":       func(ctx *RequestContextT, action Capability) bool { return ctx.Owner },
+	"participant": func(ctx *RequestContextT, action Capability) bool { return ctx.Participant },
+	"open":        func(ctx *RequestContextT, action Capability) bool { return ctx.Open },
+	// the end time of the file has passed
+	"afterEnd": func(ctx *RequestContextT, action Capability) bool { return ctx.EndTime > 0 && ctx.Now > ctx.EndTime },
+}
+
+// DefaultPolicy accepts what the privileges of the users grant.
+var DefaultPolicy = PolicyT{Rules: []PolicyRuleT{
+	{Name: "privilege", Effect: PolicyAllow, When: []string{"capability"}},
+}}
+
+// policy in force, set at startup by LoadPolicy
+var policy = &DefaultPolicy
+
+// ParsePolicy parses and checks a yaml policy.
+func ParsePolicy(content []byte) (*PolicyT, error) {
+	p := new(PolicyT)
+	err := yaml.UnmarshalStrict(content, p)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", InvalidPolicyErr, err)
+	}
+	for i, rule := range p.Rules {
+		if rule.Effect != PolicyAllow && rule.Effect != PolicyDeny {
+			return nil, fmt.Errorf("%w: rule %d: effect must be allow or deny, got %q", InvalidPolicyErr, i, rule.Effect)
+		}
+		for _, action := range rule.Actions {
+			if _, err = parseAction(action); err != nil {
+				return nil, fmt.Errorf("%w: rule %d: %s", InvalidPolicyErr, i, err)
+			}
+		}
+		for _, condition := range rule.When {
+			if _, ok := policyConditions[strings.TrimPrefix(condition, "!")]; !ok {
+				return nil, fmt.Errorf("%w: rule %d: unknown condition %q", InvalidPolicyErr, i, condition)
+			}
+		}
+		if "" == rule.Name {
+			p.Rules[i].Name = fmt.Sprintf("rule %d", i)
+		}
+	}
+	return p, nil
+}
+
+// LoadPolicy makes the policy in file path the one in force, DefaultPolicy when path
+// is empty.
+func LoadPolicy(path string) error {
+	if "" == path {
+		SetPolicy(&DefaultPolicy)
+		return nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	p, err := ParsePolicy(content)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	SetPolicy(p)
+	return nil
+}
+
+// SetPolicy makes p the policy in force.
+func SetPolicy(p *PolicyT) {
+	policy = p
+}
+
+func parseAction(name string) (Capability, error) {
+	for _, n := range capabilityNames {
+		if n.name == name {
+			return n.capability, nil
+		}
+	}
+	return NoCapability, fmt.Errorf("%w: %q", UnknownCapabilityErr, name)
+}
+
+func (rule *PolicyRuleT) appliesTo(ctx *RequestContextT, action Capability) bool {
+	if len(rule.Actions) > 0 && !contains(rule.Actions, ctx.Action) {
+		return false
+	}
+	if len(rule.Users) > 0 && !containsFold(rule.Users, ctx.User) {
+		return false
+	}
+	for _, condition := range rule.When {
+		negated := strings.HasPrefix(condition, "!")
+		if policyConditions[strings.TrimPrefix(condition, "!")](ctx, action) == negated {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// addresses are compared case-insensitively
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate returns the decision of the policy for the request of ctx.
+func (p *PolicyT) Evaluate(ctx *RequestContextT) DecisionT {
+	action, err := parseAction(ctx.Action)
+	if err != nil {
+		return DecisionT{}
+	}
+	var decision DecisionT
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.appliesTo(ctx, action) {
+			continue
+		}
+		if rule.Effect == PolicyDeny {
+			return DecisionT{Allowed: false, Rule: rule.Name}
+		}
+		if !decision.Allowed {
+			decision = DecisionT{Allowed: true, Rule: rule.Name}
+		}
+	}
+	return decision
+}
+
+// requestContext gathers what the policy needs to decide whether user may perform
+// action in a file at time now.
+func requestContext(user string, fileId string, action string, now int64) (*RequestContextT, error) {
+	ctx := &RequestContextT{User: user, FileId: fileId, Action: action, Now: now}
+	info, err := getFileInfo(fileId)
+	if err == sql.ErrNoRows {
+		return ctx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ctx.Known, ctx.Owner, ctx.Open, ctx.EndTime = true, info.Owner == user, info.IsOpen, info.EndTime
+	ctx.Capabilities, _, err = privilegeAt(user, fileId, now)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Participant, err = isParticipant(fileId, user)
+	if err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// EvaluateRequest returns the decision of the policy in force on whether user may
+// perform action, a capability name, in a file at time now, and what it was based on.
+func EvaluateRequest(user string, fileId string, action string, now int64) (*RequestContextT, DecisionT, error) {
+	if _, err := parseAction(action); err != nil {
+		return nil, DecisionT{}, err
+	}
+	ctx, err := requestContext(user, fileId, action, now)
+	if err != nil {
+		return nil, DecisionT{}, err
+	}
+	return ctx, policy.Evaluate(ctx), nil
+}
+
+// authorize is the one privilege check of the core entry points. It returns nil if the
+// policy allows user every capability of required in the file, NotOwnerErr if an owner
+// capability is refused and NoPermissionErr otherwise.
+func authorize(user string, fileId string, required Capability) error {
+	now := time.Now().Unix()
+	for _, n := range capabilityNames {
+		if !required.Has(n.capability) {
+			continue
+		}
+		ctx, decision, err := EvaluateRequest(user, fileId, n.name, now)
+		if err != nil {
+			return err
+		}
+		if decision.Allowed {
+			continue
+		}
+		refused := NoPermissionErr
+		if n.capability == CapTerminate || n.capability == CapManage || n.capability == CapRefund {
+			refused = NotOwnerErr
+		}
+		if "" != decision.Rule {
+			dbLog.Infof("%s refused %s on file %s by policy rule %q", ctx.User, ctx.Action, ctx.FileId, decision.Rule)
+		}
+		return refused
+	}
+	return nil
+}
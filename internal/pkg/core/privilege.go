@@ -0,0 +1,228 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Capability is a set of things a user may do in a file. The privilege of a user in a
+// file is the set of capabilities it holds, usually one of the roles.
+type Capability int
+
+const (
+	// read the own balance
+	CapReadOwn Capability = 1 << iota
+	// read every balance, the history and the participants of the file
+	CapReadAll
+	// subtract from the own balance
+	CapCharge
+	CapTerminate
+	// grant and revoke privileges
+	CapManage
+	// reverse subtracts, in no role but the owner's
+	CapRefund
+
+	NoCapability    Capability = 0
+	AllCapabilities            = CapReadOwn | CapReadAll | CapCharge | CapTerminate | CapManage | CapRefund
+)
+
+// named roles
+const (
+	RoleReadonly  = CapReadOwn | CapReadAll
+	RoleReadwrite = RoleReadonly | CapCharge
+	RoleWrite     = CapCharge
+	RoleManager   = RoleReadonly | CapManage
+	// what the owner of a file may do, whatever its privilege row says
+	RoleOwner = AllCapabilities
+)
+
+// privilege values of the AuthorityTable of the chain, see LegacyCapability
+const (
+	Readwrite = 0
+	Readonly  = 1
+	Write     = 2
+)
+
+var UnknownCapabilityErr = errors.New("unknown role or capability")
+var InvalidLimitsErr = errors.New("invalid privilege limits")
+var AmountLimitErr = errors.New("amount above the limit of the privilege")
+var DailyCapErr = errors.New("daily cap of the privilege reached")
+
+// window of the daily cap of a privilege
+const dailyCapWindow = 24 * 60 * 60
+
+// PrivilegeLimitsT restricts a privilege, for temporary access. Zero values do not
+// restrict.
+type PrivilegeLimitsT struct {
+	// unix times the privilege is valid from and until, both included
+	ValidFrom  int64
+	ValidUntil int64
+	// largest amount of one subtract
+	MaxAmount *CoinUnitT
+	// largest total of the subtracts of the last 24 hours
+	DailyCap *CoinUnitT
+}
+
+func (l *PrivilegeLimitsT) validAt(now int64) bool {
+	return now >= l.ValidFrom && (0 == l.ValidUntil || now <= l.ValidUntil)
+}
+
+func (l *PrivilegeLimitsT) valid() bool {
+	return l.ValidFrom >= 0 && l.ValidUntil >= 0 && (0 == l.ValidUntil || l.ValidUntil >= l.ValidFrom) &&
+		(nil == l.MaxAmount || l.MaxAmount.Sign() > 0) && (nil == l.DailyCap || l.DailyCap.Sign() > 0)
+}
+
+func sameAmount(a *CoinUnitT, b *CoinUnitT) bool {
+	return (nil == a && nil == b) || (nil != a && nil != b && a.Cmp(b) == 0)
+}
+
+func (l *PrivilegeLimitsT) equal(o *PrivilegeLimitsT) bool {
+	return l.ValidFrom == o.ValidFrom && l.ValidUntil == o.ValidUntil &&
+		sameAmount(l.MaxAmount, o.MaxAmount) && sameAmount(l.DailyCap, o.DailyCap)
+}
+
+var capabilityNames = []struct {
+	capability Capability
+	name       string
+}{
+	{CapReadOwn, "readOwn"},
+	{CapReadAll, "readAll"},
+	{CapCharge, "charge"},
+	{CapTerminate, "terminate"},
+	{CapManage, "manage"},
+	{CapRefund, "refund"},
+}
+
+// Roles are the named privileges, by name.
+var Roles = map[string]Capability{
+	"readonly":  RoleReadonly,
+	"readwrite": RoleReadwrite,
+	"write":     RoleWrite,
+	"manager":   RoleManager,
+	"owner":     RoleOwner,
+}
+
+// LegacyCapability returns the capabilities of a privilege of the chain's AuthorityTable.
+// Unknown values grant nothing.
+func LegacyCapability(privilege int) Capability {
+	switch privilege {
+	case Readwrite:
+		return RoleReadwrite
+	case Readonly:
+		return RoleReadonly
+	case Write:
+		return RoleWrite
+	default:
+		return NoCapability
+	}
+}
+
+// Has reports whether c holds every capability of required.
+func (c Capability) Has(required Capability) bool {
+	return c&required == required
+}
+
+// String returns the name of the role c is, "none", or the names of the capabilities
+// of c joined with "|".
+func (c Capability) String() string {
+	if c == NoCapability {
+		return "none"
+	}
+	for name, role := range Roles {
+		if role == c {
+			return name
+		}
+	}
+	var names []string
+	for _, n := range capabilityNames {
+		if c.Has(n.capability) {
+			names = append(names, n.name)
+		}
+	}
+	if rest := c &^ AllCapabilities; rest != 0 {
+		names = append(names, fmt.Sprintf("%#x", int(rest)))
+	}
+	return strings.Join(names, "|")
+}
+
+// ParseCapability is the inverse of String: it accepts a role name or capability
+// names joined with "|", e.g. "readOwn|charge".
+func ParseCapability(s string) (Capability, error) {
+	if role, ok := Roles[s]; ok {
+		return role, nil
+	}
+	var c Capability
+	for _, name := range strings.Split(s, "|") {
+		found := false
+		for _, n := range capabilityNames {
+			if n.name == strings.TrimSpace(name) {
+				c |= n.capability
+				found = true
+			}
+		}
+		if !found {
+			return NoCapability, fmt.Errorf("%w: %q", UnknownCapabilityErr, name)
+		}
+	}
+	return c, nil
+}
+
+// privilegeAt returns what user may do in a file at time now and the limits it does it
+// within: the owner everything without limits, anybody else what its privilege grants
+// while the privilege is valid.
+func privilegeAt(user string, fileId string, now int64) (Capability, *PrivilegeLimitsT, error) {
+	bOwner, err := isOwner(fileId, user)
+	if err != nil {
+		return NoCapability, nil, err
+	}
+	if bOwner {
+		return RoleOwner, &PrivilegeLimitsT{}, nil
+	}
+	privilege, limits, err := getPermissionForFile(user, fileId)
+	if err != nil {
+		return NoCapability, nil, err
+	}
+	if !limits.validAt(now) {
+		return NoCapability, limits, nil
+	}
+	return privilege, limits, nil
+}
+
+// capabilities returns what user may do in a file now, see privilegeAt.
+func capabilities(user string, fileId string) (Capability, error) {
+	privilege, _, err := privilegeAt(user, fileId, time.Now().Unix())
+	return privilege, err
+}
+
+// chargeLimits returns the limits of the privilege user charges its balance in a file
+// within, which checkLimits enforces where the charge is written.
+func chargeLimits(user string, fileId string) (*PrivilegeLimitsT, error) {
+	_, limits, err := privilegeAt(user, fileId, time.Now().Unix())
+	return limits, err
+}
+
+// checkLimits returns nil if user may subtract or transfer amount from its balance in a
+// file within limits at time now. q is the transaction the charge is written in, dbMutex
+// being held, so that concurrent charges count against the daily cap.
+func checkLimits(q dbExecutor, user string, fileId string, amount *CoinUnitT, limits *PrivilegeLimitsT, now int64) error {
+	if nil != limits.MaxAmount && amount.Cmp(limits.MaxAmount) > 0 {
+		return AmountLimitErr
+	}
+	if nil != limits.DailyCap {
+		spent, err := sumOperationsSince(q, fileId, user, "subtract", now-dailyCapWindow)
+		if err != nil {
+			return err
+		}
+		transferred, err := sumOperationsSince(q, fileId, user, "transferOut", now-dailyCapWindow)
+		if err != nil {
+			return err
+		}
+		spent.Add(spent, transferred)
+		if spent.Add(spent, amount).Cmp(limits.DailyCap) > 0 {
+			return DailyCapErr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package core
+
+import (
+	"errors"
+	"time"
+)
+
+var InvalidReversalErr = errors.New("invalid reversal")
+var NoSuchSubtractErr = errors.New("no such subtract in file")
+var ReversalExceededErr = errors.New("amount above what is left of the subtract")
+
+// ReversalT credits back part or all of a subtract, a refund or the fix of an
+// erroneous charge.
+type ReversalT struct {
+	FileId string
+	// ids of the subtract and of the reversal in the history of the file
+	OperationId int64
+	ReversalId  int64
+	User        string
+	// whose earning the reversal takes back, empty for subtracts without one
+	Payee      string
+	Value      *CoinUnitT
+	Actor      string
+	Reason     string
+	CreateTime int64
+}
+
+// Reverse credits amount of the subtract operationId of an open file back to the user
+// it was taken from, and takes it back from the earnings of its payee, on behalf of
+// actor, who must be allowed to refund, recording meta with it unless nil. The
+// reversals of a subtract cannot exceed it.
+func Reverse(actor string, fileId string, operationId int64, amount *CoinUnitT, reason string, meta *OperationMetaT) (*ReversalT, error) {
+	if nil == amount || amount.Sign() <= 0 {
+		return nil, InvalidReversalErr
+	}
+	if err := checkMeta(meta); err != nil {
+		return nil, err
+	}
+	if err := authorize(actor, fileId, CapRefund); err != nil {
+		return nil, err
+	}
+	reversal := &ReversalT{FileId: fileId, OperationId: operationId, Value: amount, Actor: actor, Reason: reason,
+		CreateTime: time.Now().Unix()}
+	err := appendReversal(reversal, meta)
+	if err != nil {
+		return nil, err
+	}
+	return reversal, nil
+}
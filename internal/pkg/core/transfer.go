@@ -0,0 +1,38 @@
+package core
+
+import (
+	"errors"
+)
+
+var InvalidTransferErr = errors.New("invalid transfer")
+var NoSuchParticipantErr = errors.New("recipient is not a participant of the file")
+
+// Transfer moves amount from the balance of from in a file to the one of to, another
+// participant of the file, within the privilege of from, recording meta with both sides
+// unless nil. It returns the balance of from after the transfer.
+func Transfer(from string, fileId string, to string, amount *CoinUnitT, meta *OperationMetaT) (*CoinUnitT, error) {
+	if "" == to || from == to {
+		return nil, InvalidTransferErr
+	}
+	if err := checkMeta(meta); err != nil {
+		return nil, err
+	}
+	if err := authorize(from, fileId, CapCharge); err != nil {
+		return nil, err
+	}
+	if amount.Sign() < 0 {
+		return nil, NoNegativeValueAllowedErr
+	}
+	limits, err := chargeLimits(from, fileId)
+	if err != nil {
+		return nil, err
+	}
+	participant, err := isParticipant(fileId, to)
+	if err != nil {
+		return nil, err
+	}
+	if !participant {
+		return nil, NoSuchParticipantErr
+	}
+	return appendTransfer(fileId, from, to, amount, limits, meta)
+}
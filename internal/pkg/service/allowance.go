@@ -0,0 +1,74 @@
+package service
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/internal/pkg/core"
+	"kdc/pkg/reqsig"
+	"math/big"
+)
+
+type allowanceResult struct {
+	User      string       `json:"user"`
+	Spender   string       `json:"spender"`
+	Remaining *hexutil.Big `json:"remaining"`
+	// balance of the user, but after an approve
+	Balance *hexutil.Big `json:"balance,omitempty"`
+	Time    int64        `json:"time,omitempty"`
+}
+
+func newAllowanceResult(allowance *core.AllowanceT, balance *big.Int) allowanceResult {
+	return allowanceResult{allowance.User, allowance.Spender, (*hexutil.Big)(allowance.Remaining), (*hexutil.Big)(balance), allowance.UpdateTime}
+}
+
+// allowanceMessage builds the signed message of an approve or a charge, whose Data is
+// the spender of an approve and the user of a charge.
+func allowanceMessage(method string, pp *param) (*reqsig.Message, *jsonErr) {
+	if nil == pp.Amount {
+		return nil, makeJsonError(invalidParamsCode, "missing amount")
+	}
+	return &reqsig.Message{Method: method, FileId: pp.FileId, User: pp.Data, Spender: pp.Data,
+		Amount: pp.Amount.ToInt(), Expiry: pp.Expiry}, nil
+}
+
+func handleApprove(req *jsonRpc) (interface{}, *jsonErr) {
+	return signedChange(req, allowanceMessage, func(pp *param, signer string, spender string) (interface{}, error) {
+		allowance, err := core.Approve(signer, pp.FileId, spender, pp.Amount.ToInt(), pp.Signature)
+		if err != nil {
+			return nil, err
+		}
+		return newAllowanceResult(allowance, nil), nil
+	})
+}
+
+func handleCharge(req *jsonRpc) (interface{}, *jsonErr) {
+	return signedChange(req, allowanceMessage, func(pp *param, signer string, user string) (interface{}, error) {
+		balance, allowance, err := core.ChargeAllowance(signer, user, pp.FileId, pp.Amount.ToInt(), operationMeta(req, pp, signer))
+		if err != nil {
+			return nil, err
+		}
+		return newAllowanceResult(allowance, balance), nil
+	})
+}
+
+func handleAllowance(req *jsonRpc) (interface{}, *jsonErr) {
+	pp := new(param)
+	if jErr := req.bindParams(pp); jErr != nil {
+		return nil, jErr
+	}
+	reqId, err := req.idString()
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	msg := &reqsig.Message{Method: req.Method, Id: reqId, FileId: pp.FileId, User: pp.Data, Spender: pp.Spender}
+	signer, _, jErr := recoverSigner(pp, msg)
+	if jErr != nil {
+		return nil, jErr
+	}
+	user, spender := common.HexToAddress(pp.Data).Hex(), common.HexToAddress(pp.Spender).Hex()
+	allowance, balance, err := core.GetAllowance(signer, pp.FileId, user, spender)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return newAllowanceResult(allowance, balance), nil
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"kdc/internal/pkg/core"
+	"sync"
+	"time"
+)
+
+// syncBatcherT queues settlement chunks of several files until they are flushed
+// together in batch transactions. A chunk stays queued until its transaction is
+// recorded, so that it is not queued twice.
+type syncBatcherT struct {
+	mutex  sync.Mutex
+	queue  []MortgageTab
+	queued map[string]bool
+}
+
+var syncBatcher = &syncBatcherT{queued: make(map[string]bool)}
+
+func chunkKey(mortgageTab MortgageTab) string {
+	return fmt.Sprintf("%s/%d", mortgageTab.FileID, mortgageTab.Chunk)
+}
+
+func (b *syncBatcherT) add(mortgageTab MortgageTab) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.queued[chunkKey(mortgageTab)] {
+		return
+	}
+	b.queued[chunkKey(mortgageTab)] = true
+	b.queue = append(b.queue, mortgageTab)
+}
+
+// requeue puts back chunks taken but not sent.
+func (b *syncBatcherT) requeue(mortgageTabs []MortgageTab) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.queue = append(b.queue, mortgageTabs...)
+}
+
+// release forgets a chunk whose transaction has been recorded.
+func (b *syncBatcherT) release(mortgageTab MortgageTab) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.queued, chunkKey(mortgageTab))
+}
+
+func (b *syncBatcherT) take() []MortgageTab {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	queue := b.queue
+	b.queue = nil
+	return queue
+}
+
+// packBatches groups the queued chunks so that the json of each group stays within
+// maxSize bytes. A chunk bigger than maxSize on its own still gets a group.
+func packBatches(queue []MortgageTab, maxSize int) [][]MortgageTab {
+	var batches [][]MortgageTab
+	var current []MortgageTab
+	size := 0
+	for _, mortgageTab := range queue {
+		encoded, _ := json.Marshal(mortgageTab)
+		if len(current) > 0 && size+len(encoded) > maxSize {
+			batches = append(batches, current)
+			current = nil
+			size = 0
+		}
+		current = append(current, mortgageTab)
+		size += len(encoded)
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+// FlushSyncBatch sends every queued settlement chunk and records which transaction
+// settled each file. Chunks that could not be sent are queued again.
+func FlushSyncBatch() bool {
+	queue := syncBatcher.take()
+	if 0 == len(queue) {
+		return true
+	}
+	if !UnlockAccount(conf.Account.SyncAccount, conf.Account.Password) {
+		syncBatcher.requeue(queue)
+		return false
+	}
+	ok := true
+	for _, batch := range packBatches(queue, conf.Settlement.MaxExtraDataSize) {
+		var txHash string
+		if 1 == len(batch) {
+			txHash = sendSyncChunk(batch[0])
+		} else {
+			txHash = sendSpecialTransaction(SpecialBatchTxInput{
+				Type:                           conf.Chain.SyncBatchTransactionType,
+				SpecialTxTypeMortgageInitBatch: batch,
+			})
+		}
+		if "" == txHash {
+			chainLog.Errorf("unable to send batch of %d settlements", len(batch))
+			syncBatcher.requeue(batch)
+			ok = false
+			continue
+		}
+		for _, mortgageTab := range batch {
+			chunkCount := mortgageTab.ChunkCount
+			if 0 == chunkCount {
+				chunkCount = 1
+			}
+			settlement := core.SettlementT{
+				FileId:     mortgageTab.FileID,
+				TxHash:     txHash,
+				Terminate:  mortgageTab.Terminate,
+				Chunk:      mortgageTab.Chunk,
+				ChunkCount: chunkCount,
+			}
+			err := core.RecordSettlement(&settlement)
+			if err != nil {
+				chainLog.Errorf("unable to record settlement %s of file %s chunk %d: %s", txHash, mortgageTab.FileID, mortgageTab.Chunk, err)
+			}
+			syncBatcher.release(mortgageTab)
+		}
+	}
+	return ok
+}
+
+// RunSyncBatcher flushes queued settlements every conf.Settlement.BatchInterval until stop is
+// closed, then flushes one last time.
+func RunSyncBatcher(stop <-chan struct{}) {
+	ticker := time.NewTicker(conf.Settlement.BatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			FlushSyncBatch()
+		case <-stop:
+			FlushSyncBatch()
+			return
+		}
+	}
+}
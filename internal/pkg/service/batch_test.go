@@ -0,0 +1,30 @@
+package service
+
+import (
+	"encoding/json"
+	"kdc/internal/pkg/core"
+	"strconv"
+	"testing"
+)
+
+func TestPackBatches(t *testing.T) {
+	var queue []MortgageTab
+	for i := 0; i < 5; i++ {
+		mortgage := core.MortgageT{"0xa": "0x1"}
+		queue = append(queue, MortgageTab{FromAccount: "0xowner", FileID: "file" + strconv.Itoa(i), Sidechain: &mortgage})
+	}
+	encoded, _ := json.Marshal(queue[0])
+	batches := packBatches(queue, 2*len(encoded))
+	if len(batches) != 3 {
+		t.Fatalf("expected 3 batches, got %d", len(batches))
+	}
+	if len(batches[0]) != 2 || len(batches[2]) != 1 || batches[2][0].FileID != "file4" {
+		t.Errorf("unexpected batches %v", batches)
+	}
+	if batches = packBatches(queue, 1); len(batches) != 5 {
+		t.Errorf("expected oversized chunks to be sent alone, got %d batches", len(batches))
+	}
+	if batches = packBatches(nil, 1024); len(batches) != 0 {
+		t.Errorf("expected no batch, got %d", len(batches))
+	}
+}
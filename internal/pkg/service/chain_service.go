@@ -3,17 +3,25 @@ package service
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/op/go-logging"
 	"io/ioutil"
 	"kdc/internal/pkg/core"
 	"net/http"
 )
 
+var chainLog = logging.MustGetLogger("chain")
+
 type MortgageTab struct {
 	FromAccount string          `json:"fromAccount"`
 	Terminate   bool            `json:"terminate"`
 	Sidechain   *core.MortgageT `json:"sidechain"`
 	FileID      string          `json:"fileID"`
+	Chunk       int             `json:"chunk,omitempty"`
+	ChunkCount  int             `json:"chunkCount,omitempty"`
+	// what the subtracts of the file credited to each payee, in the last chunk
+	Earnings *core.MortgageT `json:"earnings,omitempty"`
 }
 
 type SpecialTxInput struct {
@@ -21,6 +29,11 @@ type SpecialTxInput struct {
 	SpecialTxTypeMortgageInit MortgageTab `json:"specialTxTypeMortgageInit"`
 }
 
+type SpecialBatchTxInput struct {
+	Type                           string        `json:"type"`
+	SpecialTxTypeMortgageInitBatch []MortgageTab `json:"specialTxTypeMortgageInitBatch"`
+}
+
 type SendTxArgs struct {
 	From      string         `json:"from"`
 	To        string         `json:"to"`
@@ -51,6 +64,8 @@ type InitFileT struct {
 	CreateTime     int64                   `json:"createTime"`
 	EndTime        int64                   `json:"endTime"`
 	FromAccount    string                  `json:"fromAccount"`
+	// block of the init transaction, when the node reports it
+	BlockNumber string `json:"blockNumber,omitempty"`
 }
 type MortgageInitResult struct {
 	Id      int         `json:"id"`
@@ -74,6 +89,66 @@ type GetLogSwitchParameter struct {
 	Params  []string `json:"params"`
 	Id      int      `json:"id"`
 }
+type SendTransactionResult struct {
+	Id      int    `json:"id"`
+	Jsonrpc string `json:"jsonrpc"`
+	Result  string `json:"result"`
+}
+type GetTransactionReceiptParameter struct {
+	Jsonrpc string   `json:"jsonrpc"`
+	Method  string   `json:"method"`
+	Params  []string `json:"params"`
+	Id      int      `json:"id"`
+}
+type TransactionReceiptT struct {
+	TransactionHash string `json:"transactionHash"`
+	BlockNumber     string `json:"blockNumber"`
+	Status          string `json:"status"`
+}
+type GetTransactionReceiptResult struct {
+	Id      int                  `json:"id"`
+	Jsonrpc string               `json:"jsonrpc"`
+	Result  *TransactionReceiptT `json:"result"`
+}
+type GetBlockByNumberParameter struct {
+	Jsonrpc string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	Id      int           `json:"id"`
+}
+type RpcTransactionT struct {
+	Hash        string `json:"hash"`
+	BlockNumber string `json:"blockNumber"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Value       string `json:"value"`
+	ExtraData   string `json:"extraData"`
+}
+type RpcBlockT struct {
+	Number       string            `json:"number"`
+	Transactions []RpcTransactionT `json:"transactions"`
+}
+type GetBlockByNumberResult struct {
+	Id      int        `json:"id"`
+	Jsonrpc string     `json:"jsonrpc"`
+	Result  *RpcBlockT `json:"result"`
+}
+type EthCallParameter struct {
+	Jsonrpc string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	Id      int           `json:"id"`
+}
+type RpcErrorT struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+type EthCallResult struct {
+	Id      int        `json:"id"`
+	Jsonrpc string     `json:"jsonrpc"`
+	Result  string     `json:"result"`
+	Error   *RpcErrorT `json:"error"`
+}
 type FileIDT []string
 type GetLogSwitchByAddressAndFileIDResult struct {
 	Id      int                        `json:"id"`
@@ -81,32 +156,92 @@ type GetLogSwitchByAddressAndFileIDResult struct {
 	Result  map[string]map[string]bool `json:"result"`
 }
 
-func FireSyncTransaction(isTerminate bool, fromAccount, fileId string, mortgage *core.MortgageT) bool {
-	if "" == fileId || nil == mortgage || "" == fromAccount {
-		return false
+// FireSyncTransaction sends the next chunk of the settlement of the file, or queues it
+// for the next batch. The chunks are queued in the database when the file is closed,
+// see core.NextSettlementChunk for the order they are sent in.
+func FireSyncTransaction(fileId string) error {
+	settlementMutex.Lock()
+	defer settlementMutex.Unlock()
+	settlement, err := core.NextSettlementChunk(fileId)
+	if err != nil || nil == settlement {
+		return err
 	}
-	unlock := UnlockAccount(SyncAccount, AccountPassword)
+	file, err := core.GetFileInfo(fileId)
+	if err != nil {
+		return err
+	}
+	mortgage, err := core.RemainMortgage(fileId)
+	if err != nil {
+		return err
+	}
+	chunks := splitMortgage(mortgage, conf.Settlement.MaxParticipants, conf.Settlement.MaxExtraDataSize)
+	if len(chunks) != settlement.ChunkCount {
+		return fmt.Errorf("file %s now splits into %d chunks instead of %d", fileId, len(chunks), settlement.ChunkCount)
+	}
+	mortgageTab := buildMortgageTab(settlement.Terminate, file.Owner, fileId, chunks, settlement.Chunk, fileEarnings(fileId))
+	if conf.Settlement.BatchEnabled {
+		syncBatcher.add(mortgageTab)
+		return nil
+	}
+	unlock := UnlockAccount(conf.Account.SyncAccount, conf.Account.Password)
 	if false == unlock {
-		return false
+		return core.SyncTransactionErr
+	}
+	txHash := sendSyncChunk(mortgageTab)
+	if "" == txHash {
+		return core.SyncTransactionErr
 	}
+	settlement.TxHash = txHash
+	err = core.RecordSettlement(settlement)
+	if err != nil {
+		chainLog.Errorf("unable to record settlement %s of file %s chunk %d: %s", txHash, fileId, settlement.Chunk, err)
+	}
+	return err
+}
+
+// buildMortgageTab builds the sync payload of chunks[chunk]. Only the last chunk carries
+// the terminate flag so the chain keeps accepting the earlier ones, and the earnings of
+// the payees so they are paid once.
+func buildMortgageTab(isTerminate bool, fromAccount, fileId string, chunks []core.MortgageT, chunk int, earnings *core.MortgageT) MortgageTab {
 	mortgageTab := MortgageTab{
 		FromAccount: fromAccount,
-		Terminate:   isTerminate,
-		Sidechain:   mortgage,
+		Terminate:   isTerminate && chunk == len(chunks)-1,
+		Sidechain:   &chunks[chunk],
 		FileID:      fileId,
 	}
+	if chunk == len(chunks)-1 {
+		mortgageTab.Earnings = earnings
+	}
+	if len(chunks) > 1 {
+		mortgageTab.Chunk = chunk
+		mortgageTab.ChunkCount = len(chunks)
+	}
+	return mortgageTab
+}
+
+// sendSyncChunk sends one sync transaction and returns its hash, or "" on failure.
+func sendSyncChunk(mortgageTab MortgageTab) string {
 	txInput := SpecialTxInput{
-		Type: SyncTransactionType,
+		Type: conf.Chain.SyncTransactionType,
 		SpecialTxTypeMortgageInit: mortgageTab,
 	}
+	return sendSpecialTransaction(txInput)
+}
+
+func buildSendTxArgs(txInput interface{}) SendTxArgs {
 	sendTxArgs := SendTxArgs{
-		From:     SyncAccount,
-		To:       SpecialAccount,
-		Gas:      GasVal,
-		GasPrice: GasPriceVal,
+		From:     conf.Account.SyncAccount,
+		To:       conf.Chain.SpecialAccount,
+		Gas:      conf.Gas.Gas,
+		GasPrice: conf.Gas.GasPrice,
 	}
 	extraData, _ := json.Marshal(txInput)
 	sendTxArgs.ExtraData = string(extraData)
+	return sendTxArgs
+}
+
+func sendSpecialTransaction(txInput interface{}) string {
+	sendTxArgs := buildSendTxArgs(txInput)
 	parameter := FireSyncTransactionParameter{
 		Jsonrpc: "2.0",
 		Method:  "eth_sendTransaction",
@@ -116,18 +251,21 @@ func FireSyncTransaction(isTerminate bool, fromAccount, fileId string, mortgage
 	input, _ := json.Marshal(parameter)
 	result := httpPost(input)
 	if nil == result {
-		return false
+		return ""
 	}
-	return true
+	var txResult SendTransactionResult
+	json.Unmarshal(result, &txResult)
+	return txResult.Result
 }
 
+// UnlockAccount unlocks the sync account on the node with personal_unlockAccount.
 func UnlockAccount(account, password string) bool {
 	if "" == account || "" == password {
 		return false
 	}
 	parameter := UnlockAccountParameter{
 		Jsonrpc: "2.0",
-		Method:  "eth_getMortgageInitByBlockNumberRange",
+		Method:  "personal_unlockAccount",
 		Id:      1,
 	}
 	parameter.Params = append(parameter.Params, account)
@@ -144,44 +282,129 @@ func GetInitFile(startNum string) {
 	if "" == startNum {
 		return
 	}
-	mortgageInitResultArr := GetMortgageInitByBlockNumberRange(startNum)
-	var AllowTableArr core.AllowTableT
-	MortgageTableArr := make(core.MortgageTableT)
+	endNum := GetBlockNumber()
+	if "0x0" == endNum {
+		return
+	}
+	IngestBlockRange(startNum, endNum)
+}
+
+// IngestBlockRange creates the files initialised in blocks [startNum, endNum], then
+// applies the deposits of these blocks, and returns how many files were created. Files
+// already in the ledger, deposits already applied and mortgages that do not match
+// their originating transaction are skipped. Nothing is ingested when a block cannot be
+// loaded, so that the range can be ingested again.
+func IngestBlockRange(startNum, endNum string) (int, error) {
+	start, err := hexutil.DecodeUint64(startNum)
+	if err != nil {
+		return 0, err
+	}
+	end, err := hexutil.DecodeUint64(endNum)
+	if err != nil {
+		return 0, err
+	}
+	mortgageInitResultArr, err := getMortgageInitByBlockRange(startNum, endNum)
+	if err != nil {
+		return 0, err
+	}
+	var inits []InitFileT
 	for _, v := range mortgageInitResultArr {
-		AllowTableArr = v.AuthorityTable
+		if _, err := core.GetFileInfo(v.FileID); err == nil {
+			continue
+		}
+		inits = append(inits, v)
+	}
+	if 0 == len(inits) && "" == conf.Chain.DepositTransactionType {
+		return 0, nil
+	}
+	created := 0
+	originTxs, deposits, err := findSpecialTxs(blocksToScan(start, end, inits))
+	if err != nil {
+		return 0, err
+	}
+	for _, v := range inits {
+		provenance, err := validateMortgageInit(&v, originTxs[v.FileID])
+		if err != nil {
+			chainLog.Warningf("rejecting mortgage init of file %s: %s", v.FileID, err)
+			continue
+		}
+		originJson, _ := json.Marshal(provenance)
+		AllowTableArr := core.AllowTableT(v.AuthorityTable)
+		MortgageTableArr := make(core.MortgageTableT)
 		for k, v := range v.MortgageTable {
 			MortgageTableArr[k] = *v.ToInt()
 		}
-		core.InitFile(v.FromAccount, v.FileID, &AllowTableArr, &MortgageTableArr, v.CreateTime, v.EndTime)
+		err = core.InitFile(v.FromAccount, v.FileID, string(originJson), &AllowTableArr, &MortgageTableArr, v.CreateTime, v.EndTime)
+		if err != nil {
+			chainLog.Errorf("unable to create file %s: %s", v.FileID, err)
+			continue
+		}
+		created++
+	}
+	ingestDeposits(deposits)
+	return created, nil
+}
+
+// ingestDeposits applies deposits in chain order and returns how many were new.
+func ingestDeposits(deposits []depositTxT) int {
+	applied := 0
+	for i := range deposits {
+		event := &deposits[i].event
+		deposit, err := validateDeposit(&deposits[i])
+		if err != nil {
+			chainLog.Warningf("rejecting deposit to file %s: %s", event.FileID, err)
+			continue
+		}
+		allow := core.AllowTableT(event.AuthorityTable)
+		mortgage := make(core.MortgageTableT)
+		for user, amount := range event.MortgageTable {
+			mortgage[user] = *amount.ToInt()
+		}
+		err = core.Deposit(deposit, &mortgage, &allow)
+		if err == core.DepositExistsErr {
+			continue
+		}
+		if err != nil {
+			chainLog.Errorf("unable to apply deposit %s to file %s: %s", deposit.TxHash, deposit.FileId, err)
+			continue
+		}
+		chainLog.Infof("file %s topped up with %s by %s in %s", deposit.FileId, hexutil.EncodeBig(deposit.Value), deposit.From, deposit.TxHash)
+		applied++
 	}
+	return applied
 }
 
 func GetMortgageInitByBlockNumberRange(startNum string) []InitFileT {
 	if "" == startNum {
 		return nil
 	}
+	endNum := GetBlockNumber()
+	if "0x0" == endNum {
+		return nil
+	}
+	mortgageInitResultArr, _ := getMortgageInitByBlockRange(startNum, endNum)
+	return mortgageInitResultArr
+}
+
+func getMortgageInitByBlockRange(startNum, endNum string) ([]InitFileT, error) {
 	parameter := MortgageInitParameter{
 		Jsonrpc: "2.0",
 		Method:  "eth_getMortgageInitByBlockNumberRange",
 		Id:      1,
 	}
 	parameter.Params = append(parameter.Params, startNum)
-	endNum := GetBlockNumber()
-	if "0x0" == endNum {
-		return nil
-	}
 	parameter.Params = append(parameter.Params, endNum)
 	input, _ := json.Marshal(parameter)
 	result := httpPost(input)
 	if nil == result {
-		return nil
+		return nil, fmt.Errorf("eth_getMortgageInitByBlockNumberRange: no response from %s", conf.Chain.Url)
 	}
 	var mortgageInitResultArr MortgageInitResult
-	json.Unmarshal(result, &mortgageInitResultArr)
-	if nil != mortgageInitResultArr.Result {
-		return mortgageInitResultArr.Result
+	err := json.Unmarshal(result, &mortgageInitResultArr)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return mortgageInitResultArr.Result, nil
 }
 
 func GetBlockNumber() string {
@@ -200,9 +423,13 @@ func httpPost(parameter []byte) []byte {
 	}
 	client := &http.Client{}
 	req_parameter := bytes.NewBuffer(parameter)
-	request, _ := http.NewRequest("POST", ServeUrl, req_parameter)
+	request, _ := http.NewRequest("POST", conf.Chain.Url, req_parameter)
 	request.Header.Set("Content-type", "application/json")
-	response, _ := client.Do(request)
+	response, err := client.Do(request)
+	if err != nil {
+		return nil
+	}
+	defer response.Body.Close()
 	if response.StatusCode == 200 {
 		body, _ := ioutil.ReadAll(response.Body)
 		return body
@@ -231,6 +458,72 @@ func GetLogSwitchByAddressAndFileID(addressAndFileID map[string]FileIDT) map[str
 	return resultArr.Result
 }
 
+func GetTransactionReceipt(txHash string) *TransactionReceiptT {
+	if "" == txHash {
+		return nil
+	}
+	parameter := GetTransactionReceiptParameter{
+		Jsonrpc: "2.0",
+		Method:  "eth_getTransactionReceipt",
+		Id:      1,
+	}
+	parameter.Params = append(parameter.Params, txHash)
+	input, _ := json.Marshal(parameter)
+	result := httpPost(input)
+	if nil == result {
+		return nil
+	}
+	var receiptResult GetTransactionReceiptResult
+	json.Unmarshal(result, &receiptResult)
+	return receiptResult.Result
+}
+
+func GetBlockByNumber(blockNum string) *RpcBlockT {
+	if "" == blockNum {
+		return nil
+	}
+	parameter := GetBlockByNumberParameter{
+		Jsonrpc: "2.0",
+		Method:  "eth_getBlockByNumber",
+		Id:      1,
+	}
+	parameter.Params = append(parameter.Params, blockNum, true)
+	input, _ := json.Marshal(parameter)
+	result := httpPost(input)
+	if nil == result {
+		return nil
+	}
+	var blockResult GetBlockByNumberResult
+	json.Unmarshal(result, &blockResult)
+	return blockResult.Result
+}
+
+// callNode sends a read-only call such as eth_estimateGas or eth_call and returns its
+// result, or the error reported by the node.
+func callNode(method string, params ...interface{}) (string, error) {
+	parameter := EthCallParameter{
+		Jsonrpc: "2.0",
+		Method:  method,
+		Params:  params,
+		Id:      1,
+	}
+	input, _ := json.Marshal(parameter)
+	result := httpPost(input)
+	if nil == result {
+		return "", fmt.Errorf("%s: no response from %s", method, conf.Chain.Url)
+	}
+	var callResult EthCallResult
+	err := json.Unmarshal(result, &callResult)
+	if err != nil {
+		return "", err
+	}
+	if nil != callResult.Error {
+		return "", fmt.Errorf("%s: %s (%d)", method, callResult.Error.Message, callResult.Error.Code)
+	}
+	return callResult.Result, nil
+}
+
 func init() {
 	core.SetSyncFunc(FireSyncTransaction)
+	core.SetChunkCountFunc(settlementChunkCount)
 }
\ No newline at end of file
@@ -2,7 +2,6 @@ package service
 
 import (
 	"fmt"
-	"kdc/internal/pkg/core"
 	"testing"
 )
 
@@ -19,14 +18,11 @@ func TestGetInitFile(t *testing.T) {
 }
 
 func TestUnlockAccount(t *testing.T) {
-	UnlockAccount(SyncAccount, AccountPassword)
+	UnlockAccount(conf.Account.SyncAccount, conf.Account.Password)
 }
 
 func TestFireSyncTransaction(t *testing.T) {
-	mortgageTable := make(core.MortgageT)
-	mortgageTable["0xc4f27fe3af8b76c3120c7e8b27beac0b2927abf2"] = "0x22222244"
-	mortgageTable["0x92fb6a50a6817d19b1cb47bdc55a687add4ea21a"] = "0x777777"
-	FireSyncTransaction(true, "0xaf7a12de8dc1de25c0541966695498074f52a1cc", "c2bb8976c35037f73b594425b5ee77f6931bae7e3c6fd91cec52a570a804e6f8", &mortgageTable)
+	FireSyncTransaction("c2bb8976c35037f73b594425b5ee77f6931bae7e3c6fd91cec52a570a804e6f8")
 }
 
 /*
@@ -1,19 +1,10 @@
 package service
 
-//server address
-var ServeUrl string = "http://127.0.0.1:8545"
+import "kdc/internal/pkg/config"
 
-//synchronous log accounts
-var SyncAccount string = "0xaf7a12de8dc1de25c0541966695498074f52a1cc"
+// conf is the configuration the service runs with, set by Configure at startup.
+var conf = config.Default()
 
-//special account
-var SpecialAccount string = "0xa07b0fc50549c636ad4d7fbc6ea747574efb8e8a"
-
-//accountPassword
-var AccountPassword string = "123456"
-
-var GasVal string = "0x34502"
-
-var GasPriceVal string = "0x9122"
-
-var SyncTransactionType string = "0x7"
+func Configure(c *config.Config) {
+	conf = c
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/internal/pkg/core"
+	"kdc/pkg/reqsig"
+	"math/big"
+)
+
+type delegationResult struct {
+	User       string       `json:"user"`
+	Delegate   string       `json:"delegate"`
+	Cap        *hexutil.Big `json:"cap"`
+	Spent      *hexutil.Big `json:"spent"`
+	Remaining  *hexutil.Big `json:"remaining"`
+	ValidUntil int64        `json:"validUntil"`
+	Signature  string       `json:"signature,omitempty"`
+	Time       int64        `json:"time"`
+}
+
+func newDelegationResult(delegation *core.DelegationT) delegationResult {
+	return delegationResult{
+		User:       delegation.User,
+		Delegate:   delegation.Delegate,
+		Cap:        (*hexutil.Big)(delegation.Cap),
+		Spent:      (*hexutil.Big)(delegation.Spent),
+		Remaining:  (*hexutil.Big)(delegation.Remaining()),
+		ValidUntil: delegation.ValidUntil,
+		Signature:  delegation.Signature,
+		Time:       delegation.CreateTime,
+	}
+}
+
+// delegationMessage builds the signed message of a delegation change.
+func delegationMessage(method string, pp *param) (*reqsig.Message, *jsonErr) {
+	// a missing cap is signed as 0, which core refuses
+	limit := new(big.Int)
+	if nil != pp.Amount {
+		limit = pp.Amount.ToInt()
+	}
+	return &reqsig.Message{Method: method, FileId: pp.FileId, Delegate: pp.Data, Amount: limit,
+		ValidUntil: pp.ValidUntil, Expiry: pp.Expiry}, nil
+}
+
+func handleDelegate(req *jsonRpc) (interface{}, *jsonErr) {
+	return signedChange(req, delegationMessage, func(pp *param, signer string, delegate string) (interface{}, error) {
+		delegation, err := core.Delegate(signer, pp.FileId, delegate, pp.Amount.ToInt(), int64(pp.ValidUntil), pp.Signature)
+		if err != nil {
+			return nil, err
+		}
+		return newDelegationResult(delegation), nil
+	})
+}
+
+func handleRevokeDelegation(req *jsonRpc) (interface{}, *jsonErr) {
+	return signedChange(req, delegationMessage, func(pp *param, signer string, delegate string) (interface{}, error) {
+		return 1, core.RevokeDelegation(signer, pp.FileId, delegate)
+	})
+}
+
+func handleListDelegations(req *jsonRpc) (interface{}, *jsonErr) {
+	pp, signer, jErr := signedQuery(req)
+	if jErr != nil {
+		return nil, jErr
+	}
+	delegations, err := core.ListDelegations(signer, pp.FileId)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	result := []delegationResult{}
+	for i := range delegations {
+		result = append(result, newDelegationResult(&delegations[i]))
+	}
+	return result, nil
+}
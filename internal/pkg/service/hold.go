@@ -0,0 +1,84 @@
+package service
+
+import (
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/internal/pkg/core"
+	"kdc/pkg/reqsig"
+	"math/big"
+)
+
+type holdResult struct {
+	Id         int64        `json:"id"`
+	User       string       `json:"user"`
+	Payee      string       `json:"payee"`
+	Amount     *hexutil.Big `json:"amount"`
+	Captured   *hexutil.Big `json:"captured,omitempty"`
+	Status     string       `json:"status"`
+	ValidUntil int64        `json:"validUntil"`
+	// balance of the user, but after a reserve or a release
+	Balance *hexutil.Big `json:"balance,omitempty"`
+	Time    int64        `json:"time"`
+}
+
+func newHoldResult(hold *core.HoldT, balance *big.Int) holdResult {
+	return holdResult{
+		Id:         hold.Id,
+		User:       hold.User,
+		Payee:      hold.Payee,
+		Amount:     (*hexutil.Big)(hold.Amount),
+		Captured:   (*hexutil.Big)(hold.Captured),
+		Status:     hold.Status,
+		ValidUntil: hold.ValidUntil,
+		Balance:    (*hexutil.Big)(balance),
+		Time:       hold.UpdateTime,
+	}
+}
+
+type balanceResult struct {
+	Balance   *hexutil.Big `json:"balance"`
+	Held      *hexutil.Big `json:"held"`
+	Available *hexutil.Big `json:"available"`
+}
+
+// holdMessage builds the signed message of a reserve, capture or release.
+func holdMessage(method string, pp *param) (*reqsig.Message, *jsonErr) {
+	if nil == pp.Amount && "release" != method {
+		return nil, makeJsonError(invalidParamsCode, "missing amount")
+	}
+	amount := new(big.Int)
+	if nil != pp.Amount {
+		amount = pp.Amount.ToInt()
+	}
+	return &reqsig.Message{Method: method, FileId: pp.FileId, Payee: pp.Data, Hold: pp.Hold, Amount: amount,
+		ValidUntil: pp.ValidUntil, Expiry: pp.Expiry}, nil
+}
+
+func handleReserve(req *jsonRpc) (interface{}, *jsonErr) {
+	return signedChange(req, holdMessage, func(pp *param, signer string, payee string) (interface{}, error) {
+		hold, err := core.Reserve(signer, pp.FileId, payee, pp.Amount.ToInt(), int64(pp.ValidUntil))
+		if err != nil {
+			return nil, err
+		}
+		return newHoldResult(hold, nil), nil
+	})
+}
+
+func handleCapture(req *jsonRpc) (interface{}, *jsonErr) {
+	return signedChange(req, holdMessage, func(pp *param, signer string, _ string) (interface{}, error) {
+		hold, balance, err := core.Capture(signer, pp.FileId, int64(pp.Hold), pp.Amount.ToInt(), operationMeta(req, pp, signer))
+		if err != nil {
+			return nil, err
+		}
+		return newHoldResult(hold, balance), nil
+	})
+}
+
+func handleRelease(req *jsonRpc) (interface{}, *jsonErr) {
+	return signedChange(req, holdMessage, func(pp *param, signer string, _ string) (interface{}, error) {
+		hold, err := core.Release(signer, pp.FileId, int64(pp.Hold))
+		if err != nil {
+			return nil, err
+		}
+		return newHoldResult(hold, nil), nil
+	})
+}
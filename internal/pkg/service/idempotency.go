@@ -0,0 +1,69 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/internal/pkg/core"
+	"kdc/pkg/reqsig"
+)
+
+// accepted is a signed request acceptOnce let through.
+type accepted struct {
+	requestKey string
+	signer     string
+	fileId     string
+	// idempotency key the request claimed, empty for none
+	idempotencyKey string
+}
+
+// fail returns the error reporting err. A request core rejected stays recorded, so that
+// it is not applied once its balance or privileges allow it, and its retries under its
+// idempotency key get the same error. One that failed before anything was decided, an
+// internal error or a settlement that could not be sent, is forgotten to be sent again.
+func (a *accepted) fail(err error) *jsonErr {
+	jErr := rpcError(err)
+	if internalErrorCode == jErr.Code || errors.Is(err, core.SyncTransactionErr) {
+		core.ForgetRequest(a.requestKey)
+		if "" != a.idempotencyKey {
+			core.ForgetIdempotent(a.signer, a.fileId, a.idempotencyKey)
+		}
+		return jErr
+	}
+	if "" != a.idempotencyKey {
+		encoded, err := json.Marshal(jErr)
+		if err == nil {
+			err = core.FailIdempotent(a.signer, a.fileId, a.idempotencyKey, string(encoded))
+		}
+		if err != nil {
+			chainLog.Errorf("unable to record the failure of idempotency key %s of %s: %s", a.idempotencyKey, a.signer, err)
+		}
+	}
+	return jErr
+}
+
+// done records result for the retries of the request and returns it.
+func (a *accepted) done(result interface{}) (interface{}, *jsonErr) {
+	if "" != a.idempotencyKey {
+		encoded, err := json.Marshal(result)
+		if err == nil {
+			err = core.CompleteIdempotent(a.signer, a.fileId, a.idempotencyKey, string(encoded))
+		}
+		if err != nil {
+			chainLog.Errorf("unable to record the result of idempotency key %s of %s: %s", a.idempotencyKey, a.signer, err)
+		}
+	}
+	return result, nil
+}
+
+// payloadOf identifies what msg asks for: its signed fields but the id and the expiry,
+// which change when a request is signed again to be retried.
+func payloadOf(msg *reqsig.Message) (string, error) {
+	fields := *msg
+	fields.Id, fields.Expiry = "", 0
+	digest, err := fields.Digest(reqsig.TypedData, requestDomain())
+	if err != nil {
+		return "", err
+	}
+	return hexutil.Encode(digest), nil
+}
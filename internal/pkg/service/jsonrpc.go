@@ -0,0 +1,252 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/labstack/echo"
+	"io/ioutil"
+	"kdc/internal/pkg/core"
+	"kdc/pkg/reqsig"
+	"math/big"
+	"net/http"
+)
+
+// json-rpc 2.0 error codes
+const (
+	parseErrorCode     = -32700
+	invalidRequestCode = -32600
+	methodNotFoundCode = -32601
+	invalidParamsCode  = -32602
+	internalErrorCode  = -32603
+)
+
+// kdc error codes, in the -32000 to -32099 range json-rpc 2.0 leaves to servers.
+// Keep docs/api.md in sync.
+const (
+	signatureErrorCode   = -32001
+	permissionErrorCode  = -32002
+	balanceErrorCode     = -32003
+	replayErrorCode      = -32004
+	expiryErrorCode      = -32005
+	settlementErrorCode  = -32006
+	limitErrorCode       = -32007
+	idempotencyErrorCode = -32008
+)
+
+var InvalidSignatureErr = errors.New("invalid signature")
+var UnrecoverableSignatureErr = errors.New("unable to recover public key")
+
+// errorCodes gives the kdc code of each sentinel. An error matching several sentinels
+// gets the code of the first one.
+var errorCodes = []struct {
+	sentinel error
+	code     int
+}{
+	{BadIdErr, invalidParamsCode},
+	{core.NoNegativeValueAllowedErr, invalidParamsCode},
+	{core.InvalidPrivilegeErr, invalidParamsCode},
+	{core.PrivilegeUnchangedErr, invalidParamsCode},
+	{core.NoSuchPrivilegeErr, invalidParamsCode},
+	{core.UnknownCapabilityErr, invalidParamsCode},
+	{core.InvalidLimitsErr, invalidParamsCode},
+	{core.InvalidDelegationErr, invalidParamsCode},
+	{core.InvalidAllowanceErr, invalidParamsCode},
+	{core.InvalidTransferErr, invalidParamsCode},
+	{core.NoSuchParticipantErr, invalidParamsCode},
+	{core.InvalidHoldErr, invalidParamsCode},
+	{core.NoSuchHoldErr, invalidParamsCode},
+	{core.HoldNotActiveErr, invalidParamsCode},
+	{core.InvalidReversalErr, invalidParamsCode},
+	{core.NoSuchSubtractErr, invalidParamsCode},
+	{core.FileClosedErr, invalidParamsCode},
+	{core.InvalidMetadataErr, invalidParamsCode},
+	{core.InvalidIdempotencyKeyErr, invalidParamsCode},
+	{reqsig.BadAddressErr, invalidParamsCode},
+	{reqsig.UnknownSchemeErr, invalidParamsCode},
+	{reqsig.BadSignatureErr, signatureErrorCode},
+	{InvalidSignatureErr, signatureErrorCode},
+	{UnrecoverableSignatureErr, signatureErrorCode},
+	{LegacySignatureErr, signatureErrorCode},
+	{core.NotOwnerErr, permissionErrorCode},
+	{core.NoPermissionErr, permissionErrorCode},
+	{core.EscalationErr, permissionErrorCode},
+	{core.NoDelegationErr, permissionErrorCode},
+	{core.InsufficientBalanceErr, balanceErrorCode},
+	{core.AmountLimitErr, limitErrorCode},
+	{core.DailyCapErr, limitErrorCode},
+	{core.DelegationCapErr, limitErrorCode},
+	{core.AllowanceExceededErr, limitErrorCode},
+	{core.HoldExceededErr, limitErrorCode},
+	{core.ReversalExceededErr, limitErrorCode},
+	{core.RequestReusedErr, replayErrorCode},
+	{core.IdempotencyKeyReusedErr, idempotencyErrorCode},
+	{core.IdempotencyKeyPendingErr, idempotencyErrorCode},
+	{MissingExpiryErr, expiryErrorCode},
+	{RequestExpiredErr, expiryErrorCode},
+	{ExpiryTooFarErr, expiryErrorCode},
+	{core.SyncTransactionErr, settlementErrorCode},
+}
+
+type jsonRpc struct {
+	JsonRpc string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	// absent for notifications
+	Id     json.RawMessage `json:"id,omitempty"`
+	Params json.RawMessage `json:"params"`
+	// the request as received, recorded with the operations it makes
+	raw json.RawMessage
+}
+
+type jsonResponse struct {
+	JsonRpc string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *jsonErr        `json:"error,omitempty"`
+	Id      json.RawMessage `json:"id"`
+}
+
+type jsonErr struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type rpcHandler func(req *jsonRpc) (interface{}, *jsonErr)
+
+func makeJsonError(code int, message string) *jsonErr {
+	return &jsonErr{Code: code, Message: message}
+}
+
+// rpcError returns the json-rpc error reporting err, with the kdc code of its sentinel.
+func rpcError(err error) *jsonErr {
+	for _, errorCode := range errorCodes {
+		if errors.Is(err, errorCode.sentinel) {
+			return makeJsonError(errorCode.code, err.Error())
+		}
+	}
+	return makeJsonError(internalErrorCode, err.Error())
+}
+
+var nullId = json.RawMessage("null")
+
+func (req *jsonRpc) isNotification() bool {
+	return nil == req.Id
+}
+
+// idString returns the id as signed by clients: a string id as is, a number as an
+// integer. A number that is not one is a BadIdErr, so that two ids never sign the same.
+func (req *jsonRpc) idString() (string, error) {
+	if req.isNotification() {
+		return "", nil
+	}
+	var id interface{}
+	decoder := json.NewDecoder(bytes.NewReader(req.Id))
+	decoder.UseNumber()
+	if err := decoder.Decode(&id); err != nil {
+		return "", BadIdErr
+	}
+	switch id.(type) {
+	case string:
+		return id.(string), nil
+	case json.Number:
+		number, ok := new(big.Rat).SetString(id.(json.Number).String())
+		if !ok || !number.IsInt() {
+			return "", BadIdErr
+		}
+		return number.Num().String(), nil
+	case nil:
+		return "", nil
+	default:
+		return "", BadIdErr
+	}
+}
+
+// bindParams decodes the params object of the request into v.
+func (req *jsonRpc) bindParams(v interface{}) *jsonErr {
+	if nil == req.Params || bytes.Equal(req.Params, nullId) {
+		return makeJsonError(invalidParamsCode, "missing params")
+	}
+	err := json.Unmarshal(req.Params, v)
+	if err != nil {
+		return makeJsonError(invalidParamsCode, "invalid params: "+err.Error())
+	}
+	return nil
+}
+
+// validate reports why req is not a json-rpc 2.0 request.
+func (req *jsonRpc) validate() *jsonErr {
+	if req.JsonRpc != "2.0" {
+		return makeJsonError(invalidRequestCode, "invalid request: jsonrpc must be \"2.0\"")
+	}
+	if "" == req.Method {
+		return makeJsonError(invalidRequestCode, "invalid request: missing method")
+	}
+	if _, err := req.idString(); err != nil {
+		return makeJsonError(invalidRequestCode, "invalid request: id must be a string, an integer or null")
+	}
+	return nil
+}
+
+// call runs one request and returns its response, nil for notifications.
+func call(raw json.RawMessage) *jsonResponse {
+	req := new(jsonRpc)
+	err := json.Unmarshal(raw, req)
+	if err != nil {
+		return &jsonResponse{JsonRpc: "2.0", Id: nullId, Error: makeJsonError(invalidRequestCode, "invalid request")}
+	}
+	req.raw = raw
+	response := &jsonResponse{JsonRpc: "2.0", Id: req.Id}
+	if nil == response.Id {
+		response.Id = nullId
+	}
+	if jErr := req.validate(); jErr != nil {
+		response.Error = jErr
+		return response
+	}
+	handler, ok := rpcMethods[req.Method]
+	if !ok {
+		response.Error = makeJsonError(methodNotFoundCode, "method not found: "+req.Method)
+	} else {
+		response.Result, response.Error = handler(req)
+	}
+	if req.isNotification() {
+		return nil
+	}
+	return response
+}
+
+// handle serves /api: a single request or a batch of them.
+func handle(c echo.Context) error {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return err
+	}
+	body = bytes.TrimSpace(body)
+	var batch []json.RawMessage
+	if len(body) > 0 && body[0] == '[' {
+		if err = json.Unmarshal(body, &batch); err != nil {
+			return c.JSON(http.StatusOK, &jsonResponse{JsonRpc: "2.0", Id: nullId, Error: makeJsonError(parseErrorCode, "parse error")})
+		}
+		if 0 == len(batch) {
+			return c.JSON(http.StatusOK, &jsonResponse{JsonRpc: "2.0", Id: nullId, Error: makeJsonError(invalidRequestCode, "empty batch")})
+		}
+		responses := make([]*jsonResponse, 0, len(batch))
+		for _, raw := range batch {
+			if response := call(raw); response != nil {
+				responses = append(responses, response)
+			}
+		}
+		if 0 == len(responses) {
+			return c.NoContent(http.StatusNoContent)
+		}
+		return c.JSON(http.StatusOK, responses)
+	}
+	if !json.Valid(body) {
+		return c.JSON(http.StatusOK, &jsonResponse{JsonRpc: "2.0", Id: nullId, Error: makeJsonError(parseErrorCode, "parse error")})
+	}
+	response := call(body)
+	if nil == response {
+		return c.NoContent(http.StatusNoContent)
+	}
+	return c.JSON(http.StatusOK, response)
+}
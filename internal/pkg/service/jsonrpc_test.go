@@ -0,0 +1,139 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"kdc/internal/pkg/core"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postApi(t *testing.T, url string, body string) (int, string) {
+	t.Helper()
+	response, err := http.Post(url+"/api", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	content, _ := ioutil.ReadAll(response.Body)
+	return response.StatusCode, string(content)
+}
+
+func TestJsonRpcErrors(t *testing.T) {
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	for _, test := range []struct {
+		body string
+		code int
+		id   string
+	}{
+		{`{"jsonrpc": "2.0", "method": "read", "id": 1`, parseErrorCode, "null"},
+		{`[{"jsonrpc": "2.0"`, parseErrorCode, "null"},
+		{`[]`, invalidRequestCode, "null"},
+		{`"read"`, invalidRequestCode, "null"},
+		{`{"jsonrpc": "1.0", "method": "read", "id": 1, "params": {}}`, invalidRequestCode, "1"},
+		{`{"jsonrpc": "2.0", "id": "a", "params": {}}`, invalidRequestCode, `"a"`},
+		{`{"jsonrpc": "2.0", "method": "read", "id": [1], "params": {}}`, invalidRequestCode, "[1]"},
+		{`{"jsonrpc": "2.0", "method": "mint", "id": 2, "params": {}}`, methodNotFoundCode, "2"},
+		{`{"jsonrpc": "2.0", "method": "read", "id": null, "params": "file1"}`, invalidParamsCode, "null"},
+		{`{"jsonrpc": "2.0", "method": "read", "id": 3}`, invalidParamsCode, "3"},
+		{`{"jsonrpc": "2.0", "method": "subtract", "id": 4, "params": {"fileId": "f", "signature": "00"}}`, invalidParamsCode, "4"},
+		{`{"jsonrpc": "2.0", "method": "read", "id": 5, "params": {"fileId": "f", "data": "0x01", "signature": "00"}}`, invalidParamsCode, "5"},
+		{`{"jsonrpc": "2.0", "method": "read", "id": 6, "params": {"fileId": "f", "data": "0x0000000000000000000000000000000000000001", "signature": "00"}}`, signatureErrorCode, "6"},
+	} {
+		status, body := postApi(t, api.URL, test.body)
+		var response struct {
+			Result interface{}     `json:"result"`
+			Error  *jsonErr        `json:"error"`
+			Id     json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(body), &response); err != nil || status != http.StatusOK {
+			t.Errorf("%s: status %d, body %s", test.body, status, body)
+			continue
+		}
+		if nil == response.Error || response.Error.Code != test.code || string(response.Id) != test.id {
+			t.Errorf("%s: expected code %d and id %s, got %s", test.body, test.code, test.id, body)
+		}
+		if nil != response.Result {
+			t.Errorf("%s: unexpected result in %s", test.body, body)
+		}
+	}
+}
+
+func TestJsonRpcBatch(t *testing.T) {
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	status, body := postApi(t, api.URL, `[
+		{"jsonrpc": "2.0", "method": "mint", "id": 1, "params": {}},
+		{"jsonrpc": "2.0", "method": "mint", "params": {}},
+		1,
+		{"jsonrpc": "2.0", "method": "read", "id": "b", "params": {}}
+	]`)
+	var responses []jsonResponse
+	if err := json.Unmarshal([]byte(body), &responses); err != nil || status != http.StatusOK {
+		t.Fatalf("status %d, body %s", status, body)
+	}
+	// the notification gets no response
+	if len(responses) != 3 {
+		t.Fatalf("expected 3 responses, got %s", body)
+	}
+	for i, expected := range []struct {
+		id   string
+		code int
+	}{{"1", methodNotFoundCode}, {"null", invalidRequestCode}, {`"b"`, invalidParamsCode}} {
+		if string(responses[i].Id) != expected.id || responses[i].Error.Code != expected.code {
+			t.Errorf("response %d: expected id %s and code %d, got %s", i, expected.id, expected.code, body)
+		}
+	}
+
+	status, body = postApi(t, api.URL, `[{"jsonrpc": "2.0", "method": "mint", "params": {}}]`)
+	if status != http.StatusNoContent || "" != body {
+		t.Errorf("expected no content for a batch of notifications, got %d %s", status, body)
+	}
+}
+
+func TestRpcError(t *testing.T) {
+	for err, code := range map[error]int{
+		core.InsufficientBalanceErr:                               balanceErrorCode,
+		core.NotOwnerErr:                                          permissionErrorCode,
+		RequestExpiredErr:                                         expiryErrorCode,
+		fmt.Errorf("%w: while settling", core.SyncTransactionErr): settlementErrorCode,
+		errors.New("disk full"):                                   internalErrorCode,
+	} {
+		jErr := rpcError(err)
+		if jErr.Code != code || jErr.Message != err.Error() {
+			t.Errorf("%s: got %d %s", err, jErr.Code, jErr.Message)
+		}
+	}
+	// the first sentinel in errorCodes decides
+	both := fmt.Errorf("%w: %w", core.InsufficientBalanceErr, core.NotOwnerErr)
+	for i := 0; i < 10; i++ {
+		if jErr := rpcError(both); jErr.Code != permissionErrorCode {
+			t.Fatalf("expected %d, got %d", permissionErrorCode, jErr.Code)
+		}
+	}
+}
+
+func TestIdString(t *testing.T) {
+	for raw, expected := range map[string]string{`"a1"`: "a1", `12`: "12", `2.0`: "2", `1e3`: "1000",
+		`18446744073709551617`: "18446744073709551617", `null`: ""} {
+		req := &jsonRpc{Id: json.RawMessage(raw)}
+		if id, err := req.idString(); err != nil || id != expected {
+			t.Errorf("%s: expected %s, got %s, %v", raw, expected, id, err)
+		}
+	}
+	// fractions would be signed as another id
+	for _, raw := range []string{`1.5`, `1e-3`, `true`, `{}`} {
+		req := &jsonRpc{JsonRpc: "2.0", Method: "subtract", Id: json.RawMessage(raw)}
+		if _, err := req.idString(); err != BadIdErr {
+			t.Errorf("%s: expected %v, got %v", raw, BadIdErr, err)
+		}
+		if jErr := req.validate(); nil == jErr || jErr.Code != invalidRequestCode {
+			t.Errorf("%s: expected an invalid request, got %v", raw, jErr)
+		}
+	}
+}
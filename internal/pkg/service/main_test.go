@@ -0,0 +1,22 @@
+package service
+
+import (
+	"io/ioutil"
+	"kdc/internal/pkg/core"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "kdc-service")
+	if err != nil {
+		panic(err)
+	}
+	err = core.OpenDatabase(dir)
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
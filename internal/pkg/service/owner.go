@@ -0,0 +1,103 @@
+package service
+
+import (
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/internal/pkg/core"
+	"kdc/pkg/reqsig"
+	"math/big"
+)
+
+type limitsResult struct {
+	ValidFrom  int64        `json:"validFrom,omitempty"`
+	ValidUntil int64        `json:"validUntil,omitempty"`
+	MaxAmount  *hexutil.Big `json:"maxAmount,omitempty"`
+	DailyCap   *hexutil.Big `json:"dailyCap,omitempty"`
+}
+
+type privilegeEventResult struct {
+	User      string `json:"user"`
+	Action    string `json:"action"`
+	Privilege string `json:"privilege"`
+	limitsResult
+	Previous  string `json:"previous"`
+	Actor     string `json:"actor"`
+	Signature string `json:"signature,omitempty"`
+	Time      int64  `json:"time"`
+}
+
+func newLimitsResult(limits *core.PrivilegeLimitsT) limitsResult {
+	return limitsResult{limits.ValidFrom, limits.ValidUntil, (*hexutil.Big)(limits.MaxAmount), (*hexutil.Big)(limits.DailyCap)}
+}
+
+func newPrivilegeEventResult(event *core.PrivilegeEventT) privilegeEventResult {
+	return privilegeEventResult{
+		User:         event.User,
+		Action:       event.Action,
+		Privilege:    event.Privilege.String(),
+		limitsResult: newLimitsResult(&event.Limits),
+		Previous:     event.Previous.String(),
+		Actor:        event.Actor,
+		Signature:    event.Signature,
+		Time:         event.CreateTime,
+	}
+}
+
+// nonZero returns the amount limit of a request, nil for none.
+func nonZero(amount *hexutil.Big) *big.Int {
+	if nil == amount || amount.ToInt().Sign() == 0 {
+		return nil
+	}
+	return amount.ToInt()
+}
+
+// privilegeMessage builds the signed message of a privilege change.
+func privilegeMessage(method string, pp *param) (*reqsig.Message, *jsonErr) {
+	return &reqsig.Message{Method: method, FileId: pp.FileId, User: pp.Data, Privilege: pp.Privilege, Expiry: pp.Expiry,
+		ValidFrom: pp.ValidFrom, ValidUntil: pp.ValidUntil, MaxAmount: pp.MaxAmount.ToInt(), DailyCap: pp.DailyCap.ToInt()}, nil
+}
+
+func handleGrantPrivilege(req *jsonRpc) (interface{}, *jsonErr) {
+	return signedChange(req, privilegeMessage, func(pp *param, signer string, user string) (interface{}, error) {
+		privilege, err := core.ParseCapability(pp.Privilege)
+		if err != nil {
+			return nil, err
+		}
+		limits := &core.PrivilegeLimitsT{
+			ValidFrom:  int64(pp.ValidFrom),
+			ValidUntil: int64(pp.ValidUntil),
+			MaxAmount:  nonZero(pp.MaxAmount),
+			DailyCap:   nonZero(pp.DailyCap),
+		}
+		event, err := core.GrantPrivilege(signer, pp.FileId, user, privilege, limits, pp.Signature)
+		if err != nil {
+			return nil, err
+		}
+		return newPrivilegeEventResult(event), nil
+	})
+}
+
+func handleRevokePrivilege(req *jsonRpc) (interface{}, *jsonErr) {
+	return signedChange(req, privilegeMessage, func(pp *param, signer string, user string) (interface{}, error) {
+		event, err := core.RevokePrivilege(signer, pp.FileId, user, pp.Signature)
+		if err != nil {
+			return nil, err
+		}
+		return newPrivilegeEventResult(event), nil
+	})
+}
+
+func handleListPrivilegeEvents(req *jsonRpc) (interface{}, *jsonErr) {
+	pp, signer, jErr := signedQuery(req)
+	if jErr != nil {
+		return nil, jErr
+	}
+	events, err := core.ListPrivilegeEvents(signer, pp.FileId)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	result := []privilegeEventResult{}
+	for i := range events {
+		result = append(result, newPrivilegeEventResult(&events[i]))
+	}
+	return result, nil
+}
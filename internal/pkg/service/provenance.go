@@ -0,0 +1,163 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/internal/pkg/core"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// MortgageProvenanceT records which chain transaction a file was initialised from.
+// It is stored in the originjson column of fileIndex.
+type MortgageProvenanceT struct {
+	TxHash      string `json:"txHash"`
+	BlockNumber string `json:"blockNumber"`
+	From        string `json:"from"`
+	Value       string `json:"value"`
+}
+
+type mortgageInitTxInput struct {
+	Type                      string    `json:"type"`
+	SpecialTxTypeMortgageInit InitFileT `json:"specialTxTypeMortgageInit"`
+	// top-up of a deposit transaction, fromAccount defaulting to its signer
+	SpecialTxTypeMortgageDeposit InitFileT `json:"specialTxTypeMortgageDeposit"`
+}
+
+// depositTxT is a deposit transaction with the top-up it carries.
+type depositTxT struct {
+	tx    *RpcTransactionT
+	event InitFileT
+}
+
+var OriginTxNotFoundErr = errors.New("originating transaction not found")
+var SignerMismatchErr = errors.New("fromAccount is not the transaction signer")
+var LockedValueMismatchErr = errors.New("mortgage total does not match locked value")
+
+var BlockNotLoadedErr = errors.New("block could not be loaded")
+
+// blocksToScan returns the blocks in [start, end] that findSpecialTxs has to load for
+// inits: the blocks the node reported them in. Deposits have no event, so every block
+// is scanned when they are ingested, as well as when an init has no block number.
+func blocksToScan(start, end uint64, inits []InitFileT) []uint64 {
+	var all []uint64
+	for num := start; num <= end; num++ {
+		all = append(all, num)
+	}
+	if "" != conf.Chain.DepositTransactionType {
+		return all
+	}
+	seen := make(map[uint64]bool)
+	var blocks []uint64
+	for _, init := range inits {
+		num, err := hexutil.DecodeUint64(init.BlockNumber)
+		if err != nil || num < start || num > end {
+			return all
+		}
+		if !seen[num] {
+			seen[num] = true
+			blocks = append(blocks, num)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	return blocks
+}
+
+// findSpecialTxs loads the blocks for the special transactions sent to the special
+// account. It returns the mortgage inits indexed by file id and the deposits in chain
+// order, or an error as soon as a block cannot be loaded.
+func findSpecialTxs(blocks []uint64) (map[string]*RpcTransactionT, []depositTxT, error) {
+	txs := make(map[string]*RpcTransactionT)
+	var deposits []depositTxT
+	for _, num := range blocks {
+		block := GetBlockByNumber(hexutil.EncodeUint64(num))
+		if nil == block {
+			return nil, nil, fmt.Errorf("%s: %s", BlockNotLoadedErr, hexutil.EncodeUint64(num))
+		}
+		for i := range block.Transactions {
+			tx := &block.Transactions[i]
+			if !strings.EqualFold(tx.To, conf.Chain.SpecialAccount) {
+				continue
+			}
+			input, err := decodeMortgageInitTxInput(tx.ExtraData)
+			if err != nil {
+				continue
+			}
+			switch {
+			case input.Type == conf.Chain.MortgageInitTransactionType:
+				txs[input.SpecialTxTypeMortgageInit.FileID] = tx
+			case "" != conf.Chain.DepositTransactionType && input.Type == conf.Chain.DepositTransactionType:
+				deposits = append(deposits, depositTxT{tx, input.SpecialTxTypeMortgageDeposit})
+			}
+		}
+	}
+	return txs, deposits, nil
+}
+
+// decodeMortgageInitTxInput accepts extraData either as the raw json or hex encoded.
+func decodeMortgageInitTxInput(extraData string) (*mortgageInitTxInput, error) {
+	var input mortgageInitTxInput
+	raw := []byte(extraData)
+	if strings.HasPrefix(extraData, "0x") {
+		decoded, err := hexutil.Decode(extraData)
+		if err != nil {
+			return nil, err
+		}
+		raw = decoded
+	}
+	err := json.Unmarshal(raw, &input)
+	if err != nil {
+		return nil, err
+	}
+	return &input, nil
+}
+
+// validateMortgageInit checks an InitFileT returned by the node against the
+// transaction that created it: the signer must be the fromAccount and the mortgage
+// amounts must add up to the value the transaction locked.
+func validateMortgageInit(event *InitFileT, tx *RpcTransactionT) (*MortgageProvenanceT, error) {
+	if nil == tx {
+		return nil, OriginTxNotFoundErr
+	}
+	if !strings.EqualFold(tx.From, event.FromAccount) {
+		return nil, fmt.Errorf("%s: signer %s, fromAccount %s", SignerMismatchErr, tx.From, event.FromAccount)
+	}
+	locked, err := hexutil.DecodeBig(tx.Value)
+	if err != nil {
+		return nil, fmt.Errorf("bad transaction value %s: %s", tx.Value, err)
+	}
+	total := big.NewInt(0)
+	for _, amount := range event.MortgageTable {
+		if nil == amount || amount.ToInt().Sign() < 0 {
+			return nil, LockedValueMismatchErr
+		}
+		total.Add(total, amount.ToInt())
+	}
+	if total.Cmp(locked) != 0 {
+		return nil, fmt.Errorf("%s: mortgage %s, locked %s", LockedValueMismatchErr, hexutil.EncodeBig(total), tx.Value)
+	}
+	provenance := &MortgageProvenanceT{
+		TxHash:      tx.Hash,
+		BlockNumber: tx.BlockNumber,
+		From:        tx.From,
+		Value:       tx.Value,
+	}
+	return provenance, nil
+}
+
+// validateDeposit checks a deposit like a mortgage init, against the transaction that
+// carries it.
+func validateDeposit(deposit *depositTxT) (*core.DepositT, error) {
+	event := deposit.event
+	if "" == event.FromAccount && nil != deposit.tx {
+		event.FromAccount = deposit.tx.From
+	}
+	provenance, err := validateMortgageInit(&event, deposit.tx)
+	if err != nil {
+		return nil, err
+	}
+	return &core.DepositT{TxHash: provenance.TxHash, FileId: event.FileID, From: event.FromAccount, BlockNumber: provenance.BlockNumber}, nil
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"io/ioutil"
+	"kdc/internal/pkg/core"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateMortgageInit(t *testing.T) {
+	event := &InitFileT{
+		FileID:      "file1",
+		FromAccount: "0xAF7A12DE8DC1DE25C0541966695498074F52A1CC",
+		MortgageTable: map[string]*hexutil.Big{
+			"0xa": (*hexutil.Big)(big.NewInt(0x10)),
+			"0xb": (*hexutil.Big)(big.NewInt(0x20)),
+		},
+	}
+	tx := &RpcTransactionT{
+		Hash:        "0xhash",
+		BlockNumber: "0x10",
+		From:        "0xaf7a12de8dc1de25c0541966695498074f52a1cc",
+		Value:       "0x30",
+	}
+	provenance, err := validateMortgageInit(event, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provenance.TxHash != "0xhash" || provenance.BlockNumber != "0x10" {
+		t.Errorf("unexpected provenance %v", provenance)
+	}
+
+	if _, err = validateMortgageInit(event, nil); err != OriginTxNotFoundErr {
+		t.Errorf("expected %s, got %v", OriginTxNotFoundErr, err)
+	}
+	tx.Value = "0x31"
+	if _, err = validateMortgageInit(event, tx); err == nil {
+		t.Error("expected locked value mismatch")
+	}
+	tx.Value = "0x30"
+	tx.From = "0x92fb6a50a6817d19b1cb47bdc55a687add4ea21a"
+	if _, err = validateMortgageInit(event, tx); err == nil {
+		t.Error("expected signer mismatch")
+	}
+}
+
+func TestDecodeMortgageInitTxInput(t *testing.T) {
+	raw := `{"type":"0x4","specialTxTypeMortgageInit":{"fileID":"file1","fromAccount":"0xa"}}`
+	for _, extraData := range []string{raw, hexutil.Encode([]byte(raw))} {
+		input, err := decodeMortgageInitTxInput(extraData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if input.Type != "0x4" || input.SpecialTxTypeMortgageInit.FileID != "file1" {
+			t.Errorf("unexpected input %v", input)
+		}
+	}
+}
+
+func TestIngestDeposits(t *testing.T) {
+	fileId := "depositingestfile1"
+	owner := "0xaf7a12de8dc1de25c0541966695498074f52a1cc"
+	err := core.InitFile(owner, fileId, "", &core.AllowTableT{"0xa": 2}, &core.MortgageTableT{"0xa": *big.NewInt(0x10)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deposit := func(hash string, from string, value string, payload string) RpcTransactionT {
+		extraData := `{"type":"0x5","specialTxTypeMortgageDeposit":` + payload + `}`
+		return RpcTransactionT{Hash: hash, BlockNumber: "0x1", From: from, To: conf.Chain.SpecialAccount, Value: value, ExtraData: extraData}
+	}
+	block := RpcBlockT{Number: "0x1", Transactions: []RpcTransactionT{
+		deposit("0xd1", owner, "0x30", `{"fileID":"`+fileId+`","mortgage":{"0xa":"0x10","0xb":"0x20"},"authority":{"0xb":2}}`),
+		// the locked value does not match the top-up
+		deposit("0xd2", owner, "0x1", `{"fileID":"`+fileId+`","mortgage":{"0xa":"0x10"}}`),
+		// a top-up by another account, which cannot add participants
+		deposit("0xd3", "0x92fb6a50a6817d19b1cb47bdc55a687add4ea21a", "0x5", `{"fileID":"`+fileId+`","mortgage":{"0xa":"0x5"}}`),
+		deposit("0xd4", "0x92fb6a50a6817d19b1cb47bdc55a687add4ea21a", "0x5", `{"fileID":"`+fileId+`","mortgage":{"0xc":"0x5"},"authority":{"0xc":2}}`),
+	}}
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var parameter EthCallParameter
+		json.Unmarshal(body, &parameter)
+		switch parameter.Method {
+		case "eth_getBlockByNumber":
+			result, _ := json.Marshal(GetBlockByNumberResult{Id: 1, Jsonrpc: "2.0", Result: &block})
+			w.Write(result)
+		default:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":[]}`))
+		}
+	}))
+	defer node.Close()
+	oldConf := *conf
+	defer func() { *conf = oldConf }()
+	conf.Chain.Url = node.URL
+	conf.Chain.DepositTransactionType = "0x5"
+
+	// ingesting the block twice applies its deposits once
+	for i := 0; i < 2; i++ {
+		if _, err = IngestBlockRange("0x1", "0x1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remain, err := core.RemainMortgage(fileId)
+	if err != nil || len(*remain) != 2 || (*remain)["0xa"] != "0x25" || (*remain)["0xb"] != "0x20" {
+		t.Errorf("unexpected balances %v, %v", remain, err)
+	}
+	deposits, err := core.ListDeposits(fileId)
+	if err != nil || len(deposits) != 2 || deposits[0].TxHash != "0xd1" || deposits[0].From != owner || deposits[1].TxHash != "0xd3" {
+		t.Errorf("unexpected deposits %+v, %v", deposits, err)
+	}
+}
+
+func TestIngestLoadsInitBlocks(t *testing.T) {
+	fileId := "blockingestfile1"
+	owner := "0xaf7a12de8dc1de25c0541966695498074f52a1cc"
+	extraData := `{"type":"` + conf.Chain.MortgageInitTransactionType + `","specialTxTypeMortgageInit":{"fileID":"` + fileId + `"}}`
+	block := RpcBlockT{Number: "0x3", Transactions: []RpcTransactionT{
+		{Hash: "0xi1", BlockNumber: "0x3", From: owner, To: conf.Chain.SpecialAccount, Value: "0x10", ExtraData: extraData},
+	}}
+	var loaded []string
+	loads := true
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var parameter EthCallParameter
+		json.Unmarshal(body, &parameter)
+		switch parameter.Method {
+		case "eth_getMortgageInitByBlockNumberRange":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":[{"fileID":"` + fileId + `","fromAccount":"` + owner + `","mortgage":{"0xa":"0x10"},"blockNumber":"0x3"}]}`))
+		case "eth_getBlockByNumber":
+			loaded = append(loaded, parameter.Params[0].(string))
+			if !loads {
+				w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":null}`))
+				return
+			}
+			result, _ := json.Marshal(GetBlockByNumberResult{Id: 1, Jsonrpc: "2.0", Result: &block})
+			w.Write(result)
+		case "eth_blockNumber":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x5"}`))
+		}
+	}))
+	defer node.Close()
+	oldConf := *conf
+	defer func() { *conf = oldConf }()
+	conf.Chain.Url = node.URL
+	conf.Chain.StartBlock = "0x1"
+	conf.Chain.DepositTransactionType = ""
+
+	// a block that cannot be loaded stops the ingestion where it was
+	loads = false
+	if _, err := IngestNewBlocks(); err == nil {
+		t.Fatal("expected an error for the block that cannot be loaded")
+	}
+	if last, _ := core.GetSyncState(lastBlockState); "" != last {
+		t.Errorf("expected the ingestion not to move past the block, got %s", last)
+	}
+	loads = true
+	loaded = nil
+	created, err := IngestNewBlocks()
+	if err != nil || created != 1 {
+		t.Fatalf("created %d files, %v", created, err)
+	}
+	if len(loaded) != 1 || loaded[0] != "0x3" {
+		t.Errorf("expected only the block of the init to be loaded, got %v", loaded)
+	}
+	if last, _ := core.GetSyncState(lastBlockState); "0x5" != last {
+		t.Errorf("expected the ingestion to reach 0x5, got %s", last)
+	}
+}
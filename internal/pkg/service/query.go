@@ -0,0 +1,196 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/internal/pkg/core"
+	"kdc/pkg/reqsig"
+)
+
+type fileResult struct {
+	FileId     string `json:"fileId"`
+	Owner      string `json:"owner"`
+	State      string `json:"state"`
+	StartTime  int64  `json:"startTime"`
+	EndTime    int64  `json:"endTime"`
+	CreateTime int64  `json:"createTime"`
+	// privilege of the signer, in listMyFiles
+	Privilege string `json:"privilege,omitempty"`
+}
+
+type settlementResult struct {
+	TxHash     string `json:"txHash"`
+	Terminate  bool   `json:"terminate"`
+	Chunk      int    `json:"chunk"`
+	ChunkCount int    `json:"chunkCount"`
+	Status     string `json:"status"`
+	CreateTime int64  `json:"createTime"`
+}
+
+type fileInfoResult struct {
+	fileResult
+	Settlements []settlementResult `json:"settlements"`
+}
+
+type participantResult struct {
+	User      string `json:"user"`
+	Privilege string `json:"privilege"`
+	limitsResult
+	Balance string `json:"balance"`
+	Held    string `json:"held"`
+}
+
+type operationResult struct {
+	Id        int64  `json:"id"`
+	User      string `json:"user"`
+	Operation string `json:"operation"`
+	Value     string `json:"value"`
+	Time      int64  `json:"time"`
+	// id of the subtract a reversal reverses
+	Reverses int64 `json:"reverses,omitempty"`
+	// what is known of the request the operation was made by, the request itself with details
+	Reference string          `json:"reference,omitempty"`
+	Memo      string          `json:"memo,omitempty"`
+	Signer    string          `json:"signer,omitempty"`
+	RequestId string          `json:"requestId,omitempty"`
+	Request   json.RawMessage `json:"request,omitempty"`
+}
+
+type operationsResult struct {
+	Operations []operationResult `json:"operations"`
+	Total      int               `json:"total"`
+	Offset     uint64            `json:"offset"`
+	Limit      int               `json:"limit"`
+}
+
+func newFileResult(file *core.FileInfoT) fileResult {
+	state := file.State
+	if "" == state {
+		state = "open"
+		if !file.IsOpen {
+			state = "terminated"
+		}
+	}
+	return fileResult{
+		FileId:     file.FileId,
+		Owner:      file.Owner,
+		State:      state,
+		StartTime:  file.StartTime,
+		EndTime:    file.EndTime,
+		CreateTime: file.CreateTime,
+	}
+}
+
+// signedQuery binds the params of a read-only request and recovers its signer.
+func signedQuery(req *jsonRpc) (*param, string, *jsonErr) {
+	pp := new(param)
+	if jErr := req.bindParams(pp); jErr != nil {
+		return nil, "", jErr
+	}
+	reqId, err := req.idString()
+	if err != nil {
+		return nil, "", rpcError(err)
+	}
+	msg := &reqsig.Message{Method: req.Method, Id: reqId, FileId: pp.FileId, User: pp.Data,
+		From: pp.From, To: pp.To, Offset: pp.Offset, Limit: pp.Limit}
+	signer, _, jErr := recoverSigner(pp, msg)
+	if jErr != nil {
+		return nil, "", jErr
+	}
+	return pp, signer, nil
+}
+
+func handleGetFileInfo(req *jsonRpc) (interface{}, *jsonErr) {
+	pp, signer, jErr := signedQuery(req)
+	if jErr != nil {
+		return nil, jErr
+	}
+	info, settlements, err := core.FileStatus(signer, pp.FileId)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	result := fileInfoResult{fileResult: newFileResult(info), Settlements: []settlementResult{}}
+	for _, s := range settlements {
+		result.Settlements = append(result.Settlements, settlementResult{s.TxHash, s.Terminate, s.Chunk, s.ChunkCount, s.Status, s.CreateTime})
+	}
+	return result, nil
+}
+
+func handleListParticipants(req *jsonRpc) (interface{}, *jsonErr) {
+	pp, signer, jErr := signedQuery(req)
+	if jErr != nil {
+		return nil, jErr
+	}
+	participants, err := core.ListParticipants(signer, pp.FileId)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	result := []participantResult{}
+	for _, p := range participants {
+		result = append(result, participantResult{p.User, p.Privilege.String(), newLimitsResult(&p.Limits), hexutil.EncodeBig(p.Balance), hexutil.EncodeBig(p.Held)})
+	}
+	return result, nil
+}
+
+func handleListEarnings(req *jsonRpc) (interface{}, *jsonErr) {
+	pp, signer, jErr := signedQuery(req)
+	if jErr != nil {
+		return nil, jErr
+	}
+	earnings, err := core.ListEarnings(signer, pp.FileId)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return earnings, nil
+}
+
+func handleListOperations(req *jsonRpc) (interface{}, *jsonErr) {
+	pp, signer, jErr := signedQuery(req)
+	if jErr != nil {
+		return nil, jErr
+	}
+	filter := core.OperationFilterT{
+		User:   pp.Data,
+		From:   int64(pp.From),
+		To:     int64(pp.To),
+		Offset: int(pp.Offset),
+		Limit:  int(pp.Limit),
+	}
+	if filter.Limit <= 0 || filter.Limit > core.MaxOperationsPage {
+		filter.Limit = core.MaxOperationsPage
+	}
+	operations, total, err := core.ListOperations(signer, pp.FileId, filter)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	result := operationsResult{Operations: []operationResult{}, Total: total, Offset: pp.Offset, Limit: filter.Limit}
+	for _, o := range operations {
+		operation := operationResult{Id: o.Id, User: o.User, Operation: o.Operation, Value: o.Value, Time: o.CreateTime, Reverses: o.Reverses}
+		if nil != o.Meta {
+			operation.Reference, operation.Memo, operation.Signer, operation.RequestId = o.Meta.Reference, o.Meta.Memo, o.Meta.Signer, o.Meta.RequestId
+			if pp.Details && "" != o.Meta.Request {
+				operation.Request = json.RawMessage(o.Meta.Request)
+			}
+		}
+		result.Operations = append(result.Operations, operation)
+	}
+	return result, nil
+}
+
+func handleListMyFiles(req *jsonRpc) (interface{}, *jsonErr) {
+	_, signer, jErr := signedQuery(req)
+	if jErr != nil {
+		return nil, jErr
+	}
+	files, err := core.ListFilesForUser(signer)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	result := []fileResult{}
+	for i := range files {
+		file := newFileResult(&files[i].FileInfoT)
+		file.Privilege = files[i].Privilege.String()
+		result = append(result, file)
+	}
+	return result, nil
+}
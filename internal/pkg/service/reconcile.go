@@ -0,0 +1,262 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"io"
+	"kdc/internal/pkg/core"
+	"sort"
+	"strings"
+)
+
+type MismatchKindT string
+
+const (
+	// file was initialised on chain but kdc never ingested it
+	MissingLocal MismatchKindT = "missing_local"
+	// file exists in the local ledger but no InitFileT event was found
+	MissingChain   MismatchKindT = "missing_chain"
+	OwnerMismatch  MismatchKindT = "owner_mismatch"
+	AmountMismatch MismatchKindT = "amount_mismatch"
+	// the chain closed the file while kdc still accepts operations on it
+	SettledOnChainOpenLocally MismatchKindT = "settled_on_chain_open_locally"
+	// kdc terminated the file but the chain never applied a settlement
+	ClosedLocallyOpenOnChain MismatchKindT = "closed_locally_open_on_chain"
+	// kdc terminated the file and its settlement is not mined yet
+	SettlementPending MismatchKindT = "settlement_pending"
+	// a recorded sync transaction was mined with a failure status
+	SettlementFailed MismatchKindT = "settlement_failed"
+)
+
+type Mismatch struct {
+	Kind   MismatchKindT `json:"kind"`
+	FileID string        `json:"fileID"`
+	User   string        `json:"user,omitempty"`
+	Chain  string        `json:"chain,omitempty"`
+	Local  string        `json:"local,omitempty"`
+	TxHash string        `json:"txHash,omitempty"`
+}
+
+type ReconcileReport struct {
+	StartBlock string     `json:"startBlock"`
+	EndBlock   string     `json:"endBlock"`
+	ChainFiles int        `json:"chainFiles"`
+	LocalFiles int        `json:"localFiles"`
+	Mismatches []Mismatch `json:"mismatches"`
+}
+
+// localFileT is everything the reconciler needs to know about one file of the local ledger.
+type localFileT struct {
+	info        core.FileInfoT
+	mortgage    core.MortgageTableT
+	settlements []core.SettlementT
+}
+
+// chainStateT is what the chain says about files beyond their InitFileT events.
+type chainStateT struct {
+	// closed[fileId] is true when the chain reports the file as settled
+	closed map[string]bool
+	// receipts[txHash] is nil while the sync transaction is not mined
+	receipts map[string]*TransactionReceiptT
+}
+
+// Reconcile compares the files initialised on chain since startNum with the local
+// ledger and reports every disagreement between them.
+func Reconcile(startNum string) (*ReconcileReport, error) {
+	endNum := GetBlockNumber()
+	if "0x0" == endNum {
+		return nil, fmt.Errorf("unable to get current block number from %s", conf.Chain.Url)
+	}
+	start, err := hexutil.DecodeUint64(startNum)
+	if err != nil {
+		return nil, err
+	}
+	end, err := hexutil.DecodeUint64(endNum)
+	if err != nil {
+		return nil, err
+	}
+	events, err := getMortgageInitByBlockRange(startNum, endNum)
+	if err != nil {
+		return nil, err
+	}
+	locals, err := loadLocalFiles(start, end)
+	if err != nil {
+		return nil, err
+	}
+	state := loadChainState(events, locals)
+	report := &ReconcileReport{
+		StartBlock: startNum,
+		EndBlock:   endNum,
+		ChainFiles: len(events),
+		LocalFiles: len(locals),
+		Mismatches: reconcileFiles(events, locals, state),
+	}
+	return report, nil
+}
+
+// WriteJSON writes the report in a form other tools can consume.
+func (r *ReconcileReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// loadLocalFiles returns the local files whose init transaction was mined in [start, end].
+func loadLocalFiles(start, end uint64) ([]localFileT, error) {
+	files, err := core.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+	var locals []localFileT
+	for _, file := range files {
+		if !initInRange(file, start, end) {
+			continue
+		}
+		mortgage, err := core.InitMortgage(file.FileId)
+		if err != nil {
+			return nil, err
+		}
+		settlements, err := core.ListSettlements(file.FileId)
+		if err != nil {
+			return nil, err
+		}
+		locals = append(locals, localFileT{file, *mortgage, settlements})
+	}
+	return locals, nil
+}
+
+// initInRange tells whether the init of file, as recorded in its provenance, lies in
+// [start, end]. Files without a block number are only in range of a scan from genesis.
+func initInRange(file core.FileInfoT, start, end uint64) bool {
+	var provenance MortgageProvenanceT
+	if err := json.Unmarshal([]byte(file.OriginJson), &provenance); err != nil {
+		return 0 == start
+	}
+	num, err := hexutil.DecodeUint64(provenance.BlockNumber)
+	if err != nil {
+		return 0 == start
+	}
+	return num >= start && num <= end
+}
+
+func loadChainState(events []InitFileT, locals []localFileT) *chainStateT {
+	state := &chainStateT{
+		closed:   make(map[string]bool),
+		receipts: make(map[string]*TransactionReceiptT),
+	}
+	addressAndFileID := make(map[string]FileIDT)
+	for _, event := range events {
+		addressAndFileID[event.FromAccount] = append(addressAndFileID[event.FromAccount], event.FileID)
+	}
+	for _, local := range locals {
+		addressAndFileID[local.info.Owner] = append(addressAndFileID[local.info.Owner], local.info.FileId)
+		for _, settlement := range local.settlements {
+			if "" == settlement.TxHash {
+				continue
+			}
+			state.receipts[settlement.TxHash] = GetTransactionReceipt(settlement.TxHash)
+		}
+	}
+	if len(addressAndFileID) > 0 {
+		for _, switches := range GetLogSwitchByAddressAndFileID(addressAndFileID) {
+			for fileId, closed := range switches {
+				state.closed[fileId] = state.closed[fileId] || closed
+			}
+		}
+	}
+	return state
+}
+
+func reconcileFiles(events []InitFileT, locals []localFileT, state *chainStateT) []Mismatch {
+	mismatches := []Mismatch{}
+	localById := make(map[string]*localFileT)
+	for i := range locals {
+		localById[locals[i].info.FileId] = &locals[i]
+	}
+	chainById := make(map[string]bool)
+	for _, event := range events {
+		chainById[event.FileID] = true
+		local, ok := localById[event.FileID]
+		if !ok {
+			mismatches = append(mismatches, Mismatch{Kind: MissingLocal, FileID: event.FileID, Chain: event.FromAccount})
+			continue
+		}
+		if !strings.EqualFold(event.FromAccount, local.info.Owner) {
+			mismatches = append(mismatches, Mismatch{Kind: OwnerMismatch, FileID: event.FileID,
+				Chain: event.FromAccount, Local: local.info.Owner})
+		}
+		mismatches = append(mismatches, compareMortgage(event, local.mortgage)...)
+	}
+	for _, local := range locals {
+		fileId := local.info.FileId
+		if !chainById[fileId] {
+			mismatches = append(mismatches, Mismatch{Kind: MissingChain, FileID: fileId, Local: local.info.Owner})
+		}
+		closed := state.closed[fileId]
+		if closed && local.info.IsOpen {
+			mismatches = append(mismatches, Mismatch{Kind: SettledOnChainOpenLocally, FileID: fileId})
+		}
+		var lastTx string
+		pending := false
+		for _, settlement := range local.settlements {
+			lastTx = settlement.TxHash
+			receipt := state.receipts[settlement.TxHash]
+			if receipt != nil && receipt.Status == "0x0" {
+				mismatches = append(mismatches, Mismatch{Kind: SettlementFailed, FileID: fileId,
+					TxHash: settlement.TxHash, Chain: receipt.BlockNumber})
+			}
+			if core.SettlementStatusUnsent == settlement.Status ||
+				(core.SettlementStatusPending == settlement.Status && nil == receipt) {
+				pending = true
+			}
+		}
+		if !closed && !local.info.IsOpen {
+			kind := ClosedLocallyOpenOnChain
+			if pending {
+				kind = SettlementPending
+			}
+			mismatches = append(mismatches, Mismatch{Kind: kind, FileID: fileId, TxHash: lastTx})
+		}
+	}
+	sort.SliceStable(mismatches, func(i, j int) bool {
+		if mismatches[i].FileID != mismatches[j].FileID {
+			return mismatches[i].FileID < mismatches[j].FileID
+		}
+		if mismatches[i].Kind != mismatches[j].Kind {
+			return mismatches[i].Kind < mismatches[j].Kind
+		}
+		return mismatches[i].User < mismatches[j].User
+	})
+	return mismatches
+}
+
+// compareMortgage reports users whose funded amount on chain differs from the init value in the ledger.
+func compareMortgage(event InitFileT, local core.MortgageTableT) []Mismatch {
+	var mismatches []Mismatch
+	localAmounts := make(map[string]string)
+	for user, amount := range local {
+		localAmounts[strings.ToLower(user)] = hexutil.EncodeBig(&amount)
+	}
+	seen := make(map[string]bool)
+	for user, amount := range event.MortgageTable {
+		key := strings.ToLower(user)
+		seen[key] = true
+		chainAmount := "0x0"
+		if amount != nil {
+			chainAmount = amount.String()
+		}
+		localAmount := localAmounts[key]
+		if chainAmount != localAmount {
+			mismatches = append(mismatches, Mismatch{Kind: AmountMismatch, FileID: event.FileID,
+				User: user, Chain: chainAmount, Local: localAmount})
+		}
+	}
+	for user, localAmount := range localAmounts {
+		if !seen[user] {
+			mismatches = append(mismatches, Mismatch{Kind: AmountMismatch, FileID: event.FileID,
+				User: user, Local: localAmount})
+		}
+	}
+	return mismatches
+}
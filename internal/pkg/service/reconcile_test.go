@@ -0,0 +1,75 @@
+package service
+
+import (
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/internal/pkg/core"
+	"math/big"
+	"testing"
+)
+
+func TestReconcileFiles(t *testing.T) {
+	events := []InitFileT{
+		{
+			FileID:        "file1",
+			FromAccount:   "0xowner",
+			MortgageTable: map[string]*hexutil.Big{"0xA": (*hexutil.Big)(big.NewInt(10)), "0xb": (*hexutil.Big)(big.NewInt(20))},
+		},
+		{FileID: "file2", FromAccount: "0xowner"},
+	}
+	locals := []localFileT{
+		{
+			info:     core.FileInfoT{FileId: "file1", Owner: "0xOWNER", IsOpen: true},
+			mortgage: core.MortgageTableT{"0xa": *big.NewInt(10), "0xb": *big.NewInt(21)},
+		},
+		{
+			info:        core.FileInfoT{FileId: "file3", Owner: "0xowner", IsOpen: false},
+			mortgage:    core.MortgageTableT{},
+			settlements: []core.SettlementT{{FileId: "file3", TxHash: "0xtx"}},
+		},
+		{
+			info:     core.FileInfoT{FileId: "file4", Owner: "0xowner", IsOpen: false},
+			mortgage: core.MortgageTableT{},
+			settlements: []core.SettlementT{
+				{FileId: "file4", TxHash: "0xsent", Chunk: 0, ChunkCount: 2, Status: core.SettlementStatusPending},
+				{FileId: "file4", Chunk: 1, ChunkCount: 2, Status: core.SettlementStatusUnsent},
+			},
+		},
+	}
+	state := &chainStateT{
+		closed:   map[string]bool{"file1": true},
+		receipts: map[string]*TransactionReceiptT{"0xtx": {TransactionHash: "0xtx", Status: "0x0"}},
+	}
+	mismatches := reconcileFiles(events, locals, state)
+	expected := []Mismatch{
+		{Kind: AmountMismatch, FileID: "file1", User: "0xb", Chain: "0x14", Local: "0x15"},
+		{Kind: SettledOnChainOpenLocally, FileID: "file1"},
+		{Kind: MissingLocal, FileID: "file2", Chain: "0xowner"},
+		{Kind: ClosedLocallyOpenOnChain, FileID: "file3", TxHash: "0xtx"},
+		{Kind: MissingChain, FileID: "file3", Local: "0xowner"},
+		{Kind: SettlementFailed, FileID: "file3", TxHash: "0xtx"},
+		{Kind: MissingChain, FileID: "file4", Local: "0xowner"},
+		{Kind: SettlementPending, FileID: "file4"},
+	}
+	if len(mismatches) != len(expected) {
+		t.Fatalf("expected %d mismatches, got %d: %v", len(expected), len(mismatches), mismatches)
+	}
+	for i := range expected {
+		if mismatches[i] != expected[i] {
+			t.Errorf("mismatch %d: want %v have %v", i, expected[i], mismatches[i])
+		}
+	}
+}
+
+func TestInitInRange(t *testing.T) {
+	inRange := core.FileInfoT{OriginJson: `{"txHash":"0x1","blockNumber":"0x10"}`}
+	if !initInRange(inRange, 0x10, 0x20) {
+		t.Error("init at the start block should be in range")
+	}
+	if initInRange(inRange, 0x11, 0x20) {
+		t.Error("init before the start block should be out of range")
+	}
+	legacy := core.FileInfoT{OriginJson: "{}"}
+	if !initInRange(legacy, 0, 0x20) || initInRange(legacy, 1, 0x20) {
+		t.Error("files without a block number should only be in range from genesis")
+	}
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/internal/pkg/core"
+	"kdc/pkg/reqsig"
+)
+
+type reversalResult struct {
+	Operation int64        `json:"operation"`
+	Id        int64        `json:"id"`
+	User      string       `json:"user"`
+	Payee     string       `json:"payee,omitempty"`
+	Amount    *hexutil.Big `json:"amount"`
+	Reason    string       `json:"reason,omitempty"`
+	Time      int64        `json:"time"`
+}
+
+// handleReverse credits the amount of the subtract in Operation back to the user it
+// was taken from, on behalf of the owner of the file.
+func handleReverse(req *jsonRpc) (interface{}, *jsonErr) {
+	return signedChange(req, reversalMessage, func(pp *param, signer string, _ string) (interface{}, error) {
+		reversal, err := core.Reverse(signer, pp.FileId, int64(pp.Operation), pp.Amount.ToInt(), pp.Reason, operationMeta(req, pp, signer))
+		if err != nil {
+			return nil, err
+		}
+		return reversalResult{
+			Operation: reversal.OperationId,
+			Id:        reversal.ReversalId,
+			User:      reversal.User,
+			Payee:     reversal.Payee,
+			Amount:    (*hexutil.Big)(reversal.Value),
+			Reason:    reversal.Reason,
+			Time:      reversal.CreateTime,
+		}, nil
+	})
+}
+
+// reversalMessage builds the signed message of a reversal.
+func reversalMessage(method string, pp *param) (*reqsig.Message, *jsonErr) {
+	if nil == pp.Amount {
+		return nil, makeJsonError(invalidParamsCode, "missing amount")
+	}
+	return &reqsig.Message{Method: method, FileId: pp.FileId, Operation: pp.Operation, Amount: pp.Amount.ToInt(),
+		Reason: pp.Reason, Expiry: pp.Expiry}, nil
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"kdc/internal/pkg/core"
+	"sort"
+	"sync"
+)
+
+// settlementMutex keeps the worker and a terminate from sending the same chunk twice
+var settlementMutex sync.Mutex
+
+// splitMortgage splits the final balances of a file into chunks that each hold at most
+// maxParticipants users and roughly maxSize bytes of json. Users are sorted so the
+// same balances always produce the same chunks, which lets a failed chunk be rebuilt
+// and sent again.
+func splitMortgage(mortgage *core.MortgageT, maxParticipants int, maxSize int) []core.MortgageT {
+	users := make([]string, 0, len(*mortgage))
+	for user := range *mortgage {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	chunks := []core.MortgageT{make(core.MortgageT)}
+	size := 0
+	for _, user := range users {
+		value := (*mortgage)[user]
+		// "user":"value",
+		entrySize := len(user) + len(value) + 6
+		current := chunks[len(chunks)-1]
+		if len(current) > 0 && (len(current) >= maxParticipants || size+entrySize > maxSize) {
+			current = make(core.MortgageT)
+			chunks = append(chunks, current)
+			size = 0
+		}
+		current[user] = value
+		size += entrySize
+	}
+	return chunks
+}
+
+// settlementChunkCount returns in how many chunks the final balances are sent.
+func settlementChunkCount(mortgage *core.MortgageT) int {
+	return len(splitMortgage(mortgage, conf.Settlement.MaxParticipants, conf.Settlement.MaxExtraDataSize))
+}
+
+// fileEarnings returns the earnings of the payees of a file for its sync payload, nil
+// when there are none.
+func fileEarnings(fileId string) *core.MortgageT {
+	earnings, err := core.Earnings(fileId)
+	if err != nil {
+		chainLog.Errorf("unable to read the earnings of file %s: %s", fileId, err)
+		return nil
+	}
+	if len(*earnings) == 0 {
+		return nil
+	}
+	return earnings
+}
+
+// ConfirmSettlements checks the receipts of pending sync transactions. Confirmed
+// chunks are recorded, reverted chunks are marked failed so that SendSettlements sends
+// them again.
+func ConfirmSettlements() {
+	pending, err := core.ListPendingSettlements()
+	if err != nil {
+		chainLog.Errorf("unable to list pending settlements: %s", err)
+		return
+	}
+	receipts := make(map[string]*TransactionReceiptT)
+	for _, settlement := range pending {
+		receipt, ok := receipts[settlement.TxHash]
+		if !ok {
+			// a batch transaction settles several files with one receipt
+			receipt = GetTransactionReceipt(settlement.TxHash)
+			receipts[settlement.TxHash] = receipt
+		}
+		if nil == receipt {
+			continue
+		}
+		if "0x1" == receipt.Status {
+			err = core.ConfirmSettlement(settlement.TxHash)
+			if err != nil {
+				chainLog.Errorf("unable to confirm settlement %s: %s", settlement.TxHash, err)
+			}
+			continue
+		}
+		chainLog.Warningf("settlement %s of file %s chunk %d failed", settlement.TxHash, settlement.FileId, settlement.Chunk)
+		err = core.FailSettlement(settlement.TxHash)
+		if err != nil {
+			chainLog.Errorf("unable to record failed settlement %s: %s", settlement.TxHash, err)
+		}
+	}
+}
+
+// SendSettlements sends the next chunk of every settling file: the chunks queued when
+// it was closed, the ones that could not be sent and the ones that were reverted.
+func SendSettlements() {
+	files, err := core.ListFiles()
+	if err != nil {
+		chainLog.Errorf("unable to list files: %s", err)
+		return
+	}
+	for _, file := range files {
+		if file.State != core.FileStateSettling {
+			continue
+		}
+		err = FireSyncTransaction(file.FileId)
+		if err != nil {
+			chainLog.Errorf("unable to send the settlement of file %s: %s", file.FileId, err)
+		}
+	}
+}
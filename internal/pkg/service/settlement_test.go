@@ -0,0 +1,143 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"kdc/internal/pkg/core"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSplitMortgage(t *testing.T) {
+	mortgage := make(core.MortgageT)
+	for i := 0; i < 10; i++ {
+		mortgage[fmt.Sprintf("0x%02d", i)] = "0x1"
+	}
+	chunks := splitMortgage(&mortgage, 4, 1024)
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+	if len(chunks[0]) != 4 || len(chunks[2]) != 2 {
+		t.Errorf("unexpected chunk sizes %d %d %d", len(chunks[0]), len(chunks[1]), len(chunks[2]))
+	}
+	if _, ok := chunks[0]["0x00"]; !ok {
+		t.Error("expected users to be sorted into chunks")
+	}
+
+	// each entry is 13 bytes, so only two fit in 30
+	chunks = splitMortgage(&mortgage, 100, 30)
+	if len(chunks) != 5 {
+		t.Errorf("expected 5 chunks, got %d", len(chunks))
+	}
+
+	empty := make(core.MortgageT)
+	if chunks = splitMortgage(&empty, 4, 1024); len(chunks) != 1 {
+		t.Errorf("expected a single empty chunk, got %d", len(chunks))
+	}
+}
+
+func TestMortgageTabEarnings(t *testing.T) {
+	mortgage := core.MortgageT{"0x01": "0x1", "0x02": "0x2"}
+	earnings := core.MortgageT{"0xpayee": "0x3"}
+	chunks := splitMortgage(&mortgage, 1, 1024)
+	first := buildMortgageTab(true, "0xowner", "file1", chunks, 0, &earnings)
+	last := buildMortgageTab(true, "0xowner", "file1", chunks, 1, &earnings)
+	if nil != first.Earnings || first.Terminate {
+		t.Errorf("expected the earnings and the terminate flag only in the last chunk, got %+v", first)
+	}
+	if nil == last.Earnings || (*last.Earnings)["0xpayee"] != "0x3" || !last.Terminate {
+		t.Errorf("unexpected last chunk %+v", last)
+	}
+}
+
+func TestSettlementChunksInOrder(t *testing.T) {
+	var sent []MortgageTab
+	statuses := make(map[string]string)
+	failSend := true
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var parameter FireSyncTransactionParameter
+		json.Unmarshal(body, &parameter)
+		switch parameter.Method {
+		case "personal_unlockAccount":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":true}`))
+		case "eth_sendTransaction":
+			if failSend {
+				failSend = false
+				w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"nonce too low"}}`))
+				return
+			}
+			var txInput SpecialTxInput
+			json.Unmarshal([]byte(parameter.Params[0].ExtraData), &txInput)
+			sent = append(sent, txInput.SpecialTxTypeMortgageInit)
+			w.Write([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"result":"0xtx%d"}`, len(sent))))
+		case "eth_getTransactionReceipt":
+			var receipt GetTransactionReceiptParameter
+			json.Unmarshal(body, &receipt)
+			status, ok := statuses[receipt.Params[0]]
+			if !ok {
+				w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":null}`))
+				return
+			}
+			w.Write([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"result":{"status":"%s"}}`, status)))
+		}
+	}))
+	defer node.Close()
+	oldConf := *conf
+	defer func() { *conf = oldConf }()
+	conf.Chain.Url = node.URL
+	conf.Account.SyncAccount, conf.Account.Password = "0xsync", "password"
+	conf.Settlement.MaxParticipants = 1
+	conf.Settlement.BatchEnabled = false
+
+	fileId := "0xordered" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	mortgage := core.MortgageTableT{"0xa": *big.NewInt(1), "0xb": *big.NewInt(2), "0xc": *big.NewInt(3)}
+	err := core.InitFile("0xowner", fileId, "", &core.AllowTableT{}, &mortgage, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first send fails, the chunks stay queued for the worker
+	if _, err = core.Terminate("0xowner", fileId); err != nil {
+		t.Fatal(err)
+	}
+	settlements, _ := core.ListSettlements(fileId)
+	if len(sent) != 0 || len(settlements) != 3 || settlements[0].Status != core.SettlementStatusUnsent {
+		t.Fatalf("expected 3 unsent chunks, got %v", settlements)
+	}
+	SendSettlements()
+	SendSettlements()
+	if len(sent) != 1 || sent[0].Chunk != 0 || sent[0].Terminate {
+		t.Fatalf("expected only the first chunk to be sent, got %v", sent)
+	}
+	statuses["0xtx1"] = "0x1"
+	ConfirmSettlements()
+	SendSettlements()
+	if len(sent) != 2 || sent[1].Chunk != 1 {
+		t.Fatalf("expected the second chunk once the first is confirmed, got %v", sent)
+	}
+	// a reverted chunk is sent again before the next one
+	statuses["0xtx2"] = "0x0"
+	ConfirmSettlements()
+	SendSettlements()
+	if len(sent) != 3 || sent[2].Chunk != 1 {
+		t.Fatalf("expected the second chunk to be sent again, got %v", sent)
+	}
+	statuses["0xtx3"] = "0x1"
+	ConfirmSettlements()
+	SendSettlements()
+	if len(sent) != 4 || sent[3].Chunk != 2 || !sent[3].Terminate {
+		t.Fatalf("expected the terminate chunk last, got %v", sent)
+	}
+	statuses["0xtx4"] = "0x1"
+	ConfirmSettlements()
+	SendSettlements()
+	file, _ := core.GetFileInfo(fileId)
+	if len(sent) != 4 || file.State != core.FileStateSettled {
+		t.Errorf("expected the file to be settled, got %s after %d transactions", file.State, len(sent))
+	}
+}
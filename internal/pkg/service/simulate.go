@@ -0,0 +1,134 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/internal/pkg/core"
+	"math/big"
+)
+
+// SimulatedTxT is one sync transaction kdc would send, with what the node says about it.
+type SimulatedTxT struct {
+	Tx           SendTxArgs     `json:"tx"`
+	Payload      SpecialTxInput `json:"payload"`
+	EstimatedGas string         `json:"estimatedGas,omitempty"`
+	CallResult   string         `json:"callResult,omitempty"`
+	WouldSucceed bool           `json:"wouldSucceed"`
+	Problems     []string       `json:"problems,omitempty"`
+}
+
+type SimulationResult struct {
+	FileID       string         `json:"fileID"`
+	Owner        string         `json:"owner"`
+	Terminate    bool           `json:"terminate"`
+	Transactions []SimulatedTxT `json:"transactions"`
+}
+
+var FileAlreadySettledErr = errors.New("file is already settled")
+
+// SimulateSettlement computes the sync transactions that settling the file would send
+// now and runs them through eth_estimateGas and eth_call. For a file already settling,
+// those are the chunks that are neither pending nor confirmed. Nothing is broadcast and
+// the file state is left untouched.
+func SimulateSettlement(fileId string) (*SimulationResult, error) {
+	file, err := core.GetFileInfo(fileId)
+	if err != nil {
+		return nil, err
+	}
+	if file.State == core.FileStateSettled {
+		return nil, FileAlreadySettledErr
+	}
+	mortgage, err := core.RemainMortgage(fileId)
+	if err != nil {
+		return nil, err
+	}
+	simulation := &SimulationResult{
+		FileID:    fileId,
+		Owner:     file.Owner,
+		Terminate: true,
+	}
+	chunks := splitMortgage(mortgage, conf.Settlement.MaxParticipants, conf.Settlement.MaxExtraDataSize)
+	sent := make(map[int]bool)
+	if file.State == core.FileStateSettling {
+		sent, err = sentSettlementChunks(fileId, len(chunks))
+		if err != nil {
+			return nil, err
+		}
+	}
+	earnings := fileEarnings(fileId)
+	for i := range chunks {
+		if sent[i] {
+			continue
+		}
+		txInput := SpecialTxInput{
+			Type:                      conf.Chain.SyncTransactionType,
+			SpecialTxTypeMortgageInit: buildMortgageTab(true, file.Owner, fileId, chunks, i, earnings),
+		}
+		simulation.Transactions = append(simulation.Transactions, simulateTransaction(txInput))
+	}
+	return simulation, nil
+}
+
+// sentSettlementChunks returns the chunks of the settlement of a settling file that
+// FireSyncTransaction will not send again, since a transaction of theirs is pending or
+// confirmed.
+func sentSettlementChunks(fileId string, chunkCount int) (map[int]bool, error) {
+	next, err := core.NextSettlementChunk(fileId)
+	if err != nil {
+		return nil, err
+	}
+	if nil != next && next.ChunkCount != chunkCount {
+		return nil, fmt.Errorf("file %s now splits into %d chunks instead of %d", fileId, chunkCount, next.ChunkCount)
+	}
+	settlements, err := core.ListSettlements(fileId)
+	if err != nil {
+		return nil, err
+	}
+	sent := make(map[int]bool)
+	for _, settlement := range settlements {
+		if core.SettlementStatusPending == settlement.Status || core.SettlementStatusConfirmed == settlement.Status {
+			sent[settlement.Chunk] = true
+		}
+	}
+	return sent, nil
+}
+
+func simulateTransaction(txInput SpecialTxInput) SimulatedTxT {
+	simulated := SimulatedTxT{
+		Tx:           buildSendTxArgs(txInput),
+		Payload:      txInput,
+		WouldSucceed: true,
+	}
+	estimatedGas, err := callNode("eth_estimateGas", simulated.Tx)
+	if err != nil {
+		simulated.WouldSucceed = false
+		simulated.Problems = append(simulated.Problems, err.Error())
+	} else {
+		simulated.EstimatedGas = estimatedGas
+		if gasTooLow(estimatedGas, simulated.Tx.Gas) {
+			simulated.WouldSucceed = false
+			simulated.Problems = append(simulated.Problems, "estimated gas "+estimatedGas+" exceeds configured gas "+simulated.Tx.Gas)
+		}
+	}
+	callResult, err := callNode("eth_call", simulated.Tx, "latest")
+	if err != nil {
+		simulated.WouldSucceed = false
+		simulated.Problems = append(simulated.Problems, err.Error())
+	} else {
+		simulated.CallResult = callResult
+	}
+	return simulated
+}
+
+func gasTooLow(estimatedGas string, gas string) bool {
+	estimated, err := hexutil.DecodeBig(estimatedGas)
+	if err != nil {
+		return false
+	}
+	limit, err := hexutil.DecodeBig(gas)
+	if err != nil {
+		return false
+	}
+	return estimated.Cmp(limit) > 0 || limit.Cmp(big.NewInt(0)) == 0
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"kdc/internal/pkg/core"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGasTooLow(t *testing.T) {
+	if gasTooLow("0x5208", "0x34502") {
+		t.Error("0x5208 fits in 0x34502")
+	}
+	if !gasTooLow("0x34503", "0x34502") {
+		t.Error("0x34503 does not fit in 0x34502")
+	}
+}
+
+func TestSimulateSettlement(t *testing.T) {
+	var methods []string
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var parameter EthCallParameter
+		json.Unmarshal(body, &parameter)
+		methods = append(methods, parameter.Method)
+		switch parameter.Method {
+		case "eth_estimateGas":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x5208"}`))
+		default:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"execution reverted"}}`))
+		}
+	}))
+	defer node.Close()
+	oldUrl := conf.Chain.Url
+	conf.Chain.Url = node.URL
+	defer func() { conf.Chain.Url = oldUrl }()
+
+	fileId := "0xsimulate" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	mortgage := core.MortgageTableT{"0xa": *big.NewInt(5)}
+	err := core.InitFile("0xowner", fileId, "", &core.AllowTableT{}, &mortgage, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	simulation, err := SimulateSettlement(fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(simulation.Transactions) != 1 {
+		t.Fatalf("expected one transaction, got %d", len(simulation.Transactions))
+	}
+	simulated := simulation.Transactions[0]
+	if simulated.EstimatedGas != "0x5208" || simulated.WouldSucceed || len(simulated.Problems) != 1 {
+		t.Errorf("unexpected simulation %v", simulated)
+	}
+	if (*simulated.Payload.SpecialTxTypeMortgageInit.Sidechain)["0xa"] != "0x5" {
+		t.Errorf("unexpected payload %v", simulated.Payload)
+	}
+	for _, method := range methods {
+		if method == "eth_sendTransaction" || method == "personal_unlockAccount" {
+			t.Errorf("simulation must not call %s", method)
+		}
+	}
+	file, _ := core.GetFileInfo(fileId)
+	settlements, _ := core.ListSettlements(fileId)
+	if !file.IsOpen || len(settlements) != 0 {
+		t.Error("simulation must not change the file")
+	}
+}
+
+func TestSimulateSettlingFile(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var parameter EthCallParameter
+		json.Unmarshal(body, &parameter)
+		switch parameter.Method {
+		case "personal_unlockAccount":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":true}`))
+		case "eth_sendTransaction":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0xsimulated1"}`))
+		case "eth_estimateGas":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x5208"}`))
+		default:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x"}`))
+		}
+	}))
+	defer node.Close()
+	oldConf := *conf
+	defer func() { *conf = oldConf }()
+	conf.Chain.Url = node.URL
+	conf.Account.SyncAccount, conf.Account.Password = "0xsync", "password"
+	conf.Settlement.MaxParticipants = 1
+	conf.Settlement.BatchEnabled = false
+
+	fileId := "0xsimulating" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	mortgage := core.MortgageTableT{"0xa": *big.NewInt(1), "0xb": *big.NewInt(2), "0xc": *big.NewInt(3)}
+	err := core.InitFile("0xowner", fileId, "", &core.AllowTableT{}, &mortgage, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = core.Terminate("0xowner", fileId); err != nil {
+		t.Fatal(err)
+	}
+	expectChunks := func(expected ...int) {
+		simulation, err := SimulateSettlement(fileId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(simulation.Transactions) != len(expected) {
+			t.Fatalf("expected chunks %v, got %d transactions", expected, len(simulation.Transactions))
+		}
+		for i, chunk := range expected {
+			if simulation.Transactions[i].Payload.SpecialTxTypeMortgageInit.Chunk != chunk {
+				t.Errorf("expected chunk %d, got %+v", chunk, simulation.Transactions[i].Payload)
+			}
+		}
+	}
+	// the first chunk was sent by the terminate
+	expectChunks(1, 2)
+	if err = core.ConfirmSettlement("0xsimulated1"); err != nil {
+		t.Fatal(err)
+	}
+	expectChunks(1, 2)
+}
@@ -0,0 +1,28 @@
+package service
+
+import (
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/internal/pkg/core"
+	"kdc/pkg/reqsig"
+)
+
+// handleTransfer moves the amount from the balance of the signer to the one of the
+// participant in Data, and returns the balance of the signer.
+func handleTransfer(req *jsonRpc) (interface{}, *jsonErr) {
+	return signedChange(req, transferMessage, func(pp *param, signer string, recipient string) (interface{}, error) {
+		balance, err := core.Transfer(signer, pp.FileId, recipient, pp.Amount.ToInt(), operationMeta(req, pp, signer))
+		if err != nil {
+			return nil, err
+		}
+		return hexutil.EncodeBig(balance), nil
+	})
+}
+
+// transferMessage builds the signed message of a transfer.
+func transferMessage(method string, pp *param) (*reqsig.Message, *jsonErr) {
+	if nil == pp.Amount {
+		return nil, makeJsonError(invalidParamsCode, "missing amount")
+	}
+	return &reqsig.Message{Method: method, FileId: pp.FileId, Recipient: pp.Data, Amount: pp.Amount.ToInt(),
+		Expiry: pp.Expiry}, nil
+}
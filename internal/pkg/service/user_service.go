@@ -4,74 +4,101 @@ import (
 	"net/http"
 
 	"encoding/hex"
+	"encoding/json"
 	"errors"
-	"fmt"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
-	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"kdc/internal/pkg/core"
-	"reflect"
-	"strconv"
+	"kdc/pkg/reqsig"
+	"strings"
+	"time"
 )
 
-type jsonRpc struct {
-	JsonRpc string      `json:"jsonrpc"`
-	Method  string      `json:"method"`
-	Id      interface{} `json:"id"`
-	Params  *param      `json:"params"`
-}
-
 type param struct {
 	FileId    string       `json:"fileId,omitempty"`
 	Data      string       `json:"data,omitempty"`
 	Amount    *hexutil.Big `json:"amount,omitempty"`
 	Signature string       `json:"signature"`
-}
-
-type jsonResponse struct {
-	JsonRpc string      `json:"jsonrpc"`
-	Result  interface{} `json:"result,omitempty"`
-	Id      interface{} `json:"id"`
-	Error   jsonErr     `json:"error,omitempty"`
-}
-
-type jsonErr struct {
-	Code    int         `json:"code,omitempty"`
-	Message string      `json:"message,omitempty"`
-	Data    interface{} `json:"data,omitempty"`
+	// eip712 (default), personal or, when enabled, legacy
+	SignatureType string `json:"signatureType,omitempty"`
+	// unix time after which a subtract is refused, signed with it
+	Expiry uint64 `json:"expiry,omitempty"`
+	// filters of listOperations, which reads the user in Data
+	From   uint64 `json:"from,omitempty"`
+	To     uint64 `json:"to,omitempty"`
+	Offset uint64 `json:"offset,omitempty"`
+	Limit  uint64 `json:"limit,omitempty"`
+	// privilege granted by grantPrivilege, and its limits
+	Privilege  string       `json:"privilege,omitempty"`
+	ValidFrom  uint64       `json:"validFrom,omitempty"`
+	ValidUntil uint64       `json:"validUntil,omitempty"`
+	MaxAmount  *hexutil.Big `json:"maxAmount,omitempty"`
+	DailyCap   *hexutil.Big `json:"dailyCap,omitempty"`
+	// spender of the allowance read by allowance, which reads the user in Data
+	Spender string `json:"spender,omitempty"`
+	// credited with a subtract instead of the owner of the file
+	Payee string `json:"payee,omitempty"`
+	// hold captured or released
+	Hold uint64 `json:"hold,omitempty"`
+	// read returns what holds reserve and what is available with the balance, and
+	// listOperations the signed requests of the operations
+	Details bool `json:"details,omitempty"`
+	// subtract reversed by reverse, and why
+	Operation uint64 `json:"operation,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	// recorded with the operations of a request, unsigned
+	Reference string `json:"reference,omitempty"`
+	Memo      string `json:"memo,omitempty"`
+	// retries of a change with the same key and fields get the result of the first one
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 var BadIdErr = errors.New("bad id")
+var LegacySignatureErr = errors.New("legacy signatures are disabled")
+var MissingExpiryErr = errors.New("request has no expiry")
+var RequestExpiredErr = errors.New("request expired")
+var ExpiryTooFarErr = errors.New("request expiry too far in the future")
 
-func validJsonRpc2(rpc *jsonRpc) bool {
-	// check version
-	if rpc.JsonRpc != "2.0" {
-		return false
-	}
-	// check id
-	id := rpc.Id
-	fmt.Print(reflect.TypeOf(id))
-	switch id.(type) {
-	case string:
-		break
-	case float64:
-		break // go recognise number to float
-	default:
-		return false
-	}
-	// check method
-	if rpc.Method != "subtract" && rpc.Method != "read" && rpc.Method != "terminate" {
-		return false
-	}
-	// check param
-	if rpc.Params == nil {
-		return false
-	}
-	return true
+var rpcMethods = map[string]rpcHandler{
+	"subtract":  handleSubtract,
+	"read":      handleRead,
+	"terminate": handleTerminate,
+	"transfer":  handleTransfer,
+	// read-only queries
+	"getFileInfo":      handleGetFileInfo,
+	"listParticipants": handleListParticipants,
+	"listOperations":   handleListOperations,
+	"listMyFiles":      handleListMyFiles,
+	"listEarnings":     handleListEarnings,
+	// owner management
+	"grantPrivilege":      handleGrantPrivilege,
+	"revokePrivilege":     handleRevokePrivilege,
+	"listPrivilegeEvents": handleListPrivilegeEvents,
+	// session keys
+	"delegate":         handleDelegate,
+	"revokeDelegation": handleRevokeDelegation,
+	"listDelegations":  handleListDelegations,
+	// allowances
+	"approve":   handleApprove,
+	"charge":    handleCharge,
+	"allowance": handleAllowance,
+	// holds
+	"reserve": handleReserve,
+	"capture": handleCapture,
+	"release": handleRelease,
+	// reversals of subtracts
+	"reverse": handleReverse,
 }
 
 func RunService() {
+	e := newServer()
+	// Start server
+	e.Logger.Fatal(e.Start(conf.Api.Listen))
+}
+
+func newServer() *echo.Echo {
 	// Echo instance
 	e := echo.New()
 	// Middleware
@@ -79,182 +106,267 @@ func RunService() {
 	e.Use(middleware.Recover())
 	// Routes
 	e.POST("/api", handle)
-	// Start server
-	e.Logger.Fatal(e.Start(":8080"))
+	if "" != conf.Api.AdminKey {
+		admin := e.Group("/admin")
+		admin.Use(middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+			return key == conf.Api.AdminKey, nil
+		}))
+		admin.GET("/simulate/:fileId", handleSimulate)
+	}
+	return e
 }
 
-func handle(c echo.Context) (err error) {
-	j := new(jsonRpc)
-	if err = c.Bind(j); err != nil {
-		return
-	}
-	valid := validJsonRpc2(j)
-	if !valid {
-		err = echo.NewHTTPError(http.StatusBadRequest, "invalid json rpc 2.0")
-		return
-	}
-	var jResponse *jsonResponse
-	switch j.Method {
-	case "subtract":
-		jResponse = handleSubtract(j)
-		return c.JSON(http.StatusOK, jResponse)
-	case "read":
-		jResponse = handleRead(j)
-		return c.JSON(http.StatusOK, jResponse)
-	case "terminate":
-		jResponse = handleTerminate(j)
-		return c.JSON(http.StatusOK, jResponse)
-	default:
-		err = echo.NewHTTPError(http.StatusBadRequest, "method not supported")
-		return
-	}
-	err = echo.NewHTTPError(http.StatusInternalServerError, "unknown error")
-	return
+// requestDomain returns the eip-712 domain requests are signed under.
+func requestDomain() reqsig.Domain {
+	return reqsig.NewDomain(conf.Api.ChainId, conf.Api.ServiceAddress)
 }
 
-func idToStr(id interface{}) (string, error) {
-	switch id.(type) {
-	case string:
-		return id.(string), nil
-	case float64: // go recognise number to float
-		return strconv.Itoa(int(id.(float64))), nil
-	default:
-		return "", BadIdErr
+// requestScheme returns the signature scheme of the request. Requests without a
+// signature type are legacy ones when those are enabled.
+func requestScheme(pp *param) reqsig.Scheme {
+	scheme := reqsig.Scheme(pp.SignatureType)
+	if "" == scheme {
+		scheme = reqsig.TypedData
+		if conf.Api.LegacySignatures {
+			scheme = reqsig.Legacy
+		}
 	}
+	return scheme
 }
 
-func initJResponse(json *jsonRpc) *jsonResponse {
-	jResponse := new(jsonResponse)
-	jResponse.Id = json.Id
-	jResponse.JsonRpc = "2.0"
-	return jResponse
+// recoverSigner returns the account that signed msg with the signature of the request,
+// and the digest it signed.
+func recoverSigner(pp *param, msg *reqsig.Message) (string, []byte, *jsonErr) {
+	scheme := requestScheme(pp)
+	if scheme == reqsig.Legacy && !conf.Api.LegacySignatures {
+		return "", nil, rpcError(LegacySignatureErr)
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(pp.Signature, "0x"))
+	if err != nil {
+		return "", nil, rpcError(reqsig.BadSignatureErr)
+	}
+	digest, err := msg.Digest(scheme, requestDomain())
+	if err != nil {
+		return "", nil, rpcError(err)
+	}
+	signer, err := reqsig.Recover(digest, sig)
+	if err != nil {
+		return "", nil, rpcError(UnrecoverableSignatureErr)
+	}
+	return signer, digest, nil
 }
 
-func makeJsonError(code int, message string) *jsonErr {
-	je := new(jsonErr)
-	je.Code = code
-	je.Message = message
-	return je
+// acceptOnce checks the expiry of a signed request and records its digest, so that it
+// is accepted at most once, and claims its idempotency key. It returns the request to
+// complete or fail, or the result to return again of the request that completed under
+// the key earlier. A request that failed under the key gets its error again.
+func acceptOnce(pp *param, msg *reqsig.Message, signer string, digest []byte) (*accepted, json.RawMessage, *jsonErr) {
+	// legacy requests carry no expiry, the seen-request store alone protects them
+	if requestScheme(pp) != reqsig.Legacy {
+		now := time.Now().Unix()
+		expiry := int64(pp.Expiry)
+		switch {
+		case 0 == pp.Expiry:
+			return nil, nil, rpcError(MissingExpiryErr)
+		case expiry < now:
+			return nil, nil, rpcError(RequestExpiredErr)
+		case expiry > now+int64(conf.Api.MaxRequestLifetime/time.Second):
+			return nil, nil, rpcError(ExpiryTooFarErr)
+		}
+	}
+	request := &accepted{requestKey: hexutil.Encode(digest), signer: signer, fileId: pp.FileId}
+	if "" != pp.IdempotencyKey {
+		payload, err := payloadOf(msg)
+		if err != nil {
+			return nil, nil, rpcError(err)
+		}
+		result, failure, err := core.BeginIdempotent(signer, pp.FileId, pp.IdempotencyKey, payload)
+		if err != nil {
+			return nil, nil, rpcError(err)
+		}
+		if "" != failure {
+			jErr := new(jsonErr)
+			if err = json.Unmarshal([]byte(failure), jErr); err != nil {
+				return nil, nil, rpcError(err)
+			}
+			return nil, nil, jErr
+		}
+		if "" != result {
+			return nil, json.RawMessage(result), nil
+		}
+		request.idempotencyKey = pp.IdempotencyKey
+	}
+	err := core.RecordRequest(request.requestKey, signer, int64(pp.Expiry))
+	if err != nil {
+		if "" != request.idempotencyKey {
+			core.ForgetIdempotent(signer, pp.FileId, request.idempotencyKey)
+		}
+		return nil, nil, rpcError(err)
+	}
+	return request, nil, nil
 }
 
-func handleSubtract(json *jsonRpc) *jsonResponse {
-	jResponse := initJResponse(json)
-	pp := json.Params
-	id := json.Id
-	fmt.Print(reflect.TypeOf(id))
-	reqId, err := idToStr(id)
+// changeMessage builds the signed message of a change from its params, but its id.
+type changeMessage func(method string, pp *param) (*reqsig.Message, *jsonErr)
+
+// changeFunc applies a change on behalf of its signer. counterpart is the address in
+// Data, checksummed since signers are compared by their checksummed address.
+type changeFunc func(pp *param, signer string, counterpart string) (interface{}, error)
+
+// signedChange verifies a signed change, accepts it once and applies it with apply.
+func signedChange(req *jsonRpc, message changeMessage, apply changeFunc) (interface{}, *jsonErr) {
+	pp := new(param)
+	if jErr := req.bindParams(pp); jErr != nil {
+		return nil, jErr
+	}
+	reqId, err := req.idString()
 	if err != nil {
-		jResponse.Error = *makeJsonError(400, err.Error())
-		return jResponse
+		return nil, rpcError(err)
+	}
+	msg, jErr := message(req.Method, pp)
+	if jErr != nil {
+		return nil, jErr
+	}
+	msg.Id = reqId
+	signer, digest, jErr := recoverSigner(pp, msg)
+	if jErr != nil {
+		return nil, jErr
+	}
+	request, replayed, jErr := acceptOnce(pp, msg, signer, digest)
+	if jErr != nil {
+		return nil, jErr
+	}
+	if nil != replayed {
+		return replayed, nil
+	}
+	result, err := apply(pp, signer, common.HexToAddress(pp.Data).Hex())
+	if err != nil {
+		return nil, request.fail(err)
+	}
+	return request.done(result)
+}
+
+// operationMeta describes req, signed by signer, to the operations it makes.
+func operationMeta(req *jsonRpc, pp *param, signer string) *core.OperationMetaT {
+	reqId, _ := req.idString()
+	return &core.OperationMetaT{Reference: pp.Reference, Memo: pp.Memo, Request: string(req.raw), Signer: signer, RequestId: reqId}
+}
+
+func handleSubtract(req *jsonRpc) (interface{}, *jsonErr) {
+	pp := new(param)
+	if jErr := req.bindParams(pp); jErr != nil {
+		return nil, jErr
+	}
+	reqId, err := req.idString()
+	if err != nil {
+		return nil, rpcError(err)
 	}
 	fileId := pp.FileId
 	userId := pp.Data
 	amount := pp.Amount
-	sig, err1 := hex.DecodeString(pp.Signature)
-	if err1 != nil {
-		jResponse.Error = *makeJsonError(400, "bad signature")
-		return jResponse
-	}
-	fmt.Println(amount)
-	// compose msg
-	msg := json.JsonRpc + json.Method + reqId + fileId + userId + amount.String()
-	// sha msg
-	shaMsg := crypto.Keccak256([]byte(msg))
-	recoveredPub2, err3 := crypto.SigToPub(shaMsg, sig)
-	if err3 != nil {
-		jResponse.Error = *makeJsonError(400, "unable to recover public key")
-		return jResponse
-	}
-	// validate
-	finalAddr := crypto.PubkeyToAddress(*recoveredPub2).Hex()
-	fmt.Printf("calculated addr is %s\n", finalAddr)
-	if finalAddr != userId {
-		jResponse.Error = *makeJsonError(400, "invalid signature")
-		return jResponse
+	if nil == amount {
+		return nil, makeJsonError(invalidParamsCode, "missing amount")
+	}
+	msg := &reqsig.Message{Method: req.Method, Id: reqId, FileId: fileId, User: userId, Amount: amount.ToInt(), Expiry: pp.Expiry}
+	payee := ""
+	if "" != pp.Payee {
+		// naming a payee changes the signed type, so that older signatures keep verifying
+		msg.Method, msg.Payee = "subtractTo", pp.Payee
+		payee = common.HexToAddress(pp.Payee).Hex()
+	}
+	finalAddr, digest, jErr := recoverSigner(pp, msg)
+	if jErr != nil {
+		return nil, jErr
+	}
+	request, replayed, jErr := acceptOnce(pp, msg, finalAddr, digest)
+	if jErr != nil {
+		return nil, jErr
+	}
+	if nil != replayed {
+		return replayed, nil
 	}
 	// call core method
-	_, err2 := core.SubtractValue(userId, fileId, amount.ToInt())
-	if err2 != nil {
-		jResponse.Error = *makeJsonError(400, err2.Error())
-		return jResponse
+	meta := operationMeta(req, pp, finalAddr)
+	if finalAddr == userId {
+		_, err = core.SubtractValueTo(userId, fileId, amount.ToInt(), payee, meta)
+	} else {
+		// signed by a session key the user delegated to
+		_, _, err = core.SubtractAsDelegate(finalAddr, userId, fileId, amount.ToInt(), payee, meta)
+		if err == core.NoDelegationErr {
+			err = InvalidSignatureErr
+		}
+	}
+	if err != nil {
+		return nil, request.fail(err)
 	}
-	jResponse.Result = 1
-	return jResponse
+	return request.done(1)
 }
 
-func handleRead(json *jsonRpc) *jsonResponse {
-	jResponse := initJResponse(json)
-	pp := json.Params
-	id := json.Id
-	fmt.Print(reflect.TypeOf(id))
-	reqId, err := idToStr(id)
+func handleRead(req *jsonRpc) (interface{}, *jsonErr) {
+	pp := new(param)
+	if jErr := req.bindParams(pp); jErr != nil {
+		return nil, jErr
+	}
+	reqId, err := req.idString()
 	if err != nil {
-		jResponse.Error = *makeJsonError(400, err.Error())
-		return jResponse
+		return nil, rpcError(err)
 	}
 	fileId := pp.FileId
 	userId := pp.Data
-	sig, err1 := hex.DecodeString(pp.Signature)
-	if err1 != nil {
-		jResponse.Error = *makeJsonError(400, "bad signature")
-		return jResponse
-	}
-	// compose msg
-	msg := json.JsonRpc + json.Method + reqId + fileId + userId
-	// sha msg
-	shaMsg := crypto.Keccak256([]byte(msg))
-	recoveredPub2, err3 := crypto.SigToPub(shaMsg, sig)
-	if err3 != nil {
-		jResponse.Error = *makeJsonError(400, "unable to recover public key")
-		return jResponse
-	}
-	// validate
-	readingUser := crypto.PubkeyToAddress(*recoveredPub2).Hex()
-	fmt.Printf("reading user addr is %s\n", readingUser)
+	msg := &reqsig.Message{Method: req.Method, Id: reqId, FileId: fileId, User: userId}
+	readingUser, _, jErr := recoverSigner(pp, msg)
+	if jErr != nil {
+		return nil, jErr
+	}
+	if pp.Details {
+		balance, err := core.ReadBalance(readingUser, fileId, userId)
+		if err != nil {
+			return nil, rpcError(err)
+		}
+		return balanceResult{(*hexutil.Big)(balance.Balance), (*hexutil.Big)(balance.Held), (*hexutil.Big)(balance.Available)}, nil
+	}
 	// call core method
-	balance, err2 := core.ReadValue(readingUser, fileId, userId)
-	if err2 != nil {
-		jResponse.Error = *makeJsonError(400, err2.Error())
-		return jResponse
+	balance, err := core.ReadValue(readingUser, fileId, userId)
+	if err != nil {
+		return nil, rpcError(err)
 	}
-	jResponse.Result = hexutil.EncodeBig(balance)
-	return jResponse
+	return hexutil.EncodeBig(balance), nil
 }
 
-func handleTerminate(json *jsonRpc) *jsonResponse {
-	jResponse := initJResponse(json)
-	pp := json.Params
-	id := json.Id
-	fmt.Print(reflect.TypeOf(id))
-	reqId, err := idToStr(id)
+func handleTerminate(req *jsonRpc) (interface{}, *jsonErr) {
+	pp := new(param)
+	if jErr := req.bindParams(pp); jErr != nil {
+		return nil, jErr
+	}
+	reqId, err := req.idString()
 	if err != nil {
-		jResponse.Error = *makeJsonError(400, err.Error())
-		return jResponse
+		return nil, rpcError(err)
 	}
 	fileId := pp.FileId
-	sig, err1 := hex.DecodeString(pp.Signature)
-	if err1 != nil {
-		jResponse.Error = *makeJsonError(400, "bad signature")
-		return jResponse
-	}
-	// compose msg
-	msg := json.JsonRpc + json.Method + reqId + fileId
-	// sha msg
-	shaMsg := crypto.Keccak256([]byte(msg))
-	recoveredPub2, err3 := crypto.SigToPub(shaMsg, sig)
-	if err3 != nil {
-		jResponse.Error = *makeJsonError(400, "unable to recover public key")
-		return jResponse
-	}
-	// validate
-	readingUser := crypto.PubkeyToAddress(*recoveredPub2).Hex()
-	fmt.Printf("reading user addr is %s\n", readingUser)
+	msg := &reqsig.Message{Method: req.Method, Id: reqId, FileId: fileId, Expiry: pp.Expiry}
+	readingUser, digest, jErr := recoverSigner(pp, msg)
+	if jErr != nil {
+		return nil, jErr
+	}
+	request, replayed, jErr := acceptOnce(pp, msg, readingUser, digest)
+	if jErr != nil {
+		return nil, jErr
+	}
+	if nil != replayed {
+		return replayed, nil
+	}
 	// call core method
-	_, err2 := core.Terminate(readingUser, fileId)
-	if err2 != nil {
-		jResponse.Error = *makeJsonError(400, err2.Error())
-		return jResponse
+	_, err = core.Terminate(readingUser, fileId)
+	if err != nil {
+		return nil, request.fail(err)
+	}
+	return request.done(0)
+}
+
+func handleSimulate(c echo.Context) error {
+	simulation, err := SimulateSettlement(c.Param("fileId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
-	jResponse.Result = 0
-	return jResponse
+	return c.JSON(http.StatusOK, simulation)
 }
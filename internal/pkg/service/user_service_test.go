@@ -2,11 +2,21 @@ package service
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
+	"kdc/internal/pkg/core"
+	"kdc/pkg/client"
+	"kdc/pkg/reqsig"
+	"math/big"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -132,3 +142,723 @@ func TestSignTerminateReq(t *testing.T) {
 	sigStr := hex.EncodeToString(sig)
 	fmt.Printf("signature : %s\n", sigStr)
 }
+
+func TestClientRequests(t *testing.T) {
+	owner, _ := crypto.GenerateKey()
+	user, _ := crypto.GenerateKey()
+	ownerAddr, userAddr := client.Address(owner), client.Address(user)
+	fileId := "clientfile1"
+	err := core.InitFile(ownerAddr, fileId, "", &core.AllowTableT{userAddr: core.Readwrite},
+		&core.MortgageTableT{userAddr: *big.NewInt(1000)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	userClient := client.New(api.URL+"/api", client.NewSigner(user, conf.Api.ChainId, conf.Api.ServiceAddress))
+
+	err = userClient.Subtract(fileId, big.NewInt(400))
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance, err := userClient.Read(fileId, userAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Cmp(big.NewInt(600)) != 0 {
+		t.Errorf("balance %s, expected 600", balance)
+	}
+	err = userClient.Subtract(fileId, big.NewInt(601))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Message != core.InsufficientBalanceErr.Error() {
+		t.Errorf("expected insufficient balance, got %v", err)
+	}
+	err = userClient.Terminate(fileId)
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Message != core.NotOwnerErr.Error() {
+		t.Errorf("expected not owner, got %v", err)
+	}
+}
+
+func TestSignatureTypes(t *testing.T) {
+	user, _ := crypto.GenerateKey()
+	userAddr := client.Address(user)
+	fileId := "sigtypefile1"
+	err := core.InitFile(userAddr, fileId, "", &core.AllowTableT{userAddr: core.Readwrite},
+		&core.MortgageTableT{userAddr: *big.NewInt(1000)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	signer := client.NewSigner(user, conf.Api.ChainId, conf.Api.ServiceAddress)
+	userClient := client.New(api.URL+"/api", signer)
+
+	signer.Scheme = reqsig.Personal
+	if err = userClient.Subtract(fileId, big.NewInt(1)); err != nil {
+		t.Errorf("personal_sign: %s", err)
+	}
+	signer.Scheme = reqsig.Legacy
+	err = userClient.Subtract(fileId, big.NewInt(1))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Message != LegacySignatureErr.Error() {
+		t.Errorf("expected legacy signatures to be refused, got %v", err)
+	}
+	conf.Api.LegacySignatures = true
+	defer func() { conf.Api.LegacySignatures = false }()
+	if err = userClient.Subtract(fileId, big.NewInt(1)); err != nil {
+		t.Errorf("legacy: %s", err)
+	}
+	// signed for another deployment
+	signer.Scheme = reqsig.TypedData
+	signer.Domain = reqsig.NewDomain(conf.Api.ChainId+1, conf.Api.ServiceAddress)
+	if err = userClient.Subtract(fileId, big.NewInt(1)); err == nil {
+		t.Error("expected a signature of another domain to be refused")
+	}
+}
+
+func TestReplayProtection(t *testing.T) {
+	user, _ := crypto.GenerateKey()
+	userAddr := client.Address(user)
+	fileId := "replayfile1"
+	err := core.InitFile(userAddr, fileId, "", &core.AllowTableT{userAddr: core.Readwrite},
+		&core.MortgageTableT{userAddr: *big.NewInt(1000)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	signer := client.NewSigner(user, conf.Api.ChainId, conf.Api.ServiceAddress)
+	userClient := client.New(api.URL+"/api", signer)
+	expectError := func(req *client.Request, expected error) {
+		t.Helper()
+		_, err := userClient.Send(req)
+		if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Message != expected.Error() {
+			t.Errorf("expected %q, got %v", expected, err)
+		}
+	}
+
+	req, _ := signer.SubtractRequest(1, fileId, big.NewInt(10))
+	if _, err = userClient.Send(req); err != nil {
+		t.Fatal(err)
+	}
+	expectError(req, core.RequestReusedErr)
+
+	// a refused subtract is not applied later, once the balance would allow it
+	req, _ = signer.SubtractRequest(2, fileId, big.NewInt(2000))
+	expectError(req, core.InsufficientBalanceErr)
+	err = core.Deposit(&core.DepositT{TxHash: "0xreplaydeposit1", FileId: fileId, From: userAddr},
+		&core.MortgageTableT{userAddr: *big.NewInt(2000)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectError(req, core.RequestReusedErr)
+
+	signer.Lifetime = -time.Minute
+	req, _ = signer.SubtractRequest(3, fileId, big.NewInt(10))
+	expectError(req, RequestExpiredErr)
+	signer.Lifetime = conf.Api.MaxRequestLifetime + time.Minute
+	req, _ = signer.SubtractRequest(4, fileId, big.NewInt(10))
+	expectError(req, ExpiryTooFarErr)
+
+	// the expiry is signed
+	signer.Lifetime = time.Minute
+	req, _ = signer.SubtractRequest(5, fileId, big.NewInt(10))
+	req.Params.Expiry += 60
+	expectError(req, errors.New("invalid signature"))
+}
+
+func TestQueryRequests(t *testing.T) {
+	owner, _ := crypto.GenerateKey()
+	user, _ := crypto.GenerateKey()
+	outsider, _ := crypto.GenerateKey()
+	ownerAddr, userAddr := client.Address(owner), client.Address(user)
+	fileId := "queryrpcfile1"
+	err := core.InitFile(ownerAddr, fileId, "", &core.AllowTableT{ownerAddr: core.Readonly, userAddr: core.Readwrite},
+		&core.MortgageTableT{userAddr: *big.NewInt(1000)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	newClient := func(key *ecdsa.PrivateKey) *client.Client {
+		return client.New(api.URL+"/api", client.NewSigner(key, conf.Api.ChainId, conf.Api.ServiceAddress))
+	}
+	userClient := newClient(user)
+	if err = userClient.Subtract(fileId, big.NewInt(100)); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := newClient(owner).GetFileInfo(fileId)
+	if err != nil || info.Owner != ownerAddr || info.State != "open" || len(info.Settlements) != 0 {
+		t.Errorf("unexpected file info %+v, %v", info, err)
+	}
+	participants, err := userClient.ListParticipants(fileId)
+	if err != nil || len(participants) != 2 {
+		t.Fatalf("unexpected participants %+v, %v", participants, err)
+	}
+	for _, p := range participants {
+		if p.User == userAddr && (p.Privilege != "readwrite" || p.Balance != "0x384") {
+			t.Errorf("unexpected participant %+v", p)
+		}
+	}
+	operations, err := userClient.ListOperations(fileId, client.OperationFilter{User: userAddr, Offset: 1})
+	if err != nil || operations.Total != 2 || len(operations.Operations) != 1 || operations.Operations[0].Value != "0x64" {
+		t.Errorf("unexpected operations %+v, %v", operations, err)
+	}
+	files, err := userClient.ListMyFiles()
+	if err != nil || len(files) != 1 || files[0].FileId != fileId || files[0].Privilege != "readwrite" {
+		t.Errorf("unexpected files %+v, %v", files, err)
+	}
+
+	_, err = newClient(outsider).GetFileInfo(fileId)
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != permissionErrorCode {
+		t.Errorf("expected an outsider to be refused, got %v", err)
+	}
+	files, err = newClient(outsider).ListMyFiles()
+	if err != nil || len(files) != 0 {
+		t.Errorf("expected no files for an outsider, got %+v, %v", files, err)
+	}
+}
+
+func TestPrivilegeRequests(t *testing.T) {
+	owner, _ := crypto.GenerateKey()
+	user, _ := crypto.GenerateKey()
+	ownerAddr, userAddr := client.Address(owner), client.Address(user)
+	fileId := "privilegerpcfile1"
+	err := core.InitFile(ownerAddr, fileId, "", &core.AllowTableT{}, &core.MortgageTableT{userAddr: *big.NewInt(10)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	newClient := func(key *ecdsa.PrivateKey) *client.Client {
+		return client.New(api.URL+"/api", client.NewSigner(key, conf.Api.ChainId, conf.Api.ServiceAddress))
+	}
+	ownerClient, userClient := newClient(owner), newClient(user)
+
+	_, err = userClient.GrantPrivilege(fileId, userAddr, client.Readwrite, client.Limits{})
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != permissionErrorCode {
+		t.Errorf("expected a grant by a non-owner to be refused, got %v", err)
+	}
+	_, err = ownerClient.GrantPrivilege(fileId, userAddr, "admin", client.Limits{})
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != invalidParamsCode {
+		t.Errorf("expected an unknown privilege to be refused, got %v", err)
+	}
+	// addresses are checksummed before they are stored
+	event, err := ownerClient.GrantPrivilege(fileId, strings.ToLower(userAddr), client.Write, client.Limits{})
+	if err != nil || event.User != userAddr || event.Action != core.PrivilegeGrant || event.Actor != ownerAddr || "" == event.Signature {
+		t.Fatalf("unexpected grant %+v, %v", event, err)
+	}
+	if err = userClient.Subtract(fileId, big.NewInt(3)); err != nil {
+		t.Errorf("expected the granted user to subtract, got %v", err)
+	}
+	if _, err = ownerClient.RevokePrivilege(fileId, userAddr); err != nil {
+		t.Fatal(err)
+	}
+	err = userClient.Subtract(fileId, big.NewInt(3))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != permissionErrorCode {
+		t.Errorf("expected the revoked user to be refused, got %v", err)
+	}
+
+	events, err := ownerClient.ListPrivilegeEvents(fileId)
+	if err != nil || len(events) != 2 || events[1].Action != core.PrivilegeRevoke || events[1].Previous != client.Write || events[1].Privilege != "none" {
+		t.Errorf("unexpected events %+v, %v", events, err)
+	}
+}
+
+func TestPrivilegeLimitRequests(t *testing.T) {
+	owner, _ := crypto.GenerateKey()
+	user, _ := crypto.GenerateKey()
+	ownerAddr, userAddr := client.Address(owner), client.Address(user)
+	fileId := "limitrpcfile1"
+	err := core.InitFile(ownerAddr, fileId, "", &core.AllowTableT{}, &core.MortgageTableT{userAddr: *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	ownerClient := client.New(api.URL+"/api", client.NewSigner(owner, conf.Api.ChainId, conf.Api.ServiceAddress))
+	userClient := client.New(api.URL+"/api", client.NewSigner(user, conf.Api.ChainId, conf.Api.ServiceAddress))
+
+	until := uint64(time.Now().Add(time.Hour).Unix())
+	limits := client.Limits{ValidUntil: until, MaxAmount: (*hexutil.Big)(big.NewInt(10))}
+	event, err := ownerClient.GrantPrivilege(fileId, userAddr, "readOwn|charge", limits)
+	if err != nil || event.ValidUntil != until || event.MaxAmount.ToInt().Int64() != 10 || nil != event.DailyCap {
+		t.Fatalf("unexpected grant %+v, %v", event, err)
+	}
+	err = userClient.Subtract(fileId, big.NewInt(11))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != limitErrorCode {
+		t.Errorf("expected a subtract above the maximum to be refused, got %v", err)
+	}
+	if err = userClient.Subtract(fileId, big.NewInt(10)); err != nil {
+		t.Errorf("expected a subtract within the limits, got %v", err)
+	}
+	participants, err := ownerClient.ListParticipants(fileId)
+	if err != nil || len(participants) != 1 || participants[0].Privilege != "readOwn|charge" || participants[0].ValidUntil != until {
+		t.Errorf("unexpected participants %+v, %v", participants, err)
+	}
+}
+
+func TestDelegationRequests(t *testing.T) {
+	owner, _ := crypto.GenerateKey()
+	user, _ := crypto.GenerateKey()
+	session, _ := crypto.GenerateKey()
+	ownerAddr, userAddr, sessionAddr := client.Address(owner), client.Address(user), client.Address(session)
+	fileId := "delegationrpcfile1"
+	err := core.InitFile(ownerAddr, fileId, "", &core.AllowTableT{userAddr: core.Readwrite}, &core.MortgageTableT{userAddr: *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	userClient := client.New(api.URL+"/api", client.NewSigner(user, conf.Api.ChainId, conf.Api.ServiceAddress))
+	sessionClient := client.New(api.URL+"/api", client.NewSigner(session, conf.Api.ChainId, conf.Api.ServiceAddress))
+
+	err = sessionClient.SubtractFor(fileId, userAddr, big.NewInt(1))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != signatureErrorCode {
+		t.Errorf("expected a subtract signed by another key to be refused, got %v", err)
+	}
+	until := uint64(time.Now().Add(time.Hour).Unix())
+	delegation, err := userClient.Delegate(fileId, strings.ToLower(sessionAddr), big.NewInt(15), until)
+	if err != nil || delegation.Delegate != sessionAddr || delegation.Remaining.ToInt().Int64() != 15 || delegation.ValidUntil != int64(until) {
+		t.Fatalf("unexpected delegation %+v, %v", delegation, err)
+	}
+	if err = sessionClient.SubtractFor(fileId, userAddr, big.NewInt(10)); err != nil {
+		t.Errorf("expected the session key to subtract, got %v", err)
+	}
+	err = sessionClient.SubtractFor(fileId, userAddr, big.NewInt(10))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != limitErrorCode {
+		t.Errorf("expected a subtract above the allowance to be refused, got %v", err)
+	}
+	if balance, err := userClient.Read(fileId, userAddr); err != nil || balance.Int64() != 90 {
+		t.Errorf("unexpected balance %v, %v", balance, err)
+	}
+	delegations, err := userClient.ListDelegations(fileId)
+	if err != nil || len(delegations) != 1 || delegations[0].Spent.ToInt().Int64() != 10 {
+		t.Errorf("unexpected delegations %+v, %v", delegations, err)
+	}
+	if err = userClient.RevokeDelegation(fileId, sessionAddr); err != nil {
+		t.Fatal(err)
+	}
+	err = sessionClient.SubtractFor(fileId, userAddr, big.NewInt(1))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != signatureErrorCode {
+		t.Errorf("expected a revoked session key to be refused, got %v", err)
+	}
+}
+
+func TestAllowanceRequests(t *testing.T) {
+	owner, _ := crypto.GenerateKey()
+	user, _ := crypto.GenerateKey()
+	payee, _ := crypto.GenerateKey()
+	ownerAddr, userAddr, payeeAddr := client.Address(owner), client.Address(user), client.Address(payee)
+	fileId := "allowancerpcfile1"
+	err := core.InitFile(ownerAddr, fileId, "", &core.AllowTableT{userAddr: core.Readwrite}, &core.MortgageTableT{userAddr: *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	userClient := client.New(api.URL+"/api", client.NewSigner(user, conf.Api.ChainId, conf.Api.ServiceAddress))
+	payeeClient := client.New(api.URL+"/api", client.NewSigner(payee, conf.Api.ChainId, conf.Api.ServiceAddress))
+
+	allowance, err := userClient.Approve(fileId, payeeAddr, big.NewInt(40))
+	if err != nil || allowance.Spender != payeeAddr || allowance.Remaining.ToInt().Int64() != 40 {
+		t.Fatalf("unexpected approve %+v, %v", allowance, err)
+	}
+	allowance, err = payeeClient.Charge(fileId, userAddr, big.NewInt(30))
+	if err != nil || allowance.Remaining.ToInt().Int64() != 10 || allowance.Balance.ToInt().Int64() != 70 {
+		t.Errorf("unexpected charge %+v, %v", allowance, err)
+	}
+	_, err = payeeClient.Charge(fileId, userAddr, big.NewInt(11))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != limitErrorCode {
+		t.Errorf("expected a charge above the allowance to be refused, got %v", err)
+	}
+	allowance, err = payeeClient.Allowance(fileId, userAddr, payeeAddr)
+	if err != nil || allowance.Remaining.ToInt().Int64() != 10 || allowance.Balance.ToInt().Int64() != 70 {
+		t.Errorf("unexpected allowance %+v, %v", allowance, err)
+	}
+	stranger, _ := crypto.GenerateKey()
+	strangerClient := client.New(api.URL+"/api", client.NewSigner(stranger, conf.Api.ChainId, conf.Api.ServiceAddress))
+	_, err = strangerClient.Allowance(fileId, userAddr, client.Address(stranger))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != permissionErrorCode {
+		t.Errorf("expected a stranger naming itself as spender not to read the balance, got %v", err)
+	}
+}
+
+func TestPayeeRequests(t *testing.T) {
+	owner, _ := crypto.GenerateKey()
+	user, _ := crypto.GenerateKey()
+	provider, _ := crypto.GenerateKey()
+	ownerAddr, userAddr, providerAddr := client.Address(owner), client.Address(user), client.Address(provider)
+	fileId := "payeerpcfile1"
+	err := core.InitFile(ownerAddr, fileId, "", &core.AllowTableT{userAddr: core.Readwrite}, &core.MortgageTableT{userAddr: *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	ownerClient := client.New(api.URL+"/api", client.NewSigner(owner, conf.Api.ChainId, conf.Api.ServiceAddress))
+	userSigner := client.NewSigner(user, conf.Api.ChainId, conf.Api.ServiceAddress)
+	userClient := client.New(api.URL+"/api", userSigner)
+	providerClient := client.New(api.URL+"/api", client.NewSigner(provider, conf.Api.ChainId, conf.Api.ServiceAddress))
+
+	if err = userClient.Subtract(fileId, big.NewInt(10)); err != nil {
+		t.Fatal(err)
+	}
+	if err = userClient.SubtractTo(fileId, big.NewInt(30), strings.ToLower(providerAddr)); err != nil {
+		t.Fatal(err)
+	}
+	// the payee is signed
+	req, _ := userSigner.SubtractToRequest(1000, fileId, userAddr, big.NewInt(1), providerAddr)
+	req.Params.Payee = userAddr
+	_, err = userClient.Send(req)
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != signatureErrorCode {
+		t.Errorf("expected a changed payee to be refused, got %v", err)
+	}
+
+	earnings, err := ownerClient.ListEarnings(fileId)
+	if err != nil || earnings[ownerAddr] != "0xa" || earnings[providerAddr] != "0x1e" {
+		t.Errorf("unexpected earnings %v, %v", earnings, err)
+	}
+	earnings, err = providerClient.ListEarnings(fileId)
+	if err != nil || len(earnings) != 1 || earnings[providerAddr] != "0x1e" {
+		t.Errorf("unexpected earnings of the provider %v, %v", earnings, err)
+	}
+}
+
+func TestTransferRequests(t *testing.T) {
+	owner, _ := crypto.GenerateKey()
+	sender, _ := crypto.GenerateKey()
+	recipient, _ := crypto.GenerateKey()
+	ownerAddr, senderAddr, recipientAddr := client.Address(owner), client.Address(sender), client.Address(recipient)
+	fileId := "transferrpcfile1"
+	err := core.InitFile(ownerAddr, fileId, "", &core.AllowTableT{senderAddr: core.Readwrite, recipientAddr: core.Readonly},
+		&core.MortgageTableT{senderAddr: *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	senderSigner := client.NewSigner(sender, conf.Api.ChainId, conf.Api.ServiceAddress)
+	senderClient := client.New(api.URL+"/api", senderSigner)
+	recipientClient := client.New(api.URL+"/api", client.NewSigner(recipient, conf.Api.ChainId, conf.Api.ServiceAddress))
+
+	balance, err := senderClient.Transfer(fileId, strings.ToLower(recipientAddr), big.NewInt(40))
+	if err != nil || balance.Int64() != 60 {
+		t.Fatalf("unexpected transfer %v, %v", balance, err)
+	}
+	if balance, err = recipientClient.Read(fileId, recipientAddr); err != nil || balance.Int64() != 40 {
+		t.Errorf("unexpected balance of the recipient %v, %v", balance, err)
+	}
+	// the recipient is signed, changing it recovers another signer
+	req, _ := senderSigner.TransferRequest(1000, fileId, recipientAddr, big.NewInt(1))
+	req.Params.Data = ownerAddr
+	if _, err = senderClient.Send(req); err == nil {
+		t.Errorf("expected a changed recipient to be refused")
+	}
+	if balance, err = senderClient.Read(fileId, senderAddr); err != nil || balance.Int64() != 60 {
+		t.Errorf("unexpected balance of the sender %v, %v", balance, err)
+	}
+	_, err = recipientClient.Transfer(fileId, senderAddr, big.NewInt(1))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != permissionErrorCode {
+		t.Errorf("expected a reader not to transfer, got %v", err)
+	}
+	_, err = senderClient.Transfer(fileId, ownerAddr, big.NewInt(1))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != invalidParamsCode {
+		t.Errorf("expected a transfer to a stranger to be refused, got %v", err)
+	}
+	_, err = senderClient.Transfer(fileId, recipientAddr, big.NewInt(61))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != balanceErrorCode {
+		t.Errorf("expected a transfer above the balance to be refused, got %v", err)
+	}
+}
+
+func TestHoldRequests(t *testing.T) {
+	owner, _ := crypto.GenerateKey()
+	user, _ := crypto.GenerateKey()
+	payee, _ := crypto.GenerateKey()
+	ownerAddr, userAddr, payeeAddr := client.Address(owner), client.Address(user), client.Address(payee)
+	fileId := "holdrpcfile1"
+	err := core.InitFile(ownerAddr, fileId, "", &core.AllowTableT{userAddr: core.Readwrite}, &core.MortgageTableT{userAddr: *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	userClient := client.New(api.URL+"/api", client.NewSigner(user, conf.Api.ChainId, conf.Api.ServiceAddress))
+	payeeClient := client.New(api.URL+"/api", client.NewSigner(payee, conf.Api.ChainId, conf.Api.ServiceAddress))
+	ownerClient := client.New(api.URL+"/api", client.NewSigner(owner, conf.Api.ChainId, conf.Api.ServiceAddress))
+
+	hold, err := userClient.Reserve(fileId, payeeAddr, big.NewInt(60), uint64(time.Now().Add(time.Minute).Unix()))
+	if err != nil || hold.Payee != payeeAddr || hold.Status != core.HoldActive {
+		t.Fatalf("unexpected reserve %+v, %v", hold, err)
+	}
+	balance, err := userClient.ReadBalance(fileId, userAddr)
+	if err != nil || balance.Balance.ToInt().Int64() != 100 || balance.Held.ToInt().Int64() != 60 || balance.Available.ToInt().Int64() != 40 {
+		t.Errorf("unexpected balance %+v, %v", balance, err)
+	}
+	// a plain read still returns the balance alone
+	if value, err := userClient.Read(fileId, userAddr); err != nil || value.Int64() != 100 {
+		t.Errorf("unexpected read %v, %v", value, err)
+	}
+	err = userClient.Subtract(fileId, big.NewInt(41))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != balanceErrorCode {
+		t.Errorf("expected a subtract of held value to be refused, got %v", err)
+	}
+	_, err = ownerClient.Capture(fileId, uint64(hold.Id), big.NewInt(1))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != invalidParamsCode {
+		t.Errorf("expected a third party not to capture, got %v", err)
+	}
+	captured, err := payeeClient.Capture(fileId, uint64(hold.Id), big.NewInt(45))
+	if err != nil || captured.Status != core.HoldCaptured || captured.Captured.ToInt().Int64() != 45 || captured.Balance.ToInt().Int64() != 55 {
+		t.Errorf("unexpected capture %+v, %v", captured, err)
+	}
+	participants, err := ownerClient.ListParticipants(fileId)
+	if err != nil || len(participants) != 1 || participants[0].Balance != "0x37" || participants[0].Held != "0x0" {
+		t.Errorf("unexpected participants %+v, %v", participants, err)
+	}
+
+	hold, err = userClient.Reserve(fileId, payeeAddr, big.NewInt(10), uint64(time.Now().Add(time.Minute).Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = userClient.Release(fileId, uint64(hold.Id))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != permissionErrorCode {
+		t.Errorf("expected the user not to release its hold, got %v", err)
+	}
+	released, err := payeeClient.Release(fileId, uint64(hold.Id))
+	if err != nil || released.Status != core.HoldReleased {
+		t.Errorf("unexpected release %+v, %v", released, err)
+	}
+}
+
+func TestReversalRequests(t *testing.T) {
+	owner, _ := crypto.GenerateKey()
+	user, _ := crypto.GenerateKey()
+	payee, _ := crypto.GenerateKey()
+	ownerAddr, userAddr, payeeAddr := client.Address(owner), client.Address(user), client.Address(payee)
+	fileId := "reversalrpcfile1"
+	err := core.InitFile(ownerAddr, fileId, "", &core.AllowTableT{userAddr: core.Readwrite}, &core.MortgageTableT{userAddr: *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	userClient := client.New(api.URL+"/api", client.NewSigner(user, conf.Api.ChainId, conf.Api.ServiceAddress))
+	ownerClient := client.New(api.URL+"/api", client.NewSigner(owner, conf.Api.ChainId, conf.Api.ServiceAddress))
+
+	if err = userClient.SubtractTo(fileId, big.NewInt(40), payeeAddr); err != nil {
+		t.Fatal(err)
+	}
+	operations, err := ownerClient.ListOperations(fileId, client.OperationFilter{})
+	if err != nil || len(operations.Operations) != 2 {
+		t.Fatalf("unexpected operations %+v, %v", operations, err)
+	}
+	subtract := uint64(operations.Operations[1].Id)
+	_, err = userClient.Reverse(fileId, subtract, big.NewInt(40), "")
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != permissionErrorCode {
+		t.Errorf("expected a user not to reverse its subtract, got %v", err)
+	}
+	manager, _ := crypto.GenerateKey()
+	managerClient := client.New(api.URL+"/api", client.NewSigner(manager, conf.Api.ChainId, conf.Api.ServiceAddress))
+	if _, err = ownerClient.GrantPrivilege(fileId, client.Address(manager), "manager", client.Limits{}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = managerClient.Reverse(fileId, subtract, big.NewInt(40), "")
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != permissionErrorCode {
+		t.Errorf("expected a manager not to reverse, got %v", err)
+	}
+	_, err = ownerClient.Reverse(fileId, subtract, big.NewInt(41), "")
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != limitErrorCode {
+		t.Errorf("expected a reversal above the subtract to be refused, got %v", err)
+	}
+	reversal, err := ownerClient.Reverse(fileId, subtract, big.NewInt(15), "refund")
+	if err != nil || reversal.User != userAddr || reversal.Payee != payeeAddr || reversal.Amount.ToInt().Int64() != 15 || reversal.Reason != "refund" {
+		t.Fatalf("unexpected reversal %+v, %v", reversal, err)
+	}
+	if value, err := userClient.Read(fileId, userAddr); err != nil || value.Int64() != 75 {
+		t.Errorf("expected the reversal to be credited back, got %v, %v", value, err)
+	}
+	if earnings, err := ownerClient.ListEarnings(fileId); err != nil || earnings[payeeAddr] != "0x19" {
+		t.Errorf("expected the reversal to be taken from the payee, got %v, %v", earnings, err)
+	}
+	operations, err = ownerClient.ListOperations(fileId, client.OperationFilter{})
+	if err != nil || len(operations.Operations) != 3 || operations.Operations[2].Id != reversal.Id || operations.Operations[2].Reverses != int64(subtract) {
+		t.Errorf("expected the reversal in the history, got %+v, %v", operations, err)
+	}
+}
+
+func TestOperationMetaRequests(t *testing.T) {
+	owner, _ := crypto.GenerateKey()
+	user, _ := crypto.GenerateKey()
+	ownerAddr, userAddr := client.Address(owner), client.Address(user)
+	fileId := "metarpcfile1"
+	err := core.InitFile(ownerAddr, fileId, "", &core.AllowTableT{userAddr: core.Readwrite}, &core.MortgageTableT{userAddr: *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	userSigner := client.NewSigner(user, conf.Api.ChainId, conf.Api.ServiceAddress)
+	userClient := client.New(api.URL+"/api", userSigner)
+	ownerSigner := client.NewSigner(owner, conf.Api.ChainId, conf.Api.ServiceAddress)
+	ownerClient := client.New(api.URL+"/api", ownerSigner)
+
+	req, err := userSigner.SubtractRequest(userClient.NextId(), fileId, big.NewInt(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reference and memo are not signed, so they can be set after signing
+	if _, err = userClient.Send(req.WithMeta("invoice-9", "march usage")); err != nil {
+		t.Fatal(err)
+	}
+	req, err = userSigner.SubtractRequest(userClient.NextId(), fileId, big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = userClient.Send(req.WithMeta(strings.Repeat("r", 129), ""))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != invalidParamsCode {
+		t.Errorf("expected a reference too long to be refused, got %v", err)
+	}
+
+	operations, err := ownerClient.ListOperations(fileId, client.OperationFilter{})
+	if err != nil || len(operations.Operations) != 2 {
+		t.Fatalf("unexpected operations %+v, %v", operations, err)
+	}
+	subtract := operations.Operations[1]
+	if subtract.Reference != "invoice-9" || subtract.Memo != "march usage" || subtract.Signer != userAddr ||
+		subtract.RequestId != fmt.Sprint(req.Id-1) || nil != subtract.Request {
+		t.Errorf("unexpected subtract %+v", subtract)
+	}
+	query, err := ownerSigner.ListOperationsRequest(ownerClient.NextId(), fileId, client.OperationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query.Params.Details = true
+	var detailed client.Operations
+	result, err := ownerClient.Send(query)
+	if err == nil {
+		err = json.Unmarshal(result, &detailed)
+	}
+	if err != nil || len(detailed.Operations) != 2 {
+		t.Fatalf("unexpected operations %+v, %v", detailed, err)
+	}
+	// the signed request proves the user authorised the subtract
+	var signed client.Request
+	if err = json.Unmarshal(detailed.Operations[1].Request, &signed); err != nil || signed.Method != "subtract" ||
+		signed.Params.Signature == "" || signed.Params.Reference != "invoice-9" {
+		t.Errorf("unexpected signed request %s, %v", detailed.Operations[1].Request, err)
+	}
+}
+
+func TestIdempotentRequests(t *testing.T) {
+	owner, _ := crypto.GenerateKey()
+	user, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	ownerAddr, userAddr, otherAddr := client.Address(owner), client.Address(user), client.Address(other)
+	fileId := "idempotentrpcfile1"
+	err := core.InitFile(ownerAddr, fileId, "", &core.AllowTableT{userAddr: core.Readwrite, otherAddr: core.Readwrite},
+		&core.MortgageTableT{userAddr: *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	signer := client.NewSigner(user, conf.Api.ChainId, conf.Api.ServiceAddress)
+	userClient := client.New(api.URL+"/api", signer)
+	send := func(req *client.Request, err error) (json.RawMessage, error) {
+		if err != nil {
+			return nil, err
+		}
+		return userClient.Send(req.WithIdempotencyKey("charge-1"))
+	}
+
+	first, err := signer.SubtractRequest(userClient.NextId(), fileId, big.NewInt(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = send(first, nil); err != nil {
+		t.Fatal(err)
+	}
+	// a retry signed again, or the very same request, returns the first result
+	if result, err := send(signer.SubtractRequest(userClient.NextId(), fileId, big.NewInt(10))); err != nil || string(result) != "1" {
+		t.Errorf("unexpected retry %s, %v", result, err)
+	}
+	if result, err := send(first, nil); err != nil || string(result) != "1" {
+		t.Errorf("unexpected resend %s, %v", result, err)
+	}
+	if value, err := userClient.Read(fileId, userAddr); err != nil || value.Int64() != 90 {
+		t.Errorf("expected one subtract, got %v, %v", value, err)
+	}
+	_, err = send(signer.SubtractRequest(userClient.NextId(), fileId, big.NewInt(11)))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != idempotencyErrorCode {
+		t.Errorf("expected the key to be refused to another subtract, got %v", err)
+	}
+	_, err = send(signer.TransferRequest(userClient.NextId(), fileId, otherAddr, big.NewInt(10)))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != idempotencyErrorCode {
+		t.Errorf("expected the key to be refused to a transfer, got %v", err)
+	}
+
+	// a rejected request keeps its key, its retries get the same error
+	failed, err := signer.TransferRequest(userClient.NextId(), fileId, otherAddr, big.NewInt(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed.WithIdempotencyKey("transfer-1")
+	if _, err = userClient.Send(failed); err == nil {
+		t.Fatal("expected a transfer above the balance to fail")
+	}
+	err = core.Deposit(&core.DepositT{TxHash: "0xidempotentdeposit1", FileId: fileId, From: ownerAddr},
+		&core.MortgageTableT{userAddr: *big.NewInt(1000)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retry, err := signer.TransferRequest(userClient.NextId(), fileId, otherAddr, big.NewInt(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = userClient.Send(retry.WithIdempotencyKey("transfer-1"))
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != balanceErrorCode {
+		t.Errorf("expected the retry of a rejected transfer to get its error, got %v", err)
+	}
+	if value, err := userClient.Read(fileId, userAddr); err != nil || value.Int64() != 1090 {
+		t.Errorf("expected the rejected transfer not to run again, got %v, %v", value, err)
+	}
+}
+
+func TestTerminateRequests(t *testing.T) {
+	owner, _ := crypto.GenerateKey()
+	ownerAddr := client.Address(owner)
+	fileId := "terminaterpcfile1"
+	err := core.InitFile(ownerAddr, fileId, "", &core.AllowTableT{}, &core.MortgageTableT{ownerAddr: *big.NewInt(100)}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(newServer())
+	defer api.Close()
+	signer := client.NewSigner(owner, conf.Api.ChainId, conf.Api.ServiceAddress)
+	ownerClient := client.New(api.URL+"/api", signer)
+
+	first, err := signer.TerminateRequest(ownerClient.NextId(), fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := ownerClient.Send(first.WithIdempotencyKey("terminate-1")); err != nil || string(result) != "0" {
+		t.Fatalf("unexpected terminate %s, %v", result, err)
+	}
+	// a retry under the key gets the first result, the same request without it is refused
+	retry, err := signer.TerminateRequest(ownerClient.NextId(), fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := ownerClient.Send(retry.WithIdempotencyKey("terminate-1")); err != nil || string(result) != "0" {
+		t.Errorf("unexpected retry %s, %v", result, err)
+	}
+	first.WithIdempotencyKey("")
+	_, err = ownerClient.Send(first)
+	if rpcErr, ok := err.(*client.RpcError); !ok || rpcErr.Code != replayErrorCode {
+		t.Errorf("expected the request to be accepted once, got %v", err)
+	}
+	file, err := core.GetFileInfo(fileId)
+	if err != nil || file.IsOpen || file.State != core.FileStateSettling {
+		t.Errorf("unexpected file %+v, %v", file, err)
+	}
+}
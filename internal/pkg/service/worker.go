@@ -0,0 +1,112 @@
+package service
+
+import (
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/internal/pkg/core"
+	"time"
+)
+
+// sync state holding the last block whose mortgage inits were ingested
+const lastBlockState = "lastBlock"
+
+// blocks ingested per round, so a new ledger catches up in bounded steps
+const maxIngestBlocks = 1000
+
+// IngestNewBlocks ingests the blocks after the last ingested one, up to
+// maxIngestBlocks of them, and remembers how far it got. A range that fails, a block
+// that cannot be loaded included, is ingested again in the next round.
+func IngestNewBlocks() (int, error) {
+	start, err := hexutil.DecodeUint64(conf.Chain.StartBlock)
+	if err != nil {
+		return 0, err
+	}
+	last, err := core.GetSyncState(lastBlockState)
+	if err != nil {
+		return 0, err
+	}
+	if "" != last {
+		lastNum, err := hexutil.DecodeUint64(last)
+		if err != nil {
+			return 0, err
+		}
+		start = lastNum + 1
+	}
+	latest := GetBlockNumber()
+	end, err := hexutil.DecodeUint64(latest)
+	if err != nil || 0 == end {
+		return 0, fmt.Errorf("unable to get current block number from %s", conf.Chain.Url)
+	}
+	if start > end {
+		return 0, nil
+	}
+	if end-start >= maxIngestBlocks {
+		end = start + maxIngestBlocks - 1
+	}
+	created, err := IngestBlockRange(hexutil.EncodeUint64(start), hexutil.EncodeUint64(end))
+	if err != nil {
+		return created, err
+	}
+	return created, core.SetSyncState(lastBlockState, hexutil.EncodeUint64(end))
+}
+
+// RunIngester ingests new blocks every conf.Chain.PollInterval until stop is closed.
+func RunIngester(stop <-chan struct{}) {
+	ticker := time.NewTicker(conf.Chain.PollInterval)
+	defer ticker.Stop()
+	for {
+		created, err := IngestNewBlocks()
+		if err != nil {
+			chainLog.Errorf("ingestion failed: %s", err)
+		} else if created > 0 {
+			chainLog.Infof("ingested %d files", created)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// RunSettlementWorker settles expired files, checks pending sync transactions, sends
+// the next settlement chunks, forgets expired signed requests and expires stale holds
+// every conf.Settlement.Interval until stop is closed.
+func RunSettlementWorker(stop <-chan struct{}) {
+	ticker := time.NewTicker(conf.Settlement.Interval)
+	defer ticker.Stop()
+	for {
+		settled, err := core.SettleExpiredFiles(time.Now().Unix())
+		if err != nil {
+			chainLog.Errorf("unable to settle expired files: %s", err)
+		}
+		for _, fileId := range settled {
+			chainLog.Infof("file %s expired and is being settled", fileId)
+		}
+		ConfirmSettlements()
+		SendSettlements()
+		pruned, err := core.PruneRequests(time.Now().Unix())
+		if err != nil {
+			chainLog.Errorf("unable to prune expired requests: %s", err)
+		} else if pruned > 0 {
+			chainLog.Debugf("forgot %d expired requests", pruned)
+		}
+		pruned, err = core.PruneIdempotencyKeys(time.Now().Add(-conf.Api.IdempotencyKeyLifetime).Unix())
+		if err != nil {
+			chainLog.Errorf("unable to prune idempotency keys: %s", err)
+		} else if pruned > 0 {
+			chainLog.Debugf("forgot %d idempotency keys", pruned)
+		}
+		expired, err := core.ExpireHolds(time.Now().Unix())
+		if err != nil {
+			chainLog.Errorf("unable to expire holds: %s", err)
+		} else if expired > 0 {
+			chainLog.Debugf("expired %d holds", expired)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
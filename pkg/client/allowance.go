@@ -0,0 +1,69 @@
+package client
+
+import (
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/pkg/reqsig"
+	"math/big"
+)
+
+// Allowance is what Spender may still charge to the balance of User in a file.
+type Allowance struct {
+	User      string       `json:"user"`
+	Spender   string       `json:"spender"`
+	Remaining *hexutil.Big `json:"remaining"`
+	// balance of the user, but after an approve
+	Balance *hexutil.Big `json:"balance,omitempty"`
+	Time    int64        `json:"time,omitempty"`
+}
+
+// ApproveRequest builds the request letting spender charge up to amount to the signer's
+// balance in file fileId, replacing what was left of a previous allowance. Zero removes
+// the allowance.
+func (s *Signer) ApproveRequest(id uint64, fileId string, spender string, amount *big.Int) (*Request, error) {
+	expiry := s.expiry()
+	msg := &reqsig.Message{Method: "approve", FileId: fileId, Spender: spender, Amount: amount, Expiry: expiry}
+	return s.sign(id, msg, &Params{FileId: fileId, Data: spender, Amount: (*hexutil.Big)(amount), Expiry: expiry})
+}
+
+// ChargeRequest builds the request charging amount to the balance of user in file
+// fileId, within the allowance user gave the signer.
+func (s *Signer) ChargeRequest(id uint64, fileId string, user string, amount *big.Int) (*Request, error) {
+	expiry := s.expiry()
+	msg := &reqsig.Message{Method: "charge", FileId: fileId, User: user, Amount: amount, Expiry: expiry}
+	return s.sign(id, msg, &Params{FileId: fileId, Data: user, Amount: (*hexutil.Big)(amount), Expiry: expiry})
+}
+
+// AllowanceRequest builds the request reading the allowance user gave spender in file
+// fileId and the balance of user. The signer must be one of them or allowed to read all
+// balances.
+func (s *Signer) AllowanceRequest(id uint64, fileId string, user string, spender string) (*Request, error) {
+	msg := &reqsig.Message{Method: "allowance", FileId: fileId, User: user, Spender: spender}
+	return s.sign(id, msg, &Params{FileId: fileId, Data: user, Spender: spender})
+}
+
+// Approve lets spender charge up to amount to the client's balance in file fileId, see
+// ApproveRequest.
+func (c *Client) Approve(fileId string, spender string, amount *big.Int) (*Allowance, error) {
+	var allowance Allowance
+	req, err := c.signer.ApproveRequest(c.NextId(), fileId, spender, amount)
+	err = c.query(req, err, &allowance)
+	return &allowance, err
+}
+
+// Charge charges amount to the balance of user in file fileId within its allowance to
+// the client, and returns the allowance and the balance after it.
+func (c *Client) Charge(fileId string, user string, amount *big.Int) (*Allowance, error) {
+	var allowance Allowance
+	req, err := c.signer.ChargeRequest(c.NextId(), fileId, user, amount)
+	err = c.query(req, err, &allowance)
+	return &allowance, err
+}
+
+// Allowance returns the allowance user gave spender in file fileId with the balance of
+// user, see AllowanceRequest.
+func (c *Client) Allowance(fileId string, user string, spender string) (*Allowance, error) {
+	var allowance Allowance
+	req, err := c.signer.AllowanceRequest(c.NextId(), fileId, user, spender)
+	err = c.query(req, err, &allowance)
+	return &allowance, err
+}
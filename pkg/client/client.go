@@ -0,0 +1,152 @@
+// Package client builds, signs and sends kdc requests.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var UnexpectedResultErr = errors.New("unexpected result")
+
+// RpcError is an error returned by kdc in a json-rpc response.
+type RpcError struct {
+	Code    int         `json:"code,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *RpcError) Error() string {
+	return fmt.Sprintf("kdc error %d: %s", e.Code, e.Message)
+}
+
+type response struct {
+	JsonRpc string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result"`
+	Id      interface{}     `json:"id"`
+	Error   *RpcError       `json:"error"`
+}
+
+// Client sends requests signed by one signer to a kdc api.
+type Client struct {
+	url    string
+	signer *Signer
+	lastId uint64
+	// HTTPClient sends the requests, it can be replaced before the first call.
+	HTTPClient *http.Client
+}
+
+// New returns a client of the kdc api at url, e.g. http://127.0.0.1:8080/api, signing
+// with signer.
+func New(url string, signer *Signer) *Client {
+	return &Client{
+		url:    url,
+		signer: signer,
+		// ids travel as json numbers, keep them exact as float64
+		lastId:     uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Address returns the account the client signs for.
+func (c *Client) Address() string {
+	return c.signer.Address()
+}
+
+// NextId returns a request id not used before by this client.
+func (c *Client) NextId() uint64 {
+	return atomic.AddUint64(&c.lastId, 1)
+}
+
+// Subtract spends amount of the client's balance in file fileId.
+func (c *Client) Subtract(fileId string, amount *big.Int) error {
+	req, err := c.signer.SubtractRequest(c.NextId(), fileId, amount)
+	if err != nil {
+		return err
+	}
+	_, err = c.Send(req)
+	return err
+}
+
+// SubtractTo spends amount of the client's balance in file fileId and credits it to
+// payee instead of the owner of the file.
+func (c *Client) SubtractTo(fileId string, amount *big.Int, payee string) error {
+	req, err := c.signer.SubtractToRequest(c.NextId(), fileId, c.Address(), amount, payee)
+	if err != nil {
+		return err
+	}
+	_, err = c.Send(req)
+	return err
+}
+
+// Read returns the balance of user in file fileId.
+func (c *Client) Read(fileId string, user string) (*big.Int, error) {
+	req, err := c.signer.ReadRequest(c.NextId(), fileId, user)
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	var balance string
+	err = json.Unmarshal(result, &balance)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", UnexpectedResultErr, result)
+	}
+	return hexutil.DecodeBig(balance)
+}
+
+// Terminate terminates file fileId, the client must sign for its owner.
+func (c *Client) Terminate(fileId string) error {
+	req, err := c.signer.TerminateRequest(c.NextId(), fileId)
+	if err != nil {
+		return err
+	}
+	_, err = c.Send(req)
+	return err
+}
+
+// Send posts req and returns the raw result of the response.
+func (c *Client) Send(req *Request) (json.RawMessage, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpResponse, err := c.HTTPClient.Post(c.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	content, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, err
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		// echo errors carry a message field
+		var httpErr struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(content, &httpErr) == nil && "" != httpErr.Message {
+			return nil, &RpcError{Code: httpResponse.StatusCode, Message: httpErr.Message}
+		}
+		return nil, &RpcError{Code: httpResponse.StatusCode, Message: http.StatusText(httpResponse.StatusCode)}
+	}
+	var resp response
+	err = json.Unmarshal(content, &resp)
+	if err != nil {
+		return nil, err
+	}
+	// kdc always sends an error object, empty on success
+	if nil != resp.Error && (0 != resp.Error.Code || "" != resp.Error.Message) {
+		return nil, resp.Error
+	}
+	return resp.Result, nil
+}
@@ -0,0 +1,34 @@
+package client
+
+import (
+	"encoding/hex"
+	"github.com/ethereum/go-ethereum/crypto"
+	"kdc/pkg/reqsig"
+	"math/big"
+	"testing"
+)
+
+func TestSubtractRequest(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	signer := NewSigner(key, 1, "0xa07b0fc50549c636ad4d7fbc6ea747574efb8e8a")
+	for _, scheme := range []reqsig.Scheme{reqsig.TypedData, reqsig.Personal, reqsig.Legacy} {
+		signer.Scheme = scheme
+		req, err := signer.SubtractRequest(7, "file1", big.NewInt(2330))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (scheme == reqsig.Legacy) != (0 == req.Params.Expiry) {
+			t.Errorf("%s: unexpected expiry %d", scheme, req.Params.Expiry)
+		}
+		if req.Params.Data != signer.Address() || req.Params.Amount.String() != "0x91a" || req.Params.SignatureType != string(scheme) {
+			t.Errorf("%s: unexpected request %+v", scheme, req.Params)
+		}
+		msg := &reqsig.Message{Method: "subtract", Id: "7", FileId: "file1", User: signer.Address(), Amount: big.NewInt(2330), Expiry: req.Params.Expiry}
+		digest, _ := msg.Digest(scheme, signer.Domain)
+		sig, _ := hex.DecodeString(req.Params.Signature)
+		signerAddr, err := reqsig.Recover(digest, sig)
+		if err != nil || signerAddr != signer.Address() {
+			t.Errorf("%s: signature recovers to %s, %v", scheme, signerAddr, err)
+		}
+	}
+}
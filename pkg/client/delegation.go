@@ -0,0 +1,82 @@
+package client
+
+import (
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/pkg/reqsig"
+	"math/big"
+)
+
+// Delegation lets a session key or a service address subtract from the balance of a
+// user in a file, up to Cap until ValidUntil.
+type Delegation struct {
+	User       string       `json:"user"`
+	Delegate   string       `json:"delegate"`
+	Cap        *hexutil.Big `json:"cap"`
+	Spent      *hexutil.Big `json:"spent"`
+	Remaining  *hexutil.Big `json:"remaining"`
+	ValidUntil int64        `json:"validUntil"`
+	Signature  string       `json:"signature,omitempty"`
+	Time       int64        `json:"time"`
+}
+
+// DelegateRequest builds the request letting delegate subtract up to cap from the
+// signer's balance in file fileId until the unix time validUntil. The delegate signs its
+// subtracts with SubtractForRequest.
+func (s *Signer) DelegateRequest(id uint64, fileId string, delegate string, cap *big.Int, validUntil uint64) (*Request, error) {
+	expiry := s.expiry()
+	msg := &reqsig.Message{Method: "delegate", FileId: fileId, Delegate: delegate, Amount: cap, ValidUntil: validUntil, Expiry: expiry}
+	return s.sign(id, msg, &Params{FileId: fileId, Data: delegate, Amount: (*hexutil.Big)(cap), Expiry: expiry,
+		Limits: Limits{ValidUntil: validUntil}})
+}
+
+// RevokeDelegationRequest builds the request ending the delegation of the signer to
+// delegate in file fileId.
+func (s *Signer) RevokeDelegationRequest(id uint64, fileId string, delegate string) (*Request, error) {
+	expiry := s.expiry()
+	msg := &reqsig.Message{Method: "revokeDelegation", FileId: fileId, Delegate: delegate, Amount: new(big.Int), Expiry: expiry}
+	return s.sign(id, msg, &Params{FileId: fileId, Data: delegate, Expiry: expiry})
+}
+
+// ListDelegationsRequest builds the request reading the delegations of the signer in
+// file fileId.
+func (s *Signer) ListDelegationsRequest(id uint64, fileId string) (*Request, error) {
+	return s.sign(id, &reqsig.Message{Method: "listDelegations", FileId: fileId}, &Params{FileId: fileId})
+}
+
+// Delegate lets delegate subtract up to cap from the client's balance in file fileId
+// until validUntil, see DelegateRequest.
+func (c *Client) Delegate(fileId string, delegate string, cap *big.Int, validUntil uint64) (*Delegation, error) {
+	var delegation Delegation
+	req, err := c.signer.DelegateRequest(c.NextId(), fileId, delegate, cap, validUntil)
+	err = c.query(req, err, &delegation)
+	return &delegation, err
+}
+
+// RevokeDelegation ends the delegation of the client to delegate in file fileId.
+func (c *Client) RevokeDelegation(fileId string, delegate string) error {
+	req, err := c.signer.RevokeDelegationRequest(c.NextId(), fileId, delegate)
+	if err != nil {
+		return err
+	}
+	_, err = c.Send(req)
+	return err
+}
+
+// ListDelegations returns the delegations of the client in file fileId.
+func (c *Client) ListDelegations(fileId string) ([]Delegation, error) {
+	var delegations []Delegation
+	req, err := c.signer.ListDelegationsRequest(c.NextId(), fileId)
+	err = c.query(req, err, &delegations)
+	return delegations, err
+}
+
+// SubtractFor spends amount of the balance of user in file fileId on its behalf, with a
+// delegation of user to the client.
+func (c *Client) SubtractFor(fileId string, user string, amount *big.Int) error {
+	req, err := c.signer.SubtractForRequest(c.NextId(), fileId, user, amount)
+	if err != nil {
+		return err
+	}
+	_, err = c.Send(req)
+	return err
+}
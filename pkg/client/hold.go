@@ -0,0 +1,100 @@
+package client
+
+import (
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/pkg/reqsig"
+	"math/big"
+)
+
+// Hold is an amount reserved on the balance of User in a file until Payee captures it,
+// either of them releases it or it expires.
+type Hold struct {
+	Id         int64        `json:"id"`
+	User       string       `json:"user"`
+	Payee      string       `json:"payee"`
+	Amount     *hexutil.Big `json:"amount"`
+	Captured   *hexutil.Big `json:"captured,omitempty"`
+	Status     string       `json:"status"`
+	ValidUntil int64        `json:"validUntil"`
+	// balance of the user, but after a reserve or a release
+	Balance *hexutil.Big `json:"balance,omitempty"`
+	Time    int64        `json:"time"`
+}
+
+// Balance is the balance of a user in a file with what active holds reserve of it.
+type Balance struct {
+	Balance   *hexutil.Big `json:"balance"`
+	Held      *hexutil.Big `json:"held"`
+	Available *hexutil.Big `json:"available"`
+}
+
+// ReserveRequest builds the request placing a hold of amount on the signer's balance in
+// file fileId, which payee may capture until validUntil, a unix time.
+func (s *Signer) ReserveRequest(id uint64, fileId string, payee string, amount *big.Int, validUntil uint64) (*Request, error) {
+	expiry := s.expiry()
+	msg := &reqsig.Message{Method: "reserve", FileId: fileId, Payee: payee, Amount: amount, ValidUntil: validUntil, Expiry: expiry}
+	return s.sign(id, msg, &Params{FileId: fileId, Data: payee, Amount: (*hexutil.Big)(amount), Expiry: expiry,
+		Limits: Limits{ValidUntil: validUntil}})
+}
+
+// CaptureRequest builds the request charging amount of hold in file fileId, releasing
+// the rest. The signer must be the user or the payee of the hold.
+func (s *Signer) CaptureRequest(id uint64, fileId string, hold uint64, amount *big.Int) (*Request, error) {
+	expiry := s.expiry()
+	msg := &reqsig.Message{Method: "capture", FileId: fileId, Hold: hold, Amount: amount, Expiry: expiry}
+	return s.sign(id, msg, &Params{FileId: fileId, Hold: hold, Amount: (*hexutil.Big)(amount), Expiry: expiry})
+}
+
+// ReleaseRequest builds the request ending hold in file fileId without charging it. The
+// signer must be the user or the payee of the hold.
+func (s *Signer) ReleaseRequest(id uint64, fileId string, hold uint64) (*Request, error) {
+	expiry := s.expiry()
+	msg := &reqsig.Message{Method: "release", FileId: fileId, Hold: hold, Expiry: expiry}
+	return s.sign(id, msg, &Params{FileId: fileId, Hold: hold, Expiry: expiry})
+}
+
+// ReadBalanceRequest builds the request of ReadRequest returning what holds reserve and
+// what is available with the balance.
+func (s *Signer) ReadBalanceRequest(id uint64, fileId string, user string) (*Request, error) {
+	req, err := s.ReadRequest(id, fileId, user)
+	if err != nil {
+		return nil, err
+	}
+	req.Params.Details = true
+	return req, nil
+}
+
+// Reserve places a hold of amount on the client's balance in file fileId, see
+// ReserveRequest.
+func (c *Client) Reserve(fileId string, payee string, amount *big.Int, validUntil uint64) (*Hold, error) {
+	var hold Hold
+	req, err := c.signer.ReserveRequest(c.NextId(), fileId, payee, amount, validUntil)
+	err = c.query(req, err, &hold)
+	return &hold, err
+}
+
+// Capture charges amount of hold in file fileId and returns the hold and the balance of
+// its user after it.
+func (c *Client) Capture(fileId string, hold uint64, amount *big.Int) (*Hold, error) {
+	var captured Hold
+	req, err := c.signer.CaptureRequest(c.NextId(), fileId, hold, amount)
+	err = c.query(req, err, &captured)
+	return &captured, err
+}
+
+// Release ends hold in file fileId without charging it, on behalf of its payee.
+func (c *Client) Release(fileId string, hold uint64) (*Hold, error) {
+	var released Hold
+	req, err := c.signer.ReleaseRequest(c.NextId(), fileId, hold)
+	err = c.query(req, err, &released)
+	return &released, err
+}
+
+// ReadBalance returns the balance of user in file fileId with what holds reserve of it
+// and what is available.
+func (c *Client) ReadBalance(fileId string, user string) (*Balance, error) {
+	var balance Balance
+	req, err := c.signer.ReadBalanceRequest(c.NextId(), fileId, user)
+	err = c.query(req, err, &balance)
+	return &balance, err
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"io/ioutil"
+	"strings"
+)
+
+var WrongPasswordErr = errors.New("could not decrypt key with given password")
+var UnsupportedKeystoreErr = errors.New("unsupported keystore")
+
+// keystoreV3 is the version 3 web3 secret storage format written by geth and most wallets.
+type keystoreV3 struct {
+	Address string `json:"address"`
+	Crypto  struct {
+		Cipher       string `json:"cipher"`
+		CipherText   string `json:"ciphertext"`
+		CipherParams struct {
+			IV string `json:"iv"`
+		} `json:"cipherparams"`
+		KDF       string                 `json:"kdf"`
+		KDFParams map[string]interface{} `json:"kdfparams"`
+		MAC       string                 `json:"mac"`
+	} `json:"crypto"`
+	Version int `json:"version"`
+}
+
+// LoadPrivateKey reads a hex private key, with or without 0x, from file path.
+func LoadPrivateKey(path string) (*ecdsa.PrivateKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.HexToECDSA(strings.TrimPrefix(strings.TrimSpace(string(content)), "0x"))
+}
+
+// LoadKeystore decrypts the keystore file at path with password.
+func LoadKeystore(path string, password string) (*ecdsa.PrivateKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecryptKeystore(content, password)
+}
+
+// DecryptKeystore decrypts a version 3 keystore.
+func DecryptKeystore(keyJson []byte, password string) (*ecdsa.PrivateKey, error) {
+	var ks keystoreV3
+	err := json.Unmarshal(keyJson, &ks)
+	if err != nil {
+		return nil, err
+	}
+	if ks.Version != 3 {
+		return nil, fmt.Errorf("%s: version %d", UnsupportedKeystoreErr, ks.Version)
+	}
+	if ks.Crypto.Cipher != "aes-128-ctr" {
+		return nil, fmt.Errorf("%s: cipher %s", UnsupportedKeystoreErr, ks.Crypto.Cipher)
+	}
+	mac, err := hex.DecodeString(ks.Crypto.MAC)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := hex.DecodeString(ks.Crypto.CipherParams.IV)
+	if err != nil {
+		return nil, err
+	}
+	cipherText, err := hex.DecodeString(ks.Crypto.CipherText)
+	if err != nil {
+		return nil, err
+	}
+	derivedKey, err := deriveKey(ks.Crypto.KDF, ks.Crypto.KDFParams, password)
+	if err != nil {
+		return nil, err
+	}
+	calculatedMAC := crypto.Keccak256(derivedKey[16:32], cipherText)
+	if !bytes.Equal(calculatedMAC, mac) {
+		return nil, WrongPasswordErr
+	}
+	block, err := aes.NewCipher(derivedKey[:16])
+	if err != nil {
+		return nil, err
+	}
+	plainText := make([]byte, len(cipherText))
+	cipher.NewCTR(block, iv).XORKeyStream(plainText, cipherText)
+	key, err := crypto.ToECDSA(plainText)
+	if err != nil {
+		return nil, err
+	}
+	if "" != ks.Address && !strings.EqualFold(strings.TrimPrefix(ks.Address, "0x"), Address(key)[2:]) {
+		return nil, fmt.Errorf("keystore address %s does not match its key", ks.Address)
+	}
+	return key, nil
+}
+
+func deriveKey(kdf string, params map[string]interface{}, password string) ([]byte, error) {
+	salt, err := hex.DecodeString(stringParam(params, "salt"))
+	if err != nil {
+		return nil, err
+	}
+	dkLen := intParam(params, "dklen")
+	if dkLen < 32 {
+		return nil, fmt.Errorf("%s: dklen %d", UnsupportedKeystoreErr, dkLen)
+	}
+	switch kdf {
+	case "scrypt":
+		return scrypt.Key([]byte(password), salt, intParam(params, "n"), intParam(params, "r"), intParam(params, "p"), dkLen)
+	case "pbkdf2":
+		if stringParam(params, "prf") != "hmac-sha256" {
+			return nil, fmt.Errorf("%s: prf %s", UnsupportedKeystoreErr, stringParam(params, "prf"))
+		}
+		return pbkdf2.Key([]byte(password), salt, intParam(params, "c"), dkLen, sha256.New), nil
+	default:
+		return nil, fmt.Errorf("%s: kdf %s", UnsupportedKeystoreErr, kdf)
+	}
+}
+
+func stringParam(params map[string]interface{}, name string) string {
+	value, _ := params[name].(string)
+	return value
+}
+
+func intParam(params map[string]interface{}, name string) int {
+	// json numbers decode to float64
+	value, _ := params[name].(float64)
+	return int(value)
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"encoding/hex"
+	"github.com/ethereum/go-ethereum/crypto"
+	"testing"
+)
+
+// test vector of the web3 secret storage definition
+const pbkdf2Keystore = `{
+	"crypto": {
+		"cipher": "aes-128-ctr",
+		"cipherparams": {"iv": "6087dab2f9fdbbfaddc31a909735c1e6"},
+		"ciphertext": "5318b4d5bcd28de64ee5559e671353e16f075ecae9f99c7a79a38af5f869aa46",
+		"kdf": "pbkdf2",
+		"kdfparams": {
+			"c": 262144,
+			"dklen": 32,
+			"prf": "hmac-sha256",
+			"salt": "ae3cd4e7013836a3df6bd7241b12db061dbe2c6785853cce422d148a624ce0bd"
+		},
+		"mac": "517ead924a9d0dc3124507e3393d175ce3ff7c1e96529c6c555ce9e51205e9b2"
+	},
+	"id": "3198bc9c-6672-5ab3-d995-4942343ae5b6",
+	"version": 3
+}`
+
+func TestDecryptKeystore(t *testing.T) {
+	key, err := DecryptKeystore([]byte(pbkdf2Keystore), "testpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "7a28b5ba57c53603b0b07b56bba752f7784bf506fa95edc395f5cf6c7514fe9d"
+	if hex.EncodeToString(crypto.FromECDSA(key)) != expected {
+		t.Errorf("decrypted key %x, expected %s", crypto.FromECDSA(key), expected)
+	}
+	_, err = DecryptKeystore([]byte(pbkdf2Keystore), "wrong")
+	if err != WrongPasswordErr {
+		t.Errorf("expected WrongPasswordErr, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"kdc/pkg/reqsig"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+const jsonRpcVersion = "2.0"
+
+// Params are the parameters of a kdc request. Data holds the user a subtract or read
+// applies to.
+type Params struct {
+	FileId         string       `json:"fileId,omitempty"`
+	Data           string       `json:"data,omitempty"`
+	Amount         *hexutil.Big `json:"amount,omitempty"`
+	Signature      string       `json:"signature"`
+	SignatureType  string       `json:"signatureType,omitempty"`
+	Expiry         uint64       `json:"expiry,omitempty"`
+	From           uint64       `json:"from,omitempty"`
+	To             uint64       `json:"to,omitempty"`
+	Offset         uint64       `json:"offset,omitempty"`
+	Limit          uint64       `json:"limit,omitempty"`
+	Privilege      string       `json:"privilege,omitempty"`
+	Spender        string       `json:"spender,omitempty"`
+	Payee          string       `json:"payee,omitempty"`
+	Hold           uint64       `json:"hold,omitempty"`
+	Details        bool         `json:"details,omitempty"`
+	Operation      uint64       `json:"operation,omitempty"`
+	Reason         string       `json:"reason,omitempty"`
+	Reference      string       `json:"reference,omitempty"`
+	Memo           string       `json:"memo,omitempty"`
+	IdempotencyKey string       `json:"idempotencyKey,omitempty"`
+	Limits
+}
+
+// Request is a signed kdc json-rpc request.
+type Request struct {
+	JsonRpc string  `json:"jsonrpc"`
+	Method  string  `json:"method"`
+	Id      uint64  `json:"id"`
+	Params  *Params `json:"params"`
+}
+
+// WithMeta sets the reference and memo kdc records with the operations of the request.
+// They are not signed.
+func (r *Request) WithMeta(reference string, memo string) *Request {
+	r.Params.Reference, r.Params.Memo = reference, memo
+	return r
+}
+
+// WithIdempotencyKey makes kdc return the result of the first request with key to the
+// requests that retry it, signed again with the same fields, instead of repeating it.
+// Keys are scoped to the signer and the file.
+func (r *Request) WithIdempotencyKey(key string) *Request {
+	r.Params.IdempotencyKey = key
+	return r
+}
+
+// Signer signs requests with a key under the domain of a kdc deployment.
+type Signer struct {
+	Key    *ecdsa.PrivateKey
+	Domain reqsig.Domain
+	// reqsig.TypedData unless the deployment only accepts something else
+	Scheme reqsig.Scheme
+	// how long a signed subtract or privilege change stays valid, within the api.maxRequestLifetime of kdc
+	Lifetime time.Duration
+}
+
+// NewSigner returns a signer of eip-712 requests for the deployment on chain chainId
+// whose service address is service.
+func NewSigner(key *ecdsa.PrivateKey, chainId int64, service string) *Signer {
+	return &Signer{Key: key, Domain: reqsig.NewDomain(chainId, service), Scheme: reqsig.TypedData, Lifetime: 5 * time.Minute}
+}
+
+// Address returns the account of key in the checksummed form kdc compares against.
+func Address(key *ecdsa.PrivateKey) string {
+	return crypto.PubkeyToAddress(key.PublicKey).Hex()
+}
+
+// Address returns the account the signer signs for.
+func (s *Signer) Address() string {
+	return Address(s.Key)
+}
+
+// expiry returns the expiry of a request signed now, 0 for legacy requests.
+func (s *Signer) expiry() uint64 {
+	if s.Scheme == reqsig.Legacy {
+		return 0
+	}
+	return uint64(time.Now().Add(s.Lifetime).Unix())
+}
+
+func (s *Signer) sign(id uint64, msg *reqsig.Message, params *Params) (*Request, error) {
+	msg.Id = strconv.FormatUint(id, 10)
+	sig, err := msg.Sign(s.Key, s.Scheme, s.Domain)
+	if err != nil {
+		return nil, err
+	}
+	params.Signature = hex.EncodeToString(sig)
+	params.SignatureType = string(s.Scheme)
+	return &Request{jsonRpcVersion, msg.Method, id, params}, nil
+}
+
+// SubtractRequest builds the request spending amount of the signer's balance in file fileId.
+func (s *Signer) SubtractRequest(id uint64, fileId string, amount *big.Int) (*Request, error) {
+	return s.SubtractForRequest(id, fileId, s.Address(), amount)
+}
+
+// SubtractForRequest builds the request spending amount of the balance of user in file
+// fileId, which needs a delegation of user to the signer unless the signer is user.
+func (s *Signer) SubtractForRequest(id uint64, fileId string, user string, amount *big.Int) (*Request, error) {
+	return s.SubtractToRequest(id, fileId, user, amount, "")
+}
+
+// SubtractToRequest builds the request of SubtractForRequest crediting amount to payee,
+// or to the owner of the file when payee is empty.
+func (s *Signer) SubtractToRequest(id uint64, fileId string, user string, amount *big.Int, payee string) (*Request, error) {
+	expiry := s.expiry()
+	msg := &reqsig.Message{Method: "subtract", FileId: fileId, User: user, Amount: amount, Expiry: expiry}
+	if "" != payee {
+		// a subtract naming its payee is signed as a SubtractTo
+		msg.Method, msg.Payee = "subtractTo", payee
+	}
+	req, err := s.sign(id, msg, &Params{FileId: fileId, Data: user, Amount: (*hexutil.Big)(amount), Expiry: expiry, Payee: payee})
+	if err != nil {
+		return nil, err
+	}
+	req.Method = "subtract"
+	return req, nil
+}
+
+// ReadRequest builds the request reading the balance of user in file fileId.
+func (s *Signer) ReadRequest(id uint64, fileId string, user string) (*Request, error) {
+	msg := &reqsig.Message{Method: "read", FileId: fileId, User: user}
+	return s.sign(id, msg, &Params{FileId: fileId, Data: user})
+}
+
+// TerminateRequest builds the request terminating file fileId, the signer must be its owner.
+func (s *Signer) TerminateRequest(id uint64, fileId string) (*Request, error) {
+	expiry := s.expiry()
+	msg := &reqsig.Message{Method: "terminate", FileId: fileId, Expiry: expiry}
+	return s.sign(id, msg, &Params{FileId: fileId, Expiry: expiry})
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/pkg/reqsig"
+	"math/big"
+)
+
+// Roles accepted by GrantPrivilege, which also takes capabilities joined with "|",
+// e.g. "readOwn|charge". The capabilities are readOwn, readAll, charge, terminate and
+// manage.
+const (
+	Readwrite = "readwrite"
+	Readonly  = "readonly"
+	Write     = "write"
+	Manager   = "manager"
+	Owner     = "owner"
+)
+
+// Limits restrict a granted privilege, for temporary access. Zero values do not restrict.
+type Limits struct {
+	// unix times the privilege is valid from and until, both included
+	ValidFrom  uint64 `json:"validFrom,omitempty"`
+	ValidUntil uint64 `json:"validUntil,omitempty"`
+	// largest amount of one subtract
+	MaxAmount *hexutil.Big `json:"maxAmount,omitempty"`
+	// largest total of the subtracts of the last 24 hours
+	DailyCap *hexutil.Big `json:"dailyCap,omitempty"`
+}
+
+// PrivilegeEvent is one change of the privilege of a user in a file. Privilege and
+// Previous are a role, capabilities joined with "|", or "none".
+type PrivilegeEvent struct {
+	User      string `json:"user"`
+	Action    string `json:"action"`
+	Privilege string `json:"privilege"`
+	Limits
+	Previous  string `json:"previous"`
+	Actor     string `json:"actor"`
+	Signature string `json:"signature,omitempty"`
+	Time      int64  `json:"time"`
+}
+
+// GrantPrivilegeRequest builds the request giving user privilege in file fileId within
+// limits, or changing the one it has. The signer must hold the manage capability and every
+// capability it grants or takes away.
+func (s *Signer) GrantPrivilegeRequest(id uint64, fileId string, user string, privilege string, limits Limits) (*Request, error) {
+	expiry := s.expiry()
+	msg := &reqsig.Message{Method: "grantPrivilege", FileId: fileId, User: user, Privilege: privilege, Expiry: expiry,
+		ValidFrom: limits.ValidFrom, ValidUntil: limits.ValidUntil, MaxAmount: (*big.Int)(limits.MaxAmount), DailyCap: (*big.Int)(limits.DailyCap)}
+	return s.sign(id, msg, &Params{FileId: fileId, Data: user, Privilege: privilege, Expiry: expiry, Limits: limits})
+}
+
+// RevokePrivilegeRequest builds the request taking the privilege of user in file fileId
+// away, see GrantPrivilegeRequest.
+func (s *Signer) RevokePrivilegeRequest(id uint64, fileId string, user string) (*Request, error) {
+	expiry := s.expiry()
+	msg := &reqsig.Message{Method: "revokePrivilege", FileId: fileId, User: user, Expiry: expiry}
+	return s.sign(id, msg, &Params{FileId: fileId, Data: user, Expiry: expiry})
+}
+
+// ListPrivilegeEventsRequest builds the request reading the privilege changes of file fileId.
+func (s *Signer) ListPrivilegeEventsRequest(id uint64, fileId string) (*Request, error) {
+	return s.sign(id, &reqsig.Message{Method: "listPrivilegeEvents", FileId: fileId}, &Params{FileId: fileId})
+}
+
+// GrantPrivilege gives user privilege in file fileId within limits, see
+// GrantPrivilegeRequest.
+func (c *Client) GrantPrivilege(fileId string, user string, privilege string, limits Limits) (*PrivilegeEvent, error) {
+	var event PrivilegeEvent
+	req, err := c.signer.GrantPrivilegeRequest(c.NextId(), fileId, user, privilege, limits)
+	err = c.query(req, err, &event)
+	return &event, err
+}
+
+// RevokePrivilege takes the privilege of user in file fileId away, see
+// GrantPrivilegeRequest.
+func (c *Client) RevokePrivilege(fileId string, user string) (*PrivilegeEvent, error) {
+	var event PrivilegeEvent
+	req, err := c.signer.RevokePrivilegeRequest(c.NextId(), fileId, user)
+	err = c.query(req, err, &event)
+	return &event, err
+}
+
+// ListPrivilegeEvents returns the privilege changes of file fileId, oldest first.
+func (c *Client) ListPrivilegeEvents(fileId string) ([]PrivilegeEvent, error) {
+	var events []PrivilegeEvent
+	req, err := c.signer.ListPrivilegeEventsRequest(c.NextId(), fileId)
+	err = c.query(req, err, &events)
+	return events, err
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+	"encoding/json"
+	"kdc/pkg/reqsig"
+)
+
+// File is a file as returned by getFileInfo and listMyFiles.
+type File struct {
+	FileId     string `json:"fileId"`
+	Owner      string `json:"owner"`
+	State      string `json:"state"`
+	StartTime  int64  `json:"startTime"`
+	EndTime    int64  `json:"endTime"`
+	CreateTime int64  `json:"createTime"`
+	// privilege of the signer, only set by listMyFiles
+	Privilege string `json:"privilege,omitempty"`
+}
+
+// Settlement is a sync transaction of a file.
+type Settlement struct {
+	TxHash     string `json:"txHash"`
+	Terminate  bool   `json:"terminate"`
+	Chunk      int    `json:"chunk"`
+	ChunkCount int    `json:"chunkCount"`
+	Status     string `json:"status"`
+	CreateTime int64  `json:"createTime"`
+}
+
+// FileInfo is the result of getFileInfo.
+type FileInfo struct {
+	File
+	Settlements []Settlement `json:"settlements"`
+}
+
+// Participant is a user holding a privilege or a balance in a file. Balance, and Held
+// what active holds reserve of it, are hex quantities.
+type Participant struct {
+	User      string `json:"user"`
+	Privilege string `json:"privilege"`
+	Limits
+	Balance string `json:"balance"`
+	Held    string `json:"held"`
+}
+
+// Operation is one entry of the history of a file.
+type Operation struct {
+	Id        int64  `json:"id"`
+	User      string `json:"user"`
+	Operation string `json:"operation"`
+	Value     string `json:"value"`
+	Time      int64  `json:"time"`
+	// id of the subtract a reversal reverses
+	Reverses int64 `json:"reverses,omitempty"`
+	// what is known of the request the operation was made by, Request only with details
+	Reference string          `json:"reference,omitempty"`
+	Memo      string          `json:"memo,omitempty"`
+	Signer    string          `json:"signer,omitempty"`
+	RequestId string          `json:"requestId,omitempty"`
+	Request   json.RawMessage `json:"request,omitempty"`
+}
+
+// OperationFilter selects a page of the history of a file. Zero values do not filter.
+type OperationFilter struct {
+	User   string
+	From   uint64
+	To     uint64
+	Offset uint64
+	Limit  uint64
+}
+
+// Operations is the result of listOperations, Total counting every matching operation.
+type Operations struct {
+	Operations []Operation `json:"operations"`
+	Total      int         `json:"total"`
+	Offset     uint64      `json:"offset"`
+	Limit      int         `json:"limit"`
+}
+
+// GetFileInfoRequest builds the request reading file fileId and its settlements.
+func (s *Signer) GetFileInfoRequest(id uint64, fileId string) (*Request, error) {
+	return s.sign(id, &reqsig.Message{Method: "getFileInfo", FileId: fileId}, &Params{FileId: fileId})
+}
+
+// ListEarningsRequest builds the request reading what the subtracts of file fileId
+// credited to each payee.
+func (s *Signer) ListEarningsRequest(id uint64, fileId string) (*Request, error) {
+	return s.sign(id, &reqsig.Message{Method: "listEarnings", FileId: fileId}, &Params{FileId: fileId})
+}
+
+// ListParticipantsRequest builds the request listing the participants of file fileId.
+func (s *Signer) ListParticipantsRequest(id uint64, fileId string) (*Request, error) {
+	return s.sign(id, &reqsig.Message{Method: "listParticipants", FileId: fileId}, &Params{FileId: fileId})
+}
+
+// ListOperationsRequest builds the request reading the history of file fileId.
+func (s *Signer) ListOperationsRequest(id uint64, fileId string, filter OperationFilter) (*Request, error) {
+	msg := &reqsig.Message{Method: "listOperations", FileId: fileId, User: filter.User,
+		From: filter.From, To: filter.To, Offset: filter.Offset, Limit: filter.Limit}
+	return s.sign(id, msg, &Params{FileId: fileId, Data: filter.User,
+		From: filter.From, To: filter.To, Offset: filter.Offset, Limit: filter.Limit})
+}
+
+// ListMyFilesRequest builds the request listing the files the signer owns or has a
+// privilege in.
+func (s *Signer) ListMyFilesRequest(id uint64) (*Request, error) {
+	return s.sign(id, &reqsig.Message{Method: "listMyFiles"}, &Params{})
+}
+
+func (c *Client) query(req *Request, err error, result interface{}) error {
+	if err != nil {
+		return err
+	}
+	raw, err := c.Send(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, result)
+}
+
+// GetFileInfo returns file fileId and its settlements.
+func (c *Client) GetFileInfo(fileId string) (*FileInfo, error) {
+	var info FileInfo
+	req, err := c.signer.GetFileInfoRequest(c.NextId(), fileId)
+	err = c.query(req, err, &info)
+	return &info, err
+}
+
+// ListParticipants returns the privileges and balances of file fileId.
+func (c *Client) ListParticipants(fileId string) ([]Participant, error) {
+	var participants []Participant
+	req, err := c.signer.ListParticipantsRequest(c.NextId(), fileId)
+	err = c.query(req, err, &participants)
+	return participants, err
+}
+
+// ListEarnings returns the hex earnings of the payees of file fileId by payee, only the
+// client's own unless it may read all balances.
+func (c *Client) ListEarnings(fileId string) (map[string]string, error) {
+	var earnings map[string]string
+	req, err := c.signer.ListEarningsRequest(c.NextId(), fileId)
+	err = c.query(req, err, &earnings)
+	return earnings, err
+}
+
+// ListOperations returns a page of the history of file fileId.
+func (c *Client) ListOperations(fileId string, filter OperationFilter) (*Operations, error) {
+	var operations Operations
+	req, err := c.signer.ListOperationsRequest(c.NextId(), fileId, filter)
+	err = c.query(req, err, &operations)
+	return &operations, err
+}
+
+// ListMyFiles returns the files the client owns or has a privilege in.
+func (c *Client) ListMyFiles() ([]File, error) {
+	var files []File
+	req, err := c.signer.ListMyFilesRequest(c.NextId())
+	err = c.query(req, err, &files)
+	return files, err
+}
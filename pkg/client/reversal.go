@@ -0,0 +1,37 @@
+package client
+
+import (
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/pkg/reqsig"
+	"math/big"
+)
+
+// Reversal credits back Amount of the subtract Operation to User, taking it back from
+// Payee, the reversal being Id in the history of the file.
+type Reversal struct {
+	Operation int64        `json:"operation"`
+	Id        int64        `json:"id"`
+	User      string       `json:"user"`
+	Payee     string       `json:"payee,omitempty"`
+	Amount    *hexutil.Big `json:"amount"`
+	Reason    string       `json:"reason,omitempty"`
+	Time      int64        `json:"time"`
+}
+
+// ReverseRequest builds the request crediting amount of the subtract operation in file
+// fileId back to the user it was taken from. The signer must own the file or be granted refund.
+func (s *Signer) ReverseRequest(id uint64, fileId string, operation uint64, amount *big.Int, reason string) (*Request, error) {
+	expiry := s.expiry()
+	msg := &reqsig.Message{Method: "reverse", FileId: fileId, Operation: operation, Amount: amount, Reason: reason, Expiry: expiry}
+	return s.sign(id, msg, &Params{FileId: fileId, Operation: operation, Amount: (*hexutil.Big)(amount), Reason: reason,
+		Expiry: expiry})
+}
+
+// Reverse credits amount of the subtract operation in file fileId back to the user it
+// was taken from.
+func (c *Client) Reverse(fileId string, operation uint64, amount *big.Int, reason string) (*Reversal, error) {
+	var reversal Reversal
+	req, err := c.signer.ReverseRequest(c.NextId(), fileId, operation, amount, reason)
+	err = c.query(req, err, &reversal)
+	return &reversal, err
+}
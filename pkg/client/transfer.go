@@ -0,0 +1,24 @@
+package client
+
+import (
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"kdc/pkg/reqsig"
+	"math/big"
+)
+
+// TransferRequest builds the request moving amount from the signer's balance in file
+// fileId to the one of recipient, another participant of the file.
+func (s *Signer) TransferRequest(id uint64, fileId string, recipient string, amount *big.Int) (*Request, error) {
+	expiry := s.expiry()
+	msg := &reqsig.Message{Method: "transfer", FileId: fileId, Recipient: recipient, Amount: amount, Expiry: expiry}
+	return s.sign(id, msg, &Params{FileId: fileId, Data: recipient, Amount: (*hexutil.Big)(amount), Expiry: expiry})
+}
+
+// Transfer moves amount from the client's balance in file fileId to the one of
+// recipient, and returns the client's balance after it.
+func (c *Client) Transfer(fileId string, recipient string, amount *big.Int) (*big.Int, error) {
+	var balance hexutil.Big
+	req, err := c.signer.TransferRequest(c.NextId(), fileId, recipient, amount)
+	err = c.query(req, err, &balance)
+	return balance.ToInt(), err
+}
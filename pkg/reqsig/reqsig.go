@@ -0,0 +1,309 @@
+// Package reqsig computes and verifies the signatures of kdc api requests.
+//
+// Requests are signed as EIP-712 typed data under the kdc domain, with eth_signTypedData
+// or, for wallets without it, with personal_sign over the 32 byte typed data hash. The
+// legacy scheme signs the keccak256 of the concatenated request fields.
+package reqsig
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/big"
+	"strings"
+)
+
+type Scheme string
+
+const (
+	TypedData Scheme = "eip712"
+	Personal  Scheme = "personal"
+	Legacy    Scheme = "legacy"
+)
+
+var UnknownSchemeErr = errors.New("unknown signature type")
+var UnknownMethodErr = errors.New("unknown method")
+var BadAddressErr = errors.New("bad address")
+var BadSignatureErr = errors.New("bad signature")
+
+// Domain is the EIP-712 domain of a kdc deployment.
+type Domain struct {
+	Name              string         `json:"name"`
+	Version           string         `json:"version"`
+	ChainId           *big.Int       `json:"chainId"`
+	VerifyingContract common.Address `json:"verifyingContract"`
+}
+
+// NewDomain returns the kdc domain on chain chainId for the service at address service.
+func NewDomain(chainId int64, service string) Domain {
+	return Domain{
+		Name:              "kdc",
+		Version:           "1",
+		ChainId:           big.NewInt(chainId),
+		VerifyingContract: common.HexToAddress(service),
+	}
+}
+
+var domainTypeHash = crypto.Keccak256([]byte("EIP712Domain(string name,string version,uint256 chainId,address verifyingContract)"))
+
+// Separator returns the EIP-712 domain separator.
+func (d Domain) Separator() []byte {
+	return crypto.Keccak256(
+		domainTypeHash,
+		crypto.Keccak256([]byte(d.Name)),
+		crypto.Keccak256([]byte(d.Version)),
+		math.PaddedBigBytes(math.U256(new(big.Int).Set(d.ChainId)), 32),
+		common.LeftPadBytes(d.VerifyingContract.Bytes(), 32),
+	)
+}
+
+// MessageTypes are the EIP-712 types of the signed requests, by method.
+var MessageTypes = map[string]string{
+	"subtract":         "Subtract(string id,string fileId,address user,uint256 amount,uint256 expiry)",
+	"read":             "Read(string id,string fileId,address user)",
+	"terminate":        "Terminate(string id,string fileId,uint256 expiry)",
+	"getFileInfo":      "GetFileInfo(string id,string fileId)",
+	"listParticipants": "ListParticipants(string id,string fileId)",
+	"listOperations":   "ListOperations(string id,string fileId,string user,uint256 from,uint256 to,uint256 offset,uint256 limit)",
+	"listMyFiles":      "ListMyFiles(string id)",
+	"listEarnings":     "ListEarnings(string id,string fileId)",
+	// owner management
+	"grantPrivilege":      "GrantPrivilege(string id,string fileId,address user,string privilege,uint256 validFrom,uint256 validUntil,uint256 maxAmount,uint256 dailyCap,uint256 expiry)",
+	"revokePrivilege":     "RevokePrivilege(string id,string fileId,address user,uint256 expiry)",
+	"listPrivilegeEvents": "ListPrivilegeEvents(string id,string fileId)",
+	// session keys, amount being the cap of the delegation
+	"delegate":         "Delegate(string id,string fileId,address delegate,uint256 amount,uint256 validUntil,uint256 expiry)",
+	"revokeDelegation": "RevokeDelegation(string id,string fileId,address delegate,uint256 expiry)",
+	"listDelegations":  "ListDelegations(string id,string fileId)",
+	// allowances, charge being signed by the spender
+	"approve":   "Approve(string id,string fileId,address spender,uint256 amount,uint256 expiry)",
+	"charge":    "Charge(string id,string fileId,address user,uint256 amount,uint256 expiry)",
+	"allowance": "Allowance(string id,string fileId,address user,address spender)",
+	// a subtract naming the payee it is credited to
+	"subtractTo": "SubtractTo(string id,string fileId,address user,uint256 amount,address payee,uint256 expiry)",
+	// a transfer to another participant, signed by the sender
+	"transfer": "Transfer(string id,string fileId,address recipient,uint256 amount,uint256 expiry)",
+	// holds, reserved by the user, captured by it or the payee and released by the payee
+	"reserve": "Reserve(string id,string fileId,address payee,uint256 amount,uint256 validUntil,uint256 expiry)",
+	"capture": "Capture(string id,string fileId,uint256 hold,uint256 amount,uint256 expiry)",
+	"release": "Release(string id,string fileId,uint256 hold,uint256 expiry)",
+	// a reversal of a subtract, signed by the owner of the file or a user granted refund
+	"reverse": "Reverse(string id,string fileId,uint256 operation,uint256 amount,string reason,uint256 expiry)",
+}
+
+// methods that can be signed with the legacy scheme, which predates the others
+var legacyMethods = map[string]bool{"subtract": true, "read": true, "terminate": true}
+
+// Message holds the signed fields of a request. Only the fields of the method's type
+// are signed.
+type Message struct {
+	Method string
+	Id     string
+	FileId string
+	User   string
+	Amount *big.Int
+	// unix time after which the request is refused
+	Expiry uint64
+	// filters of listOperations
+	From   uint64
+	To     uint64
+	Offset uint64
+	Limit  uint64
+	// privilege granted by grantPrivilege: a role or capabilities joined with "|"
+	Privilege string
+	// limits of the privilege granted by grantPrivilege, zero for none
+	ValidFrom  uint64
+	ValidUntil uint64
+	MaxAmount  *big.Int
+	DailyCap   *big.Int
+	// session key or service address of a delegation
+	Delegate string
+	// address an allowance is given to
+	Spender string
+	// address a subtract is credited to
+	Payee string
+	// participant a transfer is credited to
+	Recipient string
+	// id of the hold captured or released
+	Hold uint64
+	// id of the subtract a reversal reverses, and why
+	Operation uint64
+	Reason    string
+}
+
+func (m *Message) value(name string) interface{} {
+	switch name {
+	case "id":
+		return m.Id
+	case "fileId":
+		return m.FileId
+	case "user":
+		return m.User
+	case "amount":
+		return m.Amount
+	case "expiry":
+		return new(big.Int).SetUint64(m.Expiry)
+	case "from":
+		return new(big.Int).SetUint64(m.From)
+	case "to":
+		return new(big.Int).SetUint64(m.To)
+	case "offset":
+		return new(big.Int).SetUint64(m.Offset)
+	case "limit":
+		return new(big.Int).SetUint64(m.Limit)
+	case "privilege":
+		return m.Privilege
+	case "validFrom":
+		return new(big.Int).SetUint64(m.ValidFrom)
+	case "validUntil":
+		return new(big.Int).SetUint64(m.ValidUntil)
+	case "maxAmount":
+		return orZero(m.MaxAmount)
+	case "dailyCap":
+		return orZero(m.DailyCap)
+	case "delegate":
+		return m.Delegate
+	case "spender":
+		return m.Spender
+	case "payee":
+		return m.Payee
+	case "recipient":
+		return m.Recipient
+	case "hold":
+		return new(big.Int).SetUint64(m.Hold)
+	case "operation":
+		return new(big.Int).SetUint64(m.Operation)
+	case "reason":
+		return m.Reason
+	}
+	return nil
+}
+
+func orZero(n *big.Int) *big.Int {
+	if nil == n {
+		return new(big.Int)
+	}
+	return n
+}
+
+// HashStruct returns the EIP-712 hash of the message.
+func (m *Message) HashStruct() ([]byte, error) {
+	messageType, ok := MessageTypes[m.Method]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", UnknownMethodErr, m.Method)
+	}
+	fields := [][]byte{crypto.Keccak256([]byte(messageType))}
+	members := messageType[strings.Index(messageType, "(")+1 : len(messageType)-1]
+	for _, member := range strings.Split(members, ",") {
+		var memberType, name string
+		fmt.Sscan(member, &memberType, &name)
+		switch value := m.value(name); memberType {
+		case "string":
+			fields = append(fields, crypto.Keccak256([]byte(value.(string))))
+		case "address":
+			if !common.IsHexAddress(value.(string)) {
+				return nil, fmt.Errorf("%w: %q", BadAddressErr, value)
+			}
+			fields = append(fields, common.LeftPadBytes(common.HexToAddress(value.(string)).Bytes(), 32))
+		case "uint256":
+			n, _ := value.(*big.Int)
+			if nil == n || n.Sign() < 0 || n.BitLen() > 256 {
+				return nil, fmt.Errorf("%s must be an uint256", name)
+			}
+			fields = append(fields, math.PaddedBigBytes(n, 32))
+		}
+	}
+	return crypto.Keccak256(fields...), nil
+}
+
+// TypedDataHash returns the hash signed by eth_signTypedData.
+func (m *Message) TypedDataHash(d Domain) ([]byte, error) {
+	hash, err := m.HashStruct()
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256([]byte{0x19, 0x01}, d.Separator(), hash), nil
+}
+
+// LegacyText returns the concatenation signed by the legacy scheme, which has no expiry.
+func (m *Message) LegacyText() string {
+	text := "2.0" + m.Method + m.Id + m.FileId
+	switch m.Method {
+	case "subtract":
+		amount := "<nil>"
+		if nil != m.Amount {
+			amount = hexutil.EncodeBig(m.Amount)
+		}
+		text += m.User + amount
+	case "read":
+		text += m.User
+	}
+	return text
+}
+
+// PersonalHash returns the hash personal_sign computes for data.
+func PersonalHash(data []byte) []byte {
+	return crypto.Keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d", len(data))), data)
+}
+
+// Digest returns the hash a signature of the message under scheme is made over.
+func (m *Message) Digest(scheme Scheme, d Domain) ([]byte, error) {
+	switch scheme {
+	case TypedData:
+		return m.TypedDataHash(d)
+	case Personal:
+		hash, err := m.TypedDataHash(d)
+		if err != nil {
+			return nil, err
+		}
+		return PersonalHash(hash), nil
+	case Legacy:
+		if !legacyMethods[m.Method] {
+			return nil, fmt.Errorf("%w: %s needs a typed data signature", UnknownSchemeErr, m.Method)
+		}
+		return crypto.Keccak256([]byte(m.LegacyText())), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", UnknownSchemeErr, scheme)
+	}
+}
+
+// Sign signs the message under scheme and returns a 65 byte signature with v 27 or 28,
+// as wallets produce, except for the legacy scheme which keeps v 0 or 1.
+func (m *Message) Sign(key *ecdsa.PrivateKey, scheme Scheme, d Domain) ([]byte, error) {
+	digest, err := m.Digest(scheme, d)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := crypto.Sign(digest, key)
+	if err != nil {
+		return nil, err
+	}
+	if scheme != Legacy {
+		sig[64] += 27
+	}
+	return sig, nil
+}
+
+// Recover returns the checksummed address that signed digest. v may be 0/1 or 27/28.
+func Recover(digest []byte, sig []byte) (string, error) {
+	if len(sig) != 65 {
+		return "", BadSignatureErr
+	}
+	normalized := make([]byte, 65)
+	copy(normalized, sig)
+	if normalized[64] >= 27 {
+		normalized[64] -= 27
+	}
+	if normalized[64] > 1 {
+		return "", BadSignatureErr
+	}
+	pub, err := crypto.SigToPub(digest, normalized)
+	if err != nil {
+		return "", err
+	}
+	return crypto.PubkeyToAddress(*pub).Hex(), nil
+}
@@ -0,0 +1,66 @@
+package reqsig
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/big"
+	"testing"
+)
+
+func TestSeparator(t *testing.T) {
+	// domain of the example in the eip-712 specification
+	d := Domain{
+		Name:              "Ether Mail",
+		Version:           "1",
+		ChainId:           big.NewInt(1),
+		VerifyingContract: common.HexToAddress("0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"),
+	}
+	expected := "0xf2cee375fa42b42143804025fc449deafd50cc031ca257e0b194a650a912090f"
+	if hexutil.Encode(d.Separator()) != expected {
+		t.Errorf("separator %s, expected %s", hexutil.Encode(d.Separator()), expected)
+	}
+}
+
+func TestSignAndRecover(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	addr := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	d := NewDomain(1, "0xa07b0fc50549c636ad4d7fbc6ea747574efb8e8a")
+	msg := &Message{Method: "subtract", Id: "1", FileId: "file1", User: addr, Amount: big.NewInt(2330)}
+	for _, scheme := range []Scheme{TypedData, Personal, Legacy} {
+		sig, err := msg.Sign(key, scheme, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, _ := msg.Digest(scheme, d)
+		signer, err := Recover(digest, sig)
+		if err != nil || signer != addr {
+			t.Errorf("%s: recovered %s, %v", scheme, signer, err)
+		}
+		// other chains must not accept the signature
+		other, _ := msg.Digest(scheme, NewDomain(2, "0xa07b0fc50549c636ad4d7fbc6ea747574efb8e8a"))
+		if signer, _ := Recover(other, sig); signer == addr && scheme != Legacy {
+			t.Errorf("%s: signature valid on another chain", scheme)
+		}
+	}
+	if msg.LegacyText() != "2.0subtract1file1"+addr+"0x91a" {
+		t.Errorf("unexpected legacy text %q", msg.LegacyText())
+	}
+	sig, _ := msg.Sign(key, TypedData, d)
+	sig[64] = 29
+	digest, _ := msg.Digest(TypedData, d)
+	if _, err := Recover(digest, sig); err != BadSignatureErr {
+		t.Errorf("expected BadSignatureErr for v=29, got %v", err)
+	}
+}
+
+func TestHashStructUser(t *testing.T) {
+	msg := &Message{Method: "read", Id: "1", FileId: "file1", User: "alice"}
+	if _, err := msg.HashStruct(); err == nil {
+		t.Error("expected an error for a user that is not an address")
+	}
+	msg = &Message{Method: "transfer", Id: "1", FileId: "file1"}
+	if _, err := msg.HashStruct(); err == nil {
+		t.Error("expected an error for an unknown method")
+	}
+}